@@ -313,8 +313,13 @@ ngrok.controller({
             };
 
             ws.onmessage = function(message) {
+                var data = JSON.parse(message.data);
                 $scope.$apply(function() {
-                    txnSvc.add(message.data);
+                    if (!!data.UiState) {
+                        $scope.tunnels = data.UiState.Tunnels;
+                    } else {
+                        txnSvc.add(message.data);
+                    }
                 });
             };
 
@@ -16,7 +16,10 @@ Examples:
 	ngrok 80
 	ngrok -subdomain=example 8080
 	ngrok -proto=tcp 22
+	ngrok -proto=tls -hostname="secure.example.com" 443
+	ngrok -proto=udp 53
 	ngrok -hostname="example.com" -httpauth="user:password" 10.0.0.1
+	ngrok -host-header=rewrite 8080
 
 
 Advanced usage: ngrok [OPTIONS] <command> [command args] [...]
@@ -36,16 +39,17 @@ Examples:
 `
 
 type Options struct {
-	config    string
-	logto     string
-	loglevel  string
-	authtoken string
-	httpauth  string
-	hostname  string
-	protocol  string
-	subdomain string
-	command   string
-	args      []string
+	config     string
+	logto      string
+	loglevel   string
+	authtoken  string
+	httpauth   string
+	hostname   string
+	protocol   string
+	subdomain  string
+	hostHeader string
+	command    string
+	args       []string
 }
 
 func ParseArgs() (opts *Options, err error) {
@@ -90,23 +94,29 @@ func ParseArgs() (opts *Options, err error) {
 		"",
 		"Request a custom hostname from the ngrok server. (HTTP only) (requires CNAME of your DNS)")
 
+	hostHeader := flag.String(
+		"host-header",
+		"",
+		"Rewrite the Host header of requests to this value, or to the local address with 'rewrite'. (HTTP only)")
+
 	protocol := flag.String(
 		"proto",
 		"http+https",
-		"The protocol of the traffic over the tunnel {'http', 'https', 'tcp'} (default: 'http+https')")
+		"The protocol of the traffic over the tunnel {'http', 'https', 'tcp', 'tls', 'udp'} (default: 'http+https')")
 
 	flag.Parse()
 
 	opts = &Options{
-		config:    *config,
-		logto:     *logto,
-		loglevel:  *loglevel,
-		httpauth:  *httpauth,
-		subdomain: *subdomain,
-		protocol:  *protocol,
-		authtoken: *authtoken,
-		hostname:  *hostname,
-		command:   flag.Arg(0),
+		config:     *config,
+		logto:      *logto,
+		loglevel:   *loglevel,
+		httpauth:   *httpauth,
+		subdomain:  *subdomain,
+		protocol:   *protocol,
+		authtoken:  *authtoken,
+		hostname:   *hostname,
+		hostHeader: *hostHeader,
+		command:    flag.Arg(0),
 	}
 
 	switch opts.command {
@@ -1,10 +1,12 @@
 package client
 
 import (
+	"crypto/tls"
 	"fmt"
 	"gopkg.in/yaml.v1"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"net/url"
 	"ngrok/log"
 	"os"
@@ -27,11 +29,80 @@ type Configuration struct {
 }
 
 type TunnelConfiguration struct {
-	Subdomain  string            `yaml:"subdomain,omitempty"`
-	Hostname   string            `yaml:"hostname,omitempty"`
-	Protocols  map[string]string `yaml:"proto,omitempty"`
-	HttpAuth   string            `yaml:"auth,omitempty"`
-	RemotePort uint16            `yaml:"remote_port,omitempty"`
+	Subdomain  string             `yaml:"subdomain,omitempty"`
+	Hostname   string             `yaml:"hostname,omitempty"`
+	Protocols  map[string]string  `yaml:"proto,omitempty"`
+	HttpAuth   string             `yaml:"auth,omitempty"`
+	AuthUsers  []string           `yaml:"auth_users,omitempty"`
+	AuthTokens []string           `yaml:"auth_tokens,omitempty"`
+	AuthRealm  string             `yaml:"auth_realm,omitempty"`
+	RemotePort uint16             `yaml:"remote_port,omitempty"`
+	Crt        string             `yaml:"crt,omitempty"`
+	Key        string             `yaml:"key,omitempty"`
+	AllowCIDRs []string           `yaml:"allow_cidrs,omitempty"`
+	DenyCIDRs  []string           `yaml:"deny_cidrs,omitempty"`
+	Oidc       *OidcConfiguration `yaml:"oidc,omitempty"`
+
+	// what ngrokd speaks to the local service for requests which
+	// arrive over HTTP/2: http1 or http2 (h2c), as gRPC needs
+	AppProtocol string `yaml:"app_protocol,omitempty"`
+
+	// tell the local service the address of the public client, with
+	// X-Forwarded-* and Forwarded headers for http tunnels or a PROXY
+	// protocol header of version 1 or 2 for tcp and tls tunnels
+	ForwardedHeaders bool `yaml:"forwarded_headers,omitempty"`
+	ProxyProtocol    int  `yaml:"proxy_protocol,omitempty"`
+
+	// the Host header requests reach the local service with: rewrite for
+	// the local address, or a fixed host. The original is kept in
+	// X-Forwarded-Host.
+	HostHeader string `yaml:"host_header,omitempty"`
+
+	// headers added to, set on or removed from http requests before
+	// they reach the local service, and from its responses
+	RequestHeaders  *HeaderRules `yaml:"request_headers,omitempty"`
+	ResponseHeaders *HeaderRules `yaml:"response_headers,omitempty"`
+
+	// share the hostname with the tunnels of other clients which use the
+	// same secret, public connections are balanced across all of them:
+	// round_robin or least_connections
+	GroupSecret string              `yaml:"group_secret,omitempty"`
+	Balance     string              `yaml:"balance,omitempty"`
+	Route       *RouteConfiguration `yaml:"route,omitempty"`
+
+	// loaded from crt and key to terminate TLS for https connections locally
+	tlsConfig *tls.Config
+}
+
+// Headers are given as "Name: value". Removals apply first, then set
+// replaces any values a header has and add appends another value.
+type HeaderRules struct {
+	Add    []string `yaml:"add,omitempty"`
+	Set    []string `yaml:"set,omitempty"`
+	Remove []string `yaml:"remove,omitempty"`
+
+	// parsed from Add and Set
+	add http.Header
+	set http.Header
+}
+
+type OidcConfiguration struct {
+	Issuer       string   `yaml:"issuer,omitempty"`
+	ClientId     string   `yaml:"client_id,omitempty"`
+	ClientSecret string   `yaml:"client_secret,omitempty"`
+	EmailDomains []string `yaml:"email_domains,omitempty"`
+	Subjects     []string `yaml:"subjects,omitempty"`
+}
+
+// The http requests of its group a tunnel gets: those with the header,
+// "Name: value", or the cookie, "name=value", and weight percent of the
+// requests no member's header or cookie matches. The server routes HTTP/1.1
+// connections by their first request, the requests which follow it on a
+// kept-alive connection go to the same tunnel.
+type RouteConfiguration struct {
+	Header string `yaml:"header,omitempty"`
+	Cookie string `yaml:"cookie,omitempty"`
+	Weight int    `yaml:"weight,omitempty"`
 }
 
 func LoadConfiguration(opts *Options) (config *Configuration, err error) {
@@ -104,32 +175,9 @@ func LoadConfiguration(opts *Options) (config *Configuration, err error) {
 	}
 
 	for name, t := range config.Tunnels {
-		if t == nil || t.Protocols == nil || len(t.Protocols) == 0 {
-			err = fmt.Errorf("Tunnel %s does not specify any protocols to tunnel.", name)
+		if err = normalizeTunnel(name, t); err != nil {
 			return
 		}
-
-		for k, addr := range t.Protocols {
-			tunnelName := fmt.Sprintf("for tunnel %s[%s]", name, k)
-			if t.Protocols[k], err = normalizeAddress(addr, tunnelName); err != nil {
-				return
-			}
-
-			if err = validateProtocol(k, tunnelName); err != nil {
-				return
-			}
-		}
-
-		// use the name of the tunnel as the subdomain if none is specified
-		if t.Hostname == "" && t.Subdomain == "" {
-			// XXX: a crude heuristic, really we should be checking if the last part
-			// is a TLD
-			if len(strings.Split(name, ".")) > 1 {
-				t.Hostname = name
-			} else {
-				t.Subdomain = name
-			}
-		}
 	}
 
 	// override configuration with command-line options
@@ -144,10 +192,11 @@ func LoadConfiguration(opts *Options) (config *Configuration, err error) {
 	case "default":
 		config.Tunnels = make(map[string]*TunnelConfiguration)
 		config.Tunnels["default"] = &TunnelConfiguration{
-			Subdomain: opts.subdomain,
-			Hostname:  opts.hostname,
-			HttpAuth:  opts.httpauth,
-			Protocols: make(map[string]string),
+			Subdomain:  opts.subdomain,
+			Hostname:   opts.hostname,
+			HttpAuth:   opts.httpauth,
+			HostHeader: opts.hostHeader,
+			Protocols:  make(map[string]string),
 		}
 
 		for _, proto := range strings.Split(opts.protocol, "+") {
@@ -160,6 +209,12 @@ func LoadConfiguration(opts *Options) (config *Configuration, err error) {
 			}
 		}
 
+		if opts.hostHeader != "" {
+			if err = validateHostHeader("default", config.Tunnels["default"]); err != nil {
+				return
+			}
+		}
+
 	// list tunnels
 	case "list":
 		for name, _ := range config.Tunnels {
@@ -201,6 +256,301 @@ func LoadConfiguration(opts *Options) (config *Configuration, err error) {
 	return
 }
 
+// validate and normalize the configuration of a single tunnel
+func normalizeTunnel(name string, t *TunnelConfiguration) (err error) {
+	if t == nil || t.Protocols == nil || len(t.Protocols) == 0 {
+		err = fmt.Errorf("Tunnel %s does not specify any protocols to tunnel.", name)
+		return
+	}
+
+	for k, addr := range t.Protocols {
+		tunnelName := fmt.Sprintf("for tunnel %s[%s]", name, k)
+		if t.Protocols[k], err = normalizeAddress(addr, tunnelName); err != nil {
+			return
+		}
+
+		if err = validateProtocol(k, tunnelName); err != nil {
+			return
+		}
+	}
+
+	if t.Crt != "" || t.Key != "" {
+		if err = loadTunnelTLS(name, t); err != nil {
+			return
+		}
+	}
+
+	if t.Oidc != nil {
+		if err = validateOidc(name, t); err != nil {
+			return
+		}
+	}
+
+	if t.AppProtocol != "" {
+		if err = validateAppProtocol(name, t); err != nil {
+			return
+		}
+	}
+
+	if t.ForwardedHeaders || t.ProxyProtocol != 0 {
+		if err = validateForwarding(name, t); err != nil {
+			return
+		}
+	}
+
+	if t.HostHeader != "" {
+		if err = validateHostHeader(name, t); err != nil {
+			return
+		}
+	}
+
+	if t.RequestHeaders != nil || t.ResponseHeaders != nil {
+		if err = validateHeaderRules(name, t); err != nil {
+			return
+		}
+	}
+
+	if t.GroupSecret != "" || t.Balance != "" || t.Route != nil {
+		if err = validateGroup(name, t); err != nil {
+			return
+		}
+	}
+
+	// use the name of the tunnel as the subdomain if none is specified
+	if t.Hostname == "" && t.Subdomain == "" {
+		// XXX: a crude heuristic, really we should be checking if the last part
+		// is a TLD
+		if len(strings.Split(name, ".")) > 1 {
+			t.Hostname = name
+		} else {
+			t.Subdomain = name
+		}
+	}
+
+	return
+}
+
+// load the certificate an https tunnel terminates TLS with locally
+func loadTunnelTLS(name string, t *TunnelConfiguration) error {
+	if t.Crt == "" || t.Key == "" {
+		return fmt.Errorf("Tunnel %s must specify both crt and key to terminate TLS locally.", name)
+	}
+
+	https := false
+	for _, proto := range tunnelProtocols(t) {
+		if proto == "https" {
+			https = true
+		}
+	}
+	if !https {
+		return fmt.Errorf("Tunnel %s specifies crt and key, but they only apply to https tunnels.", name)
+	}
+
+	// the server never sees the requests so it can't check their credentials
+	if t.HttpAuth != "" || len(t.AuthUsers) > 0 || len(t.AuthTokens) > 0 {
+		return fmt.Errorf("Tunnel %s can't use auth together with crt and key.", name)
+	}
+
+	if t.Oidc != nil {
+		return fmt.Errorf("Tunnel %s can't use oidc together with crt and key.", name)
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.Crt, t.Key)
+	if err != nil {
+		return fmt.Errorf("Failed to load crt and key for tunnel %s: %v", name, err)
+	}
+
+	t.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return nil
+}
+
+// check the OpenID Connect login browsers must complete for an http tunnel
+func validateOidc(name string, t *TunnelConfiguration) error {
+	if t.Oidc.Issuer == "" || t.Oidc.ClientId == "" {
+		return fmt.Errorf("Tunnel %s must specify an issuer and client_id for oidc.", name)
+	}
+
+	if !onlyProtocols(t, "http", "https") {
+		return fmt.Errorf("Tunnel %s specifies oidc, but it only applies to http and https tunnels.", name)
+	}
+	return nil
+}
+
+// check the protocol ngrokd speaks to the local service of an http tunnel
+func validateAppProtocol(name string, t *TunnelConfiguration) error {
+	if t.AppProtocol != "http1" && t.AppProtocol != "http2" {
+		return fmt.Errorf("Tunnel %s specifies app_protocol %s, expected http1 or http2.", name, t.AppProtocol)
+	}
+
+	if !onlyProtocols(t, "http", "https") {
+		return fmt.Errorf("Tunnel %s specifies app_protocol, but it only applies to http and https tunnels.", name)
+	}
+
+	// h2c is passed on without being decoded, so its requests can't be rewritten
+	if t.AppProtocol == "http2" && (t.ForwardedHeaders || t.HostHeader != "" || t.RequestHeaders != nil || t.ResponseHeaders != nil) {
+		return fmt.Errorf("Tunnel %s can't use forwarded_headers, host_header or header rules together with app_protocol http2.", name)
+	}
+	return nil
+}
+
+// check how a tunnel passes the address of the public client on
+func validateForwarding(name string, t *TunnelConfiguration) error {
+	if t.ProxyProtocol != 0 && t.ProxyProtocol != 1 && t.ProxyProtocol != 2 {
+		return fmt.Errorf("Tunnel %s specifies proxy_protocol %d, expected 1 or 2.", name, t.ProxyProtocol)
+	}
+
+	if t.ForwardedHeaders && !onlyProtocols(t, "http", "https") {
+		return fmt.Errorf("Tunnel %s specifies forwarded_headers, but it only applies to http and https tunnels.", name)
+	}
+
+	if t.ProxyProtocol != 0 && !onlyProtocols(t, "tcp", "tls") {
+		return fmt.Errorf("Tunnel %s specifies proxy_protocol, but it only applies to tcp and tls tunnels.", name)
+	}
+	return nil
+}
+
+// check the Host header an http tunnel's requests are rewritten to
+func validateHostHeader(name string, t *TunnelConfiguration) error {
+	if strings.ContainsAny(t.HostHeader, " \t\r\n/") {
+		return fmt.Errorf("Tunnel %s specifies an invalid host_header %s.", name, t.HostHeader)
+	}
+
+	if !onlyProtocols(t, "http", "https") {
+		return fmt.Errorf("Tunnel %s specifies host_header, but it only applies to http and https tunnels.", name)
+	}
+	return nil
+}
+
+// check and parse the header rules of an http tunnel
+func validateHeaderRules(name string, t *TunnelConfiguration) error {
+	if !onlyProtocols(t, "http", "https") {
+		return fmt.Errorf("Tunnel %s specifies header rules, but they only apply to http and https tunnels.", name)
+	}
+
+	// headers which describe how messages are framed are never rewritten
+	check := func(key string) error {
+		switch http.CanonicalHeaderKey(key) {
+		case "Host":
+			return fmt.Errorf("Tunnel %s can't rewrite the Host header with header rules, use host_header instead.", name)
+		case "Content-Length", "Transfer-Encoding", "Trailer", "Connection", "Upgrade":
+			return fmt.Errorf("Tunnel %s can't rewrite the %s header.", name, key)
+		}
+		return nil
+	}
+
+	parse := func(lines []string) (http.Header, error) {
+		h := make(http.Header)
+		for _, line := range lines {
+			parts := strings.SplitN(line, ":", 2)
+			key := strings.TrimSpace(parts[0])
+			if len(parts) != 2 || key == "" || strings.ContainsAny(key, " \t") {
+				return nil, fmt.Errorf("Tunnel %s has an invalid header rule %s, expected Name: value.", name, line)
+			}
+
+			if err := check(key); err != nil {
+				return nil, err
+			}
+			h.Add(key, strings.TrimSpace(parts[1]))
+		}
+		return h, nil
+	}
+
+	for _, r := range []*HeaderRules{t.RequestHeaders, t.ResponseHeaders} {
+		if r == nil {
+			continue
+		}
+
+		var err error
+		if r.add, err = parse(r.Add); err != nil {
+			return err
+		}
+		if r.set, err = parse(r.Set); err != nil {
+			return err
+		}
+		for _, key := range r.Remove {
+			if err = check(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// check the tunnel group a tunnel shares its hostname with
+func validateGroup(name string, t *TunnelConfiguration) error {
+	if t.GroupSecret == "" {
+		return fmt.Errorf("Tunnel %s specifies balance or route, but they only apply to tunnels with a group_secret.", name)
+	}
+
+	switch t.Balance {
+	case "", "round_robin", "least_connections":
+	default:
+		return fmt.Errorf("Tunnel %s specifies balance %s, expected round_robin or least_connections.", name, t.Balance)
+	}
+
+	if !onlyProtocols(t, "http", "https", "tls") {
+		return fmt.Errorf("Tunnel %s specifies group_secret, but it only applies to http, https and tls tunnels.", name)
+	}
+
+	if t.Route != nil {
+		return validateRoute(name, t)
+	}
+	return nil
+}
+
+// check the rules by which requests of a tunnel group are routed to a tunnel
+func validateRoute(name string, t *TunnelConfiguration) error {
+	r := t.Route
+	if !onlyProtocols(t, "http", "https") {
+		return fmt.Errorf("Tunnel %s specifies route, but it only applies to http and https tunnels.", name)
+	}
+
+	// ngrokd never sees the requests which it passes through encrypted
+	if t.Crt != "" {
+		return fmt.Errorf("Tunnel %s can't use route together with crt and key.", name)
+	}
+
+	if r.Weight < 0 || r.Weight > 100 {
+		return fmt.Errorf("Tunnel %s specifies route weight %d, expected a percentage between 0 and 100.", name, r.Weight)
+	}
+
+	if parts := strings.SplitN(r.Header, ":", 2); r.Header != "" && (len(parts) != 2 || strings.TrimSpace(parts[0]) == "") {
+		return fmt.Errorf("Tunnel %s has an invalid route header %s, expected Name: value.", name, r.Header)
+	}
+
+	if parts := strings.SplitN(r.Cookie, "=", 2); r.Cookie != "" && (len(parts) != 2 || strings.TrimSpace(parts[0]) == "") {
+		return fmt.Errorf("Tunnel %s has an invalid route cookie %s, expected name=value.", name, r.Cookie)
+	}
+
+	if r.Header == "" && r.Cookie == "" && r.Weight == 0 {
+		return fmt.Errorf("Tunnel %s specifies route without a header, cookie or weight.", name)
+	}
+	return nil
+}
+
+// the protocols a tunnel is opened for, each of a combined one like
+// http+https counted on its own
+func tunnelProtocols(t *TunnelConfiguration) (protos []string) {
+	for k, _ := range t.Protocols {
+		protos = append(protos, strings.Split(k, "+")...)
+	}
+	return
+}
+
+// whether a tunnel is only opened for the given protocols
+func onlyProtocols(t *TunnelConfiguration, allowed ...string) bool {
+	for _, proto := range tunnelProtocols(t) {
+		ok := false
+		for _, a := range allowed {
+			ok = ok || proto == a
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
 func defaultPath() string {
 	user, err := user.Current()
 
@@ -236,7 +586,7 @@ func normalizeAddress(addr string, propName string) (string, error) {
 
 func validateProtocol(proto, propName string) (err error) {
 	switch proto {
-	case "http", "https", "http+https", "tcp":
+	case "http", "https", "http+https", "tcp", "tls", "udp":
 	default:
 		err = fmt.Errorf("Invalid protocol for %s: %s", propName, proto)
 	}
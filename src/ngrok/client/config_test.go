@@ -0,0 +1,63 @@
+package client
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTunnel(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		t    TunnelConfiguration
+		err  string
+	}{
+		{"http", TunnelConfiguration{Protocols: map[string]string{"http+https": "8080"}}, ""},
+		{"none", TunnelConfiguration{}, "does not specify any protocols"},
+		{"bad proto", TunnelConfiguration{Protocols: map[string]string{"ftp": "21"}}, "Invalid protocol"},
+		{"h2c", TunnelConfiguration{Protocols: map[string]string{"https": "50051"}, AppProtocol: "http2"}, ""},
+		{"h3", TunnelConfiguration{Protocols: map[string]string{"https": "50051"}, AppProtocol: "http3"}, "expected http1 or http2"},
+		{"tcp h2c", TunnelConfiguration{Protocols: map[string]string{"tcp": "50051"}, AppProtocol: "http2"}, "only applies to http and https"},
+		{"h2c forwarded", TunnelConfiguration{Protocols: map[string]string{"https": "50051"}, AppProtocol: "http2", ForwardedHeaders: true}, "app_protocol http2"},
+		{"h2c host", TunnelConfiguration{Protocols: map[string]string{"https": "50051"}, AppProtocol: "http2", HostHeader: "rewrite"}, "app_protocol http2"},
+		{"h2c rules", TunnelConfiguration{Protocols: map[string]string{"https": "50051"}, AppProtocol: "http2", ResponseHeaders: &HeaderRules{Remove: []string{"Server"}}}, "app_protocol http2"},
+		{"h1 rules", TunnelConfiguration{Protocols: map[string]string{"https": "8080"}, AppProtocol: "http1", RequestHeaders: &HeaderRules{Set: []string{"X-Env: dev"}}}, ""},
+		{"forwarded", TunnelConfiguration{Protocols: map[string]string{"http+https": "8080"}, ForwardedHeaders: true}, ""},
+		{"tcp forwarded", TunnelConfiguration{Protocols: map[string]string{"http": "8080", "tcp": "22"}, ForwardedHeaders: true}, "forwarded_headers"},
+		{"proxy protocol", TunnelConfiguration{Protocols: map[string]string{"tcp": "22"}, ProxyProtocol: 2}, ""},
+		{"http proxy protocol", TunnelConfiguration{Protocols: map[string]string{"http": "80"}, ProxyProtocol: 1}, "proxy_protocol"},
+		{"rules on tcp", TunnelConfiguration{Protocols: map[string]string{"tcp": "22"}, RequestHeaders: &HeaderRules{Remove: []string{"X-Env"}}}, "header rules"},
+		{"framing rule", TunnelConfiguration{Protocols: map[string]string{"http": "80"}, RequestHeaders: &HeaderRules{Remove: []string{"content-length"}}}, "can't rewrite"},
+		{"group", TunnelConfiguration{Protocols: map[string]string{"tls": "443"}, GroupSecret: "s3cret"}, ""},
+		{"tcp group", TunnelConfiguration{Protocols: map[string]string{"tcp": "22"}, GroupSecret: "s3cret"}, "group_secret"},
+		{"tls route", TunnelConfiguration{Protocols: map[string]string{"tls": "443"}, GroupSecret: "s3cret", Route: &RouteConfiguration{Weight: 10}}, "route"},
+		{"host header on tcp", TunnelConfiguration{Protocols: map[string]string{"tcp": "22"}, HostHeader: "rewrite"}, "host_header"},
+	} {
+		tun := c.t
+		err := normalizeTunnel(c.name, &tun)
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s: %v", c.name, err)
+		case c.err != "" && err == nil:
+			t.Errorf("%s: expected an error", c.name)
+		case c.err != "" && !strings.Contains(err.Error(), c.err):
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		}
+	}
+}
+
+func TestOnlyProtocols(t *testing.T) {
+	for _, c := range []struct {
+		protocols map[string]string
+		ok        bool
+	}{
+		{map[string]string{"http": "80"}, true},
+		{map[string]string{"http+https": "80"}, true},
+		{map[string]string{"http": "80", "https": "443"}, true},
+		{map[string]string{"http+tcp": "80"}, false},
+		{map[string]string{"http": "80", "tls": "443"}, false},
+	} {
+		if ok := onlyProtocols(&TunnelConfiguration{Protocols: c.protocols}, "http", "https"); ok != c.ok {
+			t.Errorf("onlyProtocols(%v) = %v, expected %v", c.protocols, ok, c.ok)
+		}
+	}
+}
@@ -83,6 +83,14 @@ func (ctl *Controller) PlayRequest(tunnel mvc.Tunnel, payload []byte) {
 	ctl.cmds <- cmdPlayRequest{tunnel: tunnel, payload: payload}
 }
 
+func (ctl *Controller) StartTunnel(name string, config []byte) ([]mvc.Tunnel, error) {
+	return ctl.model.StartTunnel(name, config)
+}
+
+func (ctl *Controller) StopTunnel(name string) error {
+	return ctl.model.StopTunnel(name)
+}
+
 func (ctl *Controller) Go(fn func()) {
 	go func() {
 		defer func() {
@@ -3,10 +3,13 @@ package client
 import (
 	"crypto/tls"
 	"fmt"
+	"github.com/hashicorp/yamux"
 	metrics "github.com/rcrowley/go-metrics"
+	"gopkg.in/yaml.v1"
 	"io/ioutil"
 	"math"
 	"net"
+	"net/http"
 	"ngrok/client/mvc"
 	"ngrok/conn"
 	"ngrok/log"
@@ -16,6 +19,7 @@ import (
 	"ngrok/version"
 	"runtime"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -34,9 +38,19 @@ const (
 `
 )
 
+// how long the local api waits for the server to open a tunnel
+var tunnelReqTimeout = 30 * time.Second
+
 type ClientModel struct {
 	log.Logger
 
+	// guards tunnels, tunnelConfig, reqs, abandoned and ctlConn which are shared
+	// between the control loop, proxy connections, views and the local api
+	sync.RWMutex
+
+	// serializes writes to the control connection
+	ctlWriteLock sync.Mutex
+
 	id            string
 	tunnels       map[string]mvc.Tunnel
 	serverVersion string
@@ -52,6 +66,32 @@ type ClientModel struct {
 	tlsConfig     *tls.Config
 	tunnelConfig  map[string]*TunnelConfiguration
 	configPath    string
+	ctlConn       conn.Conn
+	reqs          map[string]*tunnelReq
+
+	// NewTunnel responses still expected for tunnel requests the local
+	// api gave up on, by request id
+	abandoned map[string]int
+
+	// TLS configs of https tunnels which terminate TLS locally, by public url
+	localTLS map[string]*tls.Config
+}
+
+// A ReqTunnel which is waiting for the server to respond with NewTunnels
+type tunnelReq struct {
+	id     string
+	name   string
+	config *TunnelConfiguration
+
+	// number of NewTunnel responses still expected
+	pending int
+
+	// tunnels opened so far
+	tunnels []mvc.Tunnel
+
+	// receives the result for tunnels requested through the local api,
+	// nil for tunnels requested from the configuration file
+	done chan error
 }
 
 func newClientModel(config *Configuration, ctl mvc.Controller) *ClientModel {
@@ -59,6 +99,8 @@ func newClientModel(config *Configuration, ctl mvc.Controller) *ClientModel {
 	protoMap["http"] = proto.NewHttp()
 	protoMap["https"] = protoMap["http"]
 	protoMap["tcp"] = proto.NewTcp()
+	protoMap["tls"] = protoMap["tcp"]
+	protoMap["udp"] = protoMap["tcp"]
 	protocols := []proto.Protocol{protoMap["http"], protoMap["tcp"]}
 
 	m := &ClientModel{
@@ -91,6 +133,15 @@ func newClientModel(config *Configuration, ctl mvc.Controller) *ClientModel {
 		// open tunnels
 		tunnels: make(map[string]mvc.Tunnel),
 
+		// outstanding tunnel requests
+		reqs: make(map[string]*tunnelReq),
+
+		// tunnel requests given up on
+		abandoned: make(map[string]int),
+
+		// tunnels which terminate TLS locally
+		localTLS: make(map[string]*tls.Config),
+
 		// controller
 		ctl: ctl,
 
@@ -133,31 +184,34 @@ func serverName(addr string) string {
 }
 
 // mvc.State interface
-func (c ClientModel) GetProtocols() []proto.Protocol { return c.protocols }
-func (c ClientModel) GetClientVersion() string       { return version.MajorMinor() }
-func (c ClientModel) GetServerVersion() string       { return c.serverVersion }
-func (c ClientModel) GetTunnels() []mvc.Tunnel {
+func (c *ClientModel) GetProtocols() []proto.Protocol { return c.protocols }
+func (c *ClientModel) GetClientVersion() string       { return version.MajorMinor() }
+func (c *ClientModel) GetServerVersion() string       { return c.serverVersion }
+func (c *ClientModel) GetTunnels() []mvc.Tunnel {
+	c.RLock()
+	defer c.RUnlock()
+
 	tunnels := make([]mvc.Tunnel, 0)
 	for _, t := range c.tunnels {
 		tunnels = append(tunnels, t)
 	}
 	return tunnels
 }
-func (c ClientModel) GetConnStatus() mvc.ConnStatus     { return c.connStatus }
-func (c ClientModel) GetUpdateStatus() mvc.UpdateStatus { return c.updateStatus }
+func (c *ClientModel) GetConnStatus() mvc.ConnStatus     { return c.connStatus }
+func (c *ClientModel) GetUpdateStatus() mvc.UpdateStatus { return c.updateStatus }
 
-func (c ClientModel) GetConnectionMetrics() (metrics.Meter, metrics.Timer) {
+func (c *ClientModel) GetConnectionMetrics() (metrics.Meter, metrics.Timer) {
 	return c.metrics.connMeter, c.metrics.connTimer
 }
 
-func (c ClientModel) GetBytesInMetrics() (metrics.Counter, metrics.Histogram) {
+func (c *ClientModel) GetBytesInMetrics() (metrics.Counter, metrics.Histogram) {
 	return c.metrics.bytesInCount, c.metrics.bytesIn
 }
 
-func (c ClientModel) GetBytesOutMetrics() (metrics.Counter, metrics.Histogram) {
+func (c *ClientModel) GetBytesOutMetrics() (metrics.Counter, metrics.Histogram) {
 	return c.metrics.bytesOutCount, c.metrics.bytesOut
 }
-func (c ClientModel) SetUpdateStatus(updateStatus mvc.UpdateStatus) {
+func (c *ClientModel) SetUpdateStatus(updateStatus mvc.UpdateStatus) {
 	c.updateStatus = updateStatus
 	c.update()
 }
@@ -177,6 +231,114 @@ func (c *ClientModel) PlayRequest(tunnel mvc.Tunnel, payload []byte) {
 	ioutil.ReadAll(localConn)
 }
 
+// Opens a new tunnel on the running session and waits for the server to
+// open it. The tunnel is requested again whenever the client reconnects.
+func (c *ClientModel) StartTunnel(name string, rawConfig []byte) ([]mvc.Tunnel, error) {
+	config := new(TunnelConfiguration)
+	if err := yaml.Unmarshal(rawConfig, config); err != nil {
+		return nil, fmt.Errorf("Error parsing configuration for tunnel %s: %v", name, err)
+	}
+
+	if err := normalizeTunnel(name, config); err != nil {
+		return nil, err
+	}
+
+	c.RLock()
+	_, exists := c.tunnelConfig[name]
+	c.RUnlock()
+	if exists {
+		return nil, fmt.Errorf("A tunnel named %s is already running.", name)
+	}
+
+	done := make(chan error, 1)
+	req, err := c.requestTunnel(name, config, done)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case err = <-done:
+	case <-time.After(tunnelReqTimeout):
+		err = fmt.Errorf("Timed out waiting for the server to open tunnel %s", name)
+	}
+
+	c.Lock()
+	// the response may have arrived just as we gave up
+	if err != nil && c.reqs[req.id] == nil {
+		select {
+		case err = <-done:
+		default:
+		}
+	}
+
+	// the server may still open the rest of a failed request's tunnels,
+	// remember to close them when it does
+	if _, ok := c.reqs[req.id]; ok {
+		delete(c.reqs, req.id)
+		c.abandoned[req.id] = req.pending
+	}
+
+	tunnels := req.tunnels
+	urls := make([]string, 0)
+	if err != nil {
+		for _, t := range tunnels {
+			delete(c.tunnels, t.PublicUrl)
+			delete(c.localTLS, t.PublicUrl)
+			urls = append(urls, t.PublicUrl)
+		}
+	}
+	ctlConn := c.ctlConn
+	c.Unlock()
+
+	if err != nil {
+		c.closeTunnels(ctlConn, urls)
+		c.update()
+		return nil, err
+	}
+	return tunnels, nil
+}
+
+// Closes all of the tunnels with the given name and stops requesting them
+// on reconnect.
+func (c *ClientModel) StopTunnel(name string) error {
+	c.Lock()
+	if _, ok := c.tunnelConfig[name]; !ok {
+		c.Unlock()
+		return fmt.Errorf("No tunnel named %s is running.", name)
+	}
+
+	delete(c.tunnelConfig, name)
+	urls := make([]string, 0)
+	for url, t := range c.tunnels {
+		if t.Name == name {
+			delete(c.tunnels, url)
+			delete(c.localTLS, url)
+			urls = append(urls, url)
+		}
+	}
+	ctlConn := c.ctlConn
+	c.Unlock()
+
+	c.closeTunnels(ctlConn, urls)
+	c.Info("Stopped tunnel %s", name)
+	c.update()
+	return nil
+}
+
+// Asks the server to close tunnels, if we're disconnected they'll be gone
+// when we reconnect
+func (c *ClientModel) closeTunnels(ctlConn conn.Conn, urls []string) {
+	if ctlConn == nil {
+		return
+	}
+
+	for _, url := range urls {
+		if err := c.writeCtl(ctlConn, &msg.CloseTunnel{Url: url}); err != nil {
+			c.Warn("Failed to write CloseTunnel for %s: %v", url, err)
+		}
+	}
+}
+
 func (c *ClientModel) Shutdown() {
 }
 
@@ -191,25 +353,31 @@ func (c *ClientModel) Run() {
 
 	for {
 		// run the control channel
-		c.control()
+		goingAway := c.control()
 
-		// control only returns when a failure has occurred, so we're going to try to reconnect
+		// control only returns when a failure has occurred or the server is
+		// shutting down, so we're going to try to reconnect
 		if c.connStatus == mvc.ConnOnline {
 			wait = 1 * time.Second
 		}
 
-		log.Info("Waiting %d seconds before reconnecting", int(wait.Seconds()))
-		time.Sleep(wait)
-		// exponentially increase wait time
-		wait = 2 * wait
-		wait = time.Duration(math.Min(float64(wait), float64(maxWait)))
+		if goingAway {
+			log.Info("Reconnecting")
+		} else {
+			log.Info("Waiting %d seconds before reconnecting", int(wait.Seconds()))
+			time.Sleep(wait)
+			// exponentially increase wait time
+			wait = 2 * wait
+			wait = time.Duration(math.Min(float64(wait), float64(maxWait)))
+		}
 		c.connStatus = mvc.ConnReconnecting
 		c.update()
 	}
 }
 
-// Establishes and manages a tunnel control connection with the server
-func (c *ClientModel) control() {
+// Establishes and manages a tunnel control connection with the server.
+// Returns true if the server went away and we should reconnect right away.
+func (c *ClientModel) control() (goingAway bool) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Error("control recovering from failure %v", r)
@@ -230,7 +398,13 @@ func (c *ClientModel) control() {
 	if err != nil {
 		panic(err)
 	}
-	defer ctlConn.Close()
+
+	// when the server goes away, drainCtl closes the connection instead
+	defer func() {
+		if !goingAway {
+			ctlConn.Close()
+		}
+	}()
 
 	// authenticate with the server
 	auth := &msg.Auth{
@@ -240,6 +414,7 @@ func (c *ClientModel) control() {
 		Version:   version.Proto,
 		MmVersion: version.MajorMinor(),
 		User:      c.authToken,
+		Mux:       true,
 	}
 
 	if err = msg.WriteMsg(ctlConn, auth); err != nil {
@@ -258,6 +433,16 @@ func (c *ClientModel) control() {
 		return
 	}
 
+	// servers which support it open proxy connections as streams
+	// inside the control connection instead of asking us to dial
+	if authResp.Mux {
+		var session *yamux.Session
+		if ctlConn, session, err = conn.StartMux(ctlConn, false); err != nil {
+			panic(err)
+		}
+		c.ctl.Go(func() { c.acceptProxies(session) })
+	}
+
 	c.id = authResp.ClientId
 	c.serverVersion = authResp.MmVersion
 	c.Info("Authenticated with server, client id: %v", c.id)
@@ -266,32 +451,21 @@ func (c *ClientModel) control() {
 		c.Error("Failed to save auth token: %v", err)
 	}
 
-	// request tunnels
-	reqIdToTunnelConfig := make(map[string]*TunnelConfiguration)
-	for _, config := range c.tunnelConfig {
-		// create the protocol list to ask for
-		var protocols []string
-		for proto, _ := range config.Protocols {
-			protocols = append(protocols, proto)
-		}
-
-		reqTunnel := &msg.ReqTunnel{
-			ReqId:      util.RandId(8),
-			Protocol:   strings.Join(protocols, "+"),
-			Hostname:   config.Hostname,
-			Subdomain:  config.Subdomain,
-			HttpAuth:   config.HttpAuth,
-			RemotePort: config.RemotePort,
-		}
+	// make the control connection available for requesting tunnels at runtime
+	c.Lock()
+	c.ctlConn = ctlConn
+	configs := make(map[string]*TunnelConfiguration)
+	for name, config := range c.tunnelConfig {
+		configs[name] = config
+	}
+	c.Unlock()
+	defer c.closeCtl()
 
-		// send the tunnel request
-		if err = msg.WriteMsg(ctlConn, reqTunnel); err != nil {
+	// request tunnels
+	for name, config := range configs {
+		if _, err = c.requestTunnel(name, config, nil); err != nil {
 			panic(err)
 		}
-
-		// save request id association so we know which local address
-		// to proxy to later
-		reqIdToTunnelConfig[reqTunnel.ReqId] = config
 	}
 
 	// start the heartbeat
@@ -313,23 +487,16 @@ func (c *ClientModel) control() {
 			atomic.StoreInt64(&lastPong, time.Now().UnixNano())
 
 		case *msg.NewTunnel:
-			if m.Error != "" {
-				emsg := fmt.Sprintf("Server failed to allocate tunnel: %s", m.Error)
-				c.Error(emsg)
-				c.ctl.Shutdown(emsg)
-				continue
-			}
+			c.newTunnel(m)
 
-			tunnel := mvc.Tunnel{
-				PublicUrl: m.Url,
-				LocalAddr: reqIdToTunnelConfig[m.ReqId].Protocols[m.Protocol],
-				Protocol:  c.protoMap[m.Protocol],
-			}
+		case *msg.TunnelClosed:
+			c.tunnelClosed(m)
 
-			c.tunnels[tunnel.PublicUrl] = tunnel
-			c.connStatus = mvc.ConnOnline
-			c.Info("Tunnel established at %v", tunnel.PublicUrl)
-			c.update()
+		case *msg.ServerGoingAway:
+			c.Info("Server is going away: %s", m.Reason)
+			goingAway = true
+			c.ctl.Go(func() { c.drainCtl(ctlConn, &lastPong) })
+			return
 
 		default:
 			ctlConn.Warn("Ignoring unknown control message %v ", m)
@@ -337,6 +504,248 @@ func (c *ClientModel) control() {
 	}
 }
 
+// Keeps reading from the control connection of a server which is going away
+// so that heartbeats are answered and the proxy connections it still has
+// joined can finish. The server closes the connection when it exits.
+func (c *ClientModel) drainCtl(ctlConn conn.Conn, lastPongAddr *int64) {
+	defer ctlConn.Close()
+
+	for {
+		rawMsg, err := msg.ReadMsg(ctlConn)
+		if err != nil {
+			ctlConn.Debug("Server closed the control connection: %v", err)
+			return
+		}
+
+		// a server which is going away can't be dialed for new proxy connections
+		if _, ok := rawMsg.(*msg.Pong); ok {
+			atomic.StoreInt64(lastPongAddr, time.Now().UnixNano())
+		}
+	}
+}
+
+// Sends a ReqTunnel for the tunnel configuration over the control connection
+func (c *ClientModel) requestTunnel(name string, config *TunnelConfiguration, done chan error) (*tunnelReq, error) {
+	// create the protocol list to ask for
+	var protocols []string
+	for proto, _ := range config.Protocols {
+		protocols = append(protocols, proto)
+	}
+	protocol := strings.Join(protocols, "+")
+
+	reqTunnel := &msg.ReqTunnel{
+		ReqId:          util.RandId(8),
+		Protocol:       protocol,
+		Hostname:       config.Hostname,
+		Subdomain:      config.Subdomain,
+		HttpAuth:       config.HttpAuth,
+		HttpAuthUsers:  config.AuthUsers,
+		HttpAuthTokens: config.AuthTokens,
+		HttpAuthRealm:  config.AuthRealm,
+		ClientTLS:      config.tlsConfig != nil,
+		AllowCIDRs:     config.AllowCIDRs,
+		DenyCIDRs:      config.DenyCIDRs,
+		RemotePort:     config.RemotePort,
+		AppProtocol:    config.AppProtocol,
+		GroupSecret:    config.GroupSecret,
+		Balance:        config.Balance,
+		Optional:       done != nil,
+	}
+
+	if config.Route != nil {
+		reqTunnel.RouteHeader = config.Route.Header
+		reqTunnel.RouteCookie = config.Route.Cookie
+		reqTunnel.Weight = config.Route.Weight
+	}
+
+	if config.Oidc != nil {
+		reqTunnel.Oidc = &msg.OidcOptions{
+			Issuer:       config.Oidc.Issuer,
+			ClientId:     config.Oidc.ClientId,
+			ClientSecret: config.Oidc.ClientSecret,
+			EmailDomains: config.Oidc.EmailDomains,
+			Subjects:     config.Oidc.Subjects,
+		}
+	}
+
+	// save the request so we know which local address
+	// to proxy to when the server responds
+	req := &tunnelReq{
+		id:      reqTunnel.ReqId,
+		name:    name,
+		config:  config,
+		pending: len(strings.Split(protocol, "+")),
+		done:    done,
+	}
+
+	c.Lock()
+	ctlConn := c.ctlConn
+	c.reqs[req.id] = req
+	c.Unlock()
+
+	if ctlConn == nil {
+		return nil, fmt.Errorf("Not connected to the server")
+	}
+
+	// send the tunnel request
+	if err := c.writeCtl(ctlConn, reqTunnel); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// Handles a NewTunnel response to one of our tunnel requests
+func (c *ClientModel) newTunnel(m *msg.NewTunnel) {
+	c.Lock()
+	if n, ok := c.abandoned[m.ReqId]; ok {
+		c.abandonedTunnel(m, n)
+		return
+	}
+
+	req, ok := c.reqs[m.ReqId]
+	if !ok && m.Error == "" {
+		c.Unlock()
+		c.Warn("Ignoring NewTunnel for unknown request %s", m.ReqId)
+		return
+	}
+
+	// a server which doesn't know about ClientTLS decrypts https connections
+	// itself, which is exactly what the tunnel's configuration forbids
+	if ok && m.Error == "" && m.Protocol == "https" && req.config.tlsConfig != nil && !m.ClientTLS {
+		m.Error = "The server does not support terminating TLS on the client."
+	}
+
+	// tunnels requested through the local api report their errors to the
+	// caller, failures of configured tunnels are fatal
+	if m.Error != "" {
+		emsg := fmt.Sprintf("Server failed to allocate tunnel: %s", m.Error)
+		c.Error(emsg)
+		if ok {
+			delete(c.reqs, m.ReqId)
+		}
+
+		if ok && req.done != nil {
+			if req.pending > 1 {
+				c.abandoned[m.ReqId] = req.pending - 1
+			}
+			req.done <- fmt.Errorf("%s", m.Error)
+			c.Unlock()
+		} else {
+			c.Unlock()
+			c.ctl.Shutdown(emsg)
+		}
+		return
+	}
+
+	tunnel := mvc.Tunnel{
+		Name:      req.name,
+		PublicUrl: m.Url,
+		LocalAddr: req.config.Protocols[m.Protocol],
+		Protocol:  c.protoMap[m.Protocol],
+		RateLimit: m.RateLimit,
+	}
+
+	c.tunnels[tunnel.PublicUrl] = tunnel
+	if m.ClientTLS {
+		c.localTLS[tunnel.PublicUrl] = req.config.tlsConfig
+	}
+	req.tunnels = append(req.tunnels, tunnel)
+	req.pending--
+
+	// the result is sent under the lock so that StartTunnel sees it if
+	// it gives up at the same moment
+	if req.pending <= 0 {
+		delete(c.reqs, m.ReqId)
+		c.tunnelConfig[req.name] = req.config
+		if req.done != nil {
+			req.done <- nil
+		}
+	}
+	c.connStatus = mvc.ConnOnline
+	c.Unlock()
+
+	c.Info("Tunnel established at %v", tunnel.PublicUrl)
+	c.update()
+}
+
+// Handles a response to a tunnel request which was given up on, called
+// with the lock held. Errors don't matter anymore, and tunnels opened
+// after all are closed again since nobody is going to use them.
+func (c *ClientModel) abandonedTunnel(m *msg.NewTunnel, pending int) {
+	if pending <= 1 {
+		delete(c.abandoned, m.ReqId)
+	} else {
+		c.abandoned[m.ReqId] = pending - 1
+	}
+	ctlConn := c.ctlConn
+	c.Unlock()
+
+	if m.Error != "" {
+		c.Warn("Ignoring failure of abandoned tunnel request %s: %s", m.ReqId, m.Error)
+		return
+	}
+
+	c.Info("Closing tunnel %s opened for abandoned request %s", m.Url, m.ReqId)
+	c.closeTunnels(ctlConn, []string{m.Url})
+}
+
+// Handles the server closing one of our tunnels, whether we asked it to or not
+func (c *ClientModel) tunnelClosed(m *msg.TunnelClosed) {
+	if m.Error != "" {
+		c.Warn("Server failed to close tunnel %s: %s", m.Url, m.Error)
+		return
+	}
+
+	c.Lock()
+	tunnel, ok := c.tunnels[m.Url]
+	if ok {
+		delete(c.tunnels, m.Url)
+		delete(c.localTLS, m.Url)
+
+		// if that was the last tunnel of its name, don't reopen it on reconnect
+		remaining := false
+		for _, t := range c.tunnels {
+			if t.Name == tunnel.Name {
+				remaining = true
+			}
+		}
+		if !remaining {
+			delete(c.tunnelConfig, tunnel.Name)
+		}
+	}
+	c.Unlock()
+
+	c.Info("Tunnel %s closed", m.Url)
+	if ok {
+		c.update()
+	}
+}
+
+// Forgets the control connection once it fails, failing any outstanding
+// tunnel requests made through the local api
+func (c *ClientModel) closeCtl() {
+	c.Lock()
+	c.ctlConn = nil
+	reqs := c.reqs
+	c.reqs = make(map[string]*tunnelReq)
+	c.abandoned = make(map[string]int)
+	c.Unlock()
+
+	for _, req := range reqs {
+		if req.done != nil {
+			req.done <- fmt.Errorf("Lost connection to the server")
+		}
+	}
+}
+
+// Writes a message to the control connection, safe for concurrent use
+func (c *ClientModel) writeCtl(ctlConn conn.Conn, m msg.Message) error {
+	c.ctlWriteLock.Lock()
+	defer c.ctlWriteLock.Unlock()
+	return msg.WriteMsg(ctlConn, m)
+}
+
 // Establishes and manages a tunnel proxy connection with the server
 func (c *ClientModel) proxy() {
 	var (
@@ -362,19 +771,84 @@ func (c *ClientModel) proxy() {
 		return
 	}
 
+	c.handleProxy(remoteConn)
+}
+
+// Accepts the proxy streams the server opens on a multiplexed session
+// until the session closes
+func (c *ClientModel) acceptProxies(session *yamux.Session) {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			log.Debug("Stopped accepting proxy streams: %v", err)
+			return
+		}
+
+		c.ctl.Go(func() {
+			remoteConn := conn.Wrap(stream, "pxy")
+			defer remoteConn.Close()
+			c.handleProxy(remoteConn)
+		})
+	}
+}
+
+// Waits for the server to start using a proxy connection and joins it
+// with a new connection to the tunnel's local address
+func (c *ClientModel) handleProxy(remoteConn conn.Conn) {
 	// wait for the server to ack our register
 	var startPxy msg.StartProxy
-	if err = msg.ReadMsgInto(remoteConn, &startPxy); err != nil {
+	if err := msg.ReadMsgInto(remoteConn, &startPxy); err != nil {
 		remoteConn.Error("Server failed to write StartProxy: %v", err)
 		return
 	}
 
+	c.RLock()
 	tunnel, ok := c.tunnels[startPxy.Url]
+	tlsConfig := c.localTLS[startPxy.Url]
+	config := c.tunnelConfig[tunnel.Name]
+	c.RUnlock()
 	if !ok {
 		remoteConn.Error("Couldn't find tunnel for proxy: %s", startPxy.Url)
 		return
 	}
 
+	// udp tunnels carry datagrams instead of a stream
+	if strings.HasPrefix(startPxy.Url, "udp://") {
+		c.handleUdpProxy(remoteConn, tunnel)
+		return
+	}
+
+	// the server passes connections to this tunnel through still encrypted,
+	// decrypt them before they're inspected and sent to the local address
+	if tlsConfig != nil {
+		remoteConn = conn.TLSServer(remoteConn, tlsConfig)
+	}
+
+	// rewrite requests before the local service and the inspector see them,
+	// responses are parsed once the private connection is open to learn
+	// which requests switched protocols and rewrite their headers
+	var sent chan *sentRequest
+	if config != nil && tunnel.Protocol.GetName() == "http" &&
+		(config.ForwardedHeaders || config.HostHeader != "" || config.RequestHeaders != nil || config.ResponseHeaders != nil) {
+		sent = make(chan *sentRequest, maxPipelinedRequests)
+
+		proto := strings.SplitN(startPxy.Url, ":", 2)[0]
+		remoteConn = rewriteRequests(remoteConn, func(req *http.Request) {
+			if config.ForwardedHeaders {
+				addForwardedHeaders(req, proto, startPxy.ClientAddr)
+			}
+			if config.HostHeader != "" {
+				rewriteHost(req, config.HostHeader, tunnel.LocalAddr)
+			}
+			if config.RequestHeaders != nil {
+				config.RequestHeaders.apply(req.Header)
+			}
+		}, sent)
+
+		// the rewritten requests wait on a pipe which is closed with it
+		defer remoteConn.Close()
+	}
+
 	// start up the private connection
 	start := time.Now()
 	localConn, err := conn.Dial(tunnel.LocalAddr, "prv", nil)
@@ -394,12 +868,28 @@ Content-Length: %d
 	}
 	defer localConn.Close()
 
+	if config != nil && config.ProxyProtocol != 0 && tunnel.Protocol.GetName() == "tcp" {
+		if err = writeProxyHeader(localConn, config.ProxyProtocol, startPxy.ClientAddr, localConn.RemoteAddr()); err != nil {
+			remoteConn.Warn("Failed to write PROXY protocol header: %v", err)
+			return
+		}
+	}
+
+	var privateConn conn.Conn = localConn
+	if sent != nil {
+		privateConn = rewriteResponses(localConn, func(resp *http.Response) {
+			if config.ResponseHeaders != nil {
+				config.ResponseHeaders.apply(resp.Header)
+			}
+		}, sent)
+	}
+
 	m := c.metrics
 	m.proxySetupTimer.Update(time.Since(start))
 	m.connMeter.Mark(1)
 	c.update()
 	m.connTimer.Time(func() {
-		localConn := tunnel.Protocol.WrapConn(localConn, mvc.ConnectionContext{Tunnel: tunnel, ClientAddr: startPxy.ClientAddr})
+		localConn := tunnel.Protocol.WrapConn(privateConn, mvc.ConnectionContext{Tunnel: tunnel, ClientAddr: startPxy.ClientAddr})
 		bytesIn, bytesOut := conn.Join(localConn, remoteConn)
 		m.bytesIn.Update(bytesIn)
 		m.bytesOut.Update(bytesOut)
@@ -409,6 +899,72 @@ Content-Length: %d
 	c.update()
 }
 
+// Replays the datagrams of one public address of a udp tunnel to the
+// tunnel's local address and carries the replies back. The server ends
+// the flow by closing the proxy connection once it's idle.
+func (c *ClientModel) handleUdpProxy(remoteConn conn.Conn, tunnel mvc.Tunnel) {
+	start := time.Now()
+	localConn, err := net.Dial("udp", tunnel.LocalAddr)
+	if err != nil {
+		remoteConn.Warn("Failed to open private leg %s: %v", tunnel.LocalAddr, err)
+		return
+	}
+	defer localConn.Close()
+
+	m := c.metrics
+	m.proxySetupTimer.Update(time.Since(start))
+	m.connMeter.Mark(1)
+	c.update()
+
+	var bytesIn, bytesOut int64
+	m.connTimer.Time(func() {
+		// replies from the local address
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer remoteConn.Close()
+
+			buf := make([]byte, conn.MaxDatagramSize)
+			for {
+				n, err := localConn.Read(buf)
+				if err != nil {
+					remoteConn.Debug("Stopped reading from %s: %v", tunnel.LocalAddr, err)
+					return
+				}
+
+				if err = conn.WriteDatagram(remoteConn, buf[:n]); err != nil {
+					return
+				}
+				atomic.AddInt64(&bytesOut, int64(n))
+			}
+		}()
+
+		buf := make([]byte, conn.MaxDatagramSize)
+		for {
+			p, err := conn.ReadDatagram(remoteConn, buf)
+			if err != nil {
+				break
+			}
+
+			if _, err = localConn.Write(p); err != nil {
+				remoteConn.Warn("Failed to write datagram to %s: %v", tunnel.LocalAddr, err)
+				break
+			}
+			bytesIn += int64(len(p))
+		}
+
+		localConn.Close()
+		<-done
+	})
+
+	bytesOut = atomic.LoadInt64(&bytesOut)
+	m.bytesIn.Update(bytesIn)
+	m.bytesOut.Update(bytesOut)
+	m.bytesInCount.Inc(bytesIn)
+	m.bytesOutCount.Inc(bytesOut)
+	c.update()
+}
+
 // Hearbeating to ensure our connection ngrokd is still live
 func (c *ClientModel) heartbeat(lastPongAddr *int64, conn conn.Conn) {
 	lastPing := time.Unix(atomic.LoadInt64(lastPongAddr)-1, 0)
@@ -435,7 +991,7 @@ func (c *ClientModel) heartbeat(lastPongAddr *int64, conn conn.Conn) {
 			}
 
 		case <-ping.C:
-			err := msg.WriteMsg(conn, &msg.Ping{})
+			err := c.writeCtl(conn, &msg.Ping{})
 			if err != nil {
 				conn.Debug("Got error %v when writing PingMsg", err)
 				return
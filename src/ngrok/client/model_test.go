@@ -0,0 +1,244 @@
+package client
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"ngrok/client/mvc"
+	"ngrok/conn"
+	"ngrok/log"
+	"ngrok/msg"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// a controller which only records shutdowns
+type testController struct {
+	mvc.Controller
+	shutdown chan string
+}
+
+func (c *testController) Update(mvc.State) {}
+
+func (c *testController) Shutdown(message string) {
+	c.shutdown <- message
+}
+
+func (c *testController) Go(fn func()) {
+	go fn()
+}
+
+// A model connected to a fake server, returns the server's end of the
+// control connection
+func testModel(t *testing.T) (*ClientModel, *testController, conn.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	ctl := &testController{shutdown: make(chan string, 1)}
+	c := &ClientModel{
+		Logger:       log.NewPrefixLogger("client"),
+		tunnels:      make(map[string]mvc.Tunnel),
+		reqs:         make(map[string]*tunnelReq),
+		abandoned:    make(map[string]int),
+		localTLS:     make(map[string]*tls.Config),
+		tunnelConfig: make(map[string]*TunnelConfiguration),
+		ctl:          ctl,
+		ctlConn:      conn.Wrap(client, "ctl"),
+	}
+	return c, ctl, conn.Wrap(server, "srv")
+}
+
+func TestStartTunnelAbandoned(t *testing.T) {
+	defer func(d time.Duration) { tunnelReqTimeout = d }(tunnelReqTimeout)
+	tunnelReqTimeout = 50 * time.Millisecond
+
+	c, ctl, server := testModel(t)
+
+	started := make(chan error, 1)
+	go func() {
+		_, err := c.StartTunnel("web", []byte("proto:\n  http+https: 8080\n"))
+		started <- err
+	}()
+
+	var req msg.ReqTunnel
+	if err := msg.ReadMsgInto(server, &req); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server only answers after the api gave up
+	if err := <-started; err == nil {
+		t.Fatalf("StartTunnel succeeded without a response from the server")
+	}
+
+	// a late success is closed again
+	go c.newTunnel(&msg.NewTunnel{ReqId: req.ReqId, Url: "http://foo.ngrok.test", Protocol: "http"})
+	var close msg.CloseTunnel
+	if err := msg.ReadMsgInto(server, &close); err != nil {
+		t.Fatal(err)
+	}
+	if close.Url != "http://foo.ngrok.test" {
+		t.Fatalf("Closed %q, expected the late tunnel", close.Url)
+	}
+
+	// and a late error doesn't shut the client down
+	c.newTunnel(&msg.NewTunnel{ReqId: req.ReqId, Error: "Subdomain taken"})
+	select {
+	case m := <-ctl.shutdown:
+		t.Fatalf("Late error shut the client down: %s", m)
+	default:
+	}
+
+	if len(c.tunnels) != 0 || len(c.tunnelConfig) != 0 {
+		t.Errorf("Abandoned request left tunnels %v, config %v", c.tunnels, c.tunnelConfig)
+	}
+	if len(c.abandoned) != 0 {
+		t.Errorf("Abandoned request is still remembered after all of its responses")
+	}
+}
+
+func TestStartTunnelPartialFailure(t *testing.T) {
+	c, ctl, server := testModel(t)
+
+	started := make(chan error, 1)
+	go func() {
+		_, err := c.StartTunnel("web", []byte("proto:\n  http+https: 8080\n"))
+		started <- err
+	}()
+
+	var req msg.ReqTunnel
+	if err := msg.ReadMsgInto(server, &req); err != nil {
+		t.Fatal(err)
+	}
+
+	// one protocol fails, the other one is opened after all
+	c.newTunnel(&msg.NewTunnel{ReqId: req.ReqId, Error: "Subdomain taken"})
+	if err := <-started; err == nil {
+		t.Fatalf("StartTunnel succeeded although the server failed")
+	}
+
+	go c.newTunnel(&msg.NewTunnel{ReqId: req.ReqId, Url: "https://foo.ngrok.test", Protocol: "https"})
+	var close msg.CloseTunnel
+	if err := msg.ReadMsgInto(server, &close); err != nil {
+		t.Fatal(err)
+	}
+	if close.Url != "https://foo.ngrok.test" {
+		t.Fatalf("Closed %q, expected the rest of the failed request", close.Url)
+	}
+
+	select {
+	case m := <-ctl.shutdown:
+		t.Fatalf("Failed api request shut the client down: %s", m)
+	default:
+	}
+}
+
+func TestTunnelClosed(t *testing.T) {
+	c, _, _ := testModel(t)
+	c.tunnelConfig["web"] = &TunnelConfiguration{}
+	c.tunnels["http://foo.ngrok.test"] = mvc.Tunnel{Name: "web", PublicUrl: "http://foo.ngrok.test"}
+	c.tunnels["https://foo.ngrok.test"] = mvc.Tunnel{Name: "web", PublicUrl: "https://foo.ngrok.test"}
+
+	// a failure leaves the tunnel alone
+	c.tunnelClosed(&msg.TunnelClosed{Url: "http://foo.ngrok.test", Error: "No tunnel found"})
+	if len(c.tunnels) != 2 {
+		t.Fatalf("Failed close removed a tunnel")
+	}
+
+	// the configuration is kept for reconnects until its last tunnel closes
+	c.tunnelClosed(&msg.TunnelClosed{Url: "http://foo.ngrok.test"})
+	if _, ok := c.tunnels["http://foo.ngrok.test"]; ok {
+		t.Errorf("Closed tunnel is still listed")
+	}
+	if _, ok := c.tunnelConfig["web"]; !ok {
+		t.Errorf("Configuration was dropped while one of its tunnels is open")
+	}
+
+	c.tunnelClosed(&msg.TunnelClosed{Url: "https://foo.ngrok.test"})
+	if len(c.tunnels) != 0 || len(c.tunnelConfig) != 0 {
+		t.Errorf("Closing all tunnels left tunnels %v, config %v", c.tunnels, c.tunnelConfig)
+	}
+}
+
+// Runs the control connection against a fake server which authenticates
+// the client and then calls serve
+func testControl(t *testing.T, serve func(server conn.Conn)) (goingAway bool) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		raw, err := l.Accept()
+		if err != nil {
+			return
+		}
+		server := conn.Wrap(raw, "srv")
+		defer server.Close()
+
+		var auth msg.Auth
+		if err := msg.ReadMsgInto(server, &auth); err != nil {
+			return
+		}
+		msg.WriteMsg(server, &msg.AuthResp{ClientId: "abc"})
+		serve(server)
+	}()
+
+	c, _, _ := testModel(t)
+	c.serverAddr = l.Addr().String()
+	c.configPath = filepath.Join(t.TempDir(), "ngrok.yml")
+
+	returned := make(chan bool, 1)
+	go func() { returned <- c.control() }()
+	select {
+	case goingAway = <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Control connection didn't return")
+	}
+
+	if c.id != "abc" {
+		t.Errorf("Client id is %q after authenticating", c.id)
+	}
+	return
+}
+
+func TestControlGoingAway(t *testing.T) {
+	// a server which is shutting down makes the client reconnect right away
+	// while the old connection stays open for its proxy connections
+	stillOpen := make(chan error, 1)
+	goingAway := testControl(t, func(server conn.Conn) {
+		msg.WriteMsg(server, &msg.ServerGoingAway{Reason: "The server is shutting down"})
+
+		server.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err := server.Read(make([]byte, 1))
+		stillOpen <- err
+	})
+	if !goingAway {
+		t.Fatalf("Client didn't take ServerGoingAway as a reason to reconnect right away")
+	}
+	if err := <-stillOpen; err == io.EOF {
+		t.Errorf("Client closed the control connection of a server which is going away")
+	}
+
+	// a failed connection is retried after a backoff instead
+	if testControl(t, func(server conn.Conn) {}) {
+		t.Errorf("Client took a failed connection for a server going away")
+	}
+}
@@ -14,6 +14,13 @@ type Controller interface {
 	// PlayRequest instructs the model to play requests
 	PlayRequest(tunnel Tunnel, payload []byte)
 
+	// StartTunnel asks the model to open a new tunnel on the running session.
+	// config is the tunnel's configuration in the same format as the config file.
+	StartTunnel(name string, config []byte) ([]Tunnel, error)
+
+	// StopTunnel asks the model to close all of the tunnels with the given name
+	StopTunnel(name string) error
+
 	// A channel of updates
 	Updates() *util.Broadcast
 
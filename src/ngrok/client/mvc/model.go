@@ -6,4 +6,8 @@ type Model interface {
 	Shutdown()
 
 	PlayRequest(tunnel Tunnel, payload []byte)
+
+	StartTunnel(name string, config []byte) ([]Tunnel, error)
+
+	StopTunnel(name string) error
 }
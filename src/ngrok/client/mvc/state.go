@@ -23,9 +23,11 @@ const (
 )
 
 type Tunnel struct {
+	Name      string
 	PublicUrl string
 	Protocol  proto.Protocol
 	LocalAddr string
+	RateLimit int64 // bytes a second the server lets through, 0 if unlimited
 }
 
 type ConnectionContext struct {
@@ -0,0 +1,296 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"ngrok/conn"
+	"strings"
+)
+
+const (
+	// every HTTP/1 request line is longer, so peeking this much never waits
+	// on more than the request line
+	http2RequestLine = "PRI * HTTP/2.0"
+
+	// requests which may be read ahead of the responses answering them
+	maxPipelinedRequests = 16
+)
+
+// the signature which starts a PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// A request passed on to the local service. Requests asking to upgrade the
+// connection wait on upgraded to learn whether the local service switched
+// protocols, it's closed if the response never arrives.
+type sentRequest struct {
+	*http.Request
+	upgraded chan bool
+}
+
+// A connection whose HTTP/1 messages are rewritten as they are read
+type rewrittenConn struct {
+	conn.Conn
+	rd *io.PipeReader
+}
+
+func (c *rewrittenConn) Read(p []byte) (int, error) {
+	return c.rd.Read(p)
+}
+
+func (c *rewrittenConn) Close() error {
+	c.rd.Close()
+	return c.Conn.Close()
+}
+
+// Rewrites the requests read from the proxy connection c with rewrite
+// before the local service reads them. Each request is passed on to sent,
+// which is closed once no more requests will be parsed, for
+// rewriteResponses to match the responses with.
+func rewriteRequests(c conn.Conn, rewrite func(*http.Request), sent chan<- *sentRequest) conn.Conn {
+	pr, pw := io.Pipe()
+	go rewriteRequestLoop(bufio.NewReader(c), pw, rewrite, sent)
+	return &rewrittenConn{Conn: c, rd: pr}
+}
+
+func rewriteRequestLoop(rd *bufio.Reader, pw *io.PipeWriter, rewrite func(*http.Request), sent chan<- *sentRequest) {
+	defer close(sent)
+
+	// h2c can't be rewritten without decoding it, pass it through untouched
+	if b, err := rd.Peek(len(http2RequestLine)); err == nil && string(b) == http2RequestLine {
+		_, err = io.Copy(pw, rd)
+		pw.CloseWithError(err)
+		return
+	}
+
+	for {
+		req, err := http.ReadRequest(rd)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		rewrite(req)
+
+		// a request without a User-Agent mustn't get the one of Go's client
+		if _, ok := req.Header["User-Agent"]; !ok {
+			req.Header["User-Agent"] = nil
+		}
+
+		// before the body is written, the local service may answer early
+		r := &sentRequest{Request: req}
+		if req.Header.Get("Upgrade") != "" {
+			r.upgraded = make(chan bool, 1)
+		}
+		sent <- r
+
+		if err = req.Write(pw); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		// upgraded connections, like websockets, carry another protocol
+		// from now on, unless the local service declined the upgrade
+		if r.upgraded != nil && <-r.upgraded {
+			_, err = io.Copy(pw, rd)
+			pw.CloseWithError(err)
+			return
+		}
+	}
+}
+
+// Rewrites the responses read from the private connection c with rewrite
+// before they're inspected and returned to the public client. sent carries
+// the requests they answer, in order, from rewriteRequests.
+func rewriteResponses(c conn.Conn, rewrite func(*http.Response), sent <-chan *sentRequest) conn.Conn {
+	pr, pw := io.Pipe()
+	go rewriteResponseLoop(bufio.NewReader(c), pw, rewrite, sent)
+	return &rewrittenConn{Conn: c, rd: pr}
+}
+
+func rewriteResponseLoop(rd *bufio.Reader, pw *io.PipeWriter, rewrite func(*http.Response), sent <-chan *sentRequest) {
+	// requests which won't get a response anymore mustn't wait on it
+	defer func() {
+		go func() {
+			for req := range sent {
+				if req.upgraded != nil {
+					close(req.upgraded)
+				}
+			}
+		}()
+	}()
+
+	for {
+		req, ok := <-sent
+		if !ok {
+			// the requests stopped being parsed, neither are the responses
+			_, err := io.Copy(pw, rd)
+			pw.CloseWithError(err)
+			return
+		}
+
+		var resp *http.Response
+		for {
+			var err error
+			if resp, err = http.ReadResponse(rd, req.Request); err != nil {
+				if req.upgraded != nil {
+					close(req.upgraded)
+				}
+				pw.CloseWithError(err)
+				return
+			}
+
+			rewrite(resp)
+			if err = resp.Write(pw); err != nil {
+				if req.upgraded != nil {
+					close(req.upgraded)
+				}
+				pw.CloseWithError(err)
+				return
+			}
+
+			// informational responses like 100 Continue come before the real one
+			if resp.StatusCode >= 200 || resp.StatusCode == 101 {
+				break
+			}
+		}
+
+		switched := resp.StatusCode == 101
+		if req.upgraded != nil {
+			req.upgraded <- switched
+		}
+
+		if switched {
+			_, err := io.Copy(pw, rd)
+			pw.CloseWithError(err)
+			return
+		}
+	}
+}
+
+// Adds X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host and Forwarded
+// headers to a request. proto is the scheme of the tunnel's public url,
+// clientAddr the address of the public client from the StartProxy message.
+func addForwardedHeaders(req *http.Request, proto, clientAddr string) {
+	ip := clientAddr
+	if host, _, err := net.SplitHostPort(clientAddr); err == nil {
+		ip = host
+	}
+
+	// proxies in front of ngrokd may have added themselves already
+	if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+		req.Header.Set("X-Forwarded-For", prior+", "+ip)
+	} else {
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", req.Host)
+
+	// RFC 7239 quotes IPv6 addresses along with their brackets
+	node := ip
+	if strings.Contains(ip, ":") {
+		node = fmt.Sprintf(`"[%s]"`, ip)
+	}
+	forwarded := fmt.Sprintf("for=%s;host=%q;proto=%s", node, req.Host, proto)
+	if prior := req.Header.Get("Forwarded"); prior != "" {
+		forwarded = prior + ", " + forwarded
+	}
+	req.Header.Set("Forwarded", forwarded)
+}
+
+// Applies the rules to the headers of a request or response
+func (r *HeaderRules) apply(h http.Header) {
+	for _, key := range r.Remove {
+		h.Del(key)
+	}
+	for key, values := range r.set {
+		h[key] = append([]string(nil), values...)
+	}
+	for key, values := range r.add {
+		for _, v := range values {
+			h.Add(key, v)
+		}
+	}
+}
+
+// Replaces the Host header of a request with hostHeader, or with the
+// tunnel's local address if it is "rewrite". The original is kept in
+// X-Forwarded-Host.
+func rewriteHost(req *http.Request, hostHeader, localAddr string) {
+	req.Header.Set("X-Forwarded-Host", req.Host)
+	if hostHeader == "rewrite" {
+		req.Host = localAddr
+	} else {
+		req.Host = hostHeader
+	}
+}
+
+// Writes a PROXY protocol header of the given version to the private
+// connection so the local service learns the address of the public client.
+// The destination is the local address the connection was made to.
+func writeProxyHeader(w io.Writer, version int, clientAddr string, dst net.Addr) error {
+	src, err := net.ResolveTCPAddr("tcp", clientAddr)
+	if err != nil {
+		return fmt.Errorf("Invalid client address %s: %v", clientAddr, err)
+	}
+
+	dstTcp, ok := dst.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("Invalid local address %v", dst)
+	}
+
+	srcIP, dstIP := src.IP.To4(), dstTcp.IP.To4()
+	ipv4 := srcIP != nil && dstIP != nil
+	if !ipv4 {
+		srcIP, dstIP = src.IP.To16(), dstTcp.IP.To16()
+	}
+
+	switch version {
+	case 1:
+		family, srcText, dstText := "TCP4", srcIP.String(), dstIP.String()
+		if !ipv4 {
+			family, srcText, dstText = "TCP6", ipv6Text(srcIP), ipv6Text(dstIP)
+		}
+		_, err = fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", family, srcText, dstText, src.Port, dstTcp.Port)
+		return err
+
+	case 2:
+		var buf bytes.Buffer
+		buf.Write(proxyV2Signature)
+		// version 2, PROXY command
+		buf.WriteByte(0x21)
+
+		// TCP over IPv4 or IPv6, then the length of the addresses
+		if ipv4 {
+			buf.WriteByte(0x11)
+			binary.Write(&buf, binary.BigEndian, uint16(12))
+		} else {
+			buf.WriteByte(0x21)
+			binary.Write(&buf, binary.BigEndian, uint16(36))
+		}
+
+		buf.Write(srcIP)
+		buf.Write(dstIP)
+		binary.Write(&buf, binary.BigEndian, uint16(src.Port))
+		binary.Write(&buf, binary.BigEndian, uint16(dstTcp.Port))
+
+		_, err = w.Write(buf.Bytes())
+		return err
+
+	default:
+		return fmt.Errorf("Unknown PROXY protocol version %d", version)
+	}
+}
+
+// Formats an IPv6 address for a PROXY protocol v1 header, which has no
+// room for IPv4 addresses even when they're mapped to IPv6
+func ipv6Text(ip net.IP) string {
+	if ip.To4() != nil {
+		return "::ffff:" + ip.To4().String()
+	}
+	return ip.String()
+}
@@ -0,0 +1,193 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWriteProxyHeader(t *testing.T) {
+	for _, c := range []struct {
+		version    int
+		clientAddr string
+		dst        net.Addr
+		expected   string
+	}{
+		{1, "1.2.3.4:5678", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}, "PROXY TCP4 1.2.3.4 127.0.0.1 5678 80\r\n"},
+		{1, "[2001:db8::1]:5678", &net.TCPAddr{IP: net.ParseIP("::1"), Port: 80}, "PROXY TCP6 2001:db8::1 ::1 5678 80\r\n"},
+		{1, "1.2.3.4:5678", &net.TCPAddr{IP: net.ParseIP("::1"), Port: 80}, "PROXY TCP6 ::ffff:1.2.3.4 ::1 5678 80\r\n"},
+		{2, "1.2.3.4:5678", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80},
+			"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c\x01\x02\x03\x04\x7f\x00\x00\x01\x16\x2e\x00\x50"},
+		{2, "[2001:db8::1]:5678", &net.TCPAddr{IP: net.ParseIP("::1"), Port: 443},
+			"\r\n\r\n\x00\r\nQUIT\n\x21\x21\x00\x24" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\x16\x2e\x01\xbb"},
+	} {
+		var buf bytes.Buffer
+		if err := writeProxyHeader(&buf, c.version, c.clientAddr, c.dst); err != nil {
+			t.Errorf("v%d %s: %v", c.version, c.clientAddr, err)
+			continue
+		}
+		if buf.String() != c.expected {
+			t.Errorf("v%d %s -> %v wrote %q, expected %q", c.version, c.clientAddr, c.dst, buf.String(), c.expected)
+		}
+	}
+
+	for _, c := range []struct {
+		version    int
+		clientAddr string
+		dst        net.Addr
+	}{
+		{3, "1.2.3.4:5678", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}},
+		{1, "not an address", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}},
+		{2, "1.2.3.4:5678", &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}},
+	} {
+		if err := writeProxyHeader(ioutil.Discard, c.version, c.clientAddr, c.dst); err == nil {
+			t.Errorf("v%d %s -> %v: expected an error", c.version, c.clientAddr, c.dst)
+		}
+	}
+}
+
+// marks the requests it rewrites
+func markRequest(req *http.Request) {
+	req.Header.Set("X-Rewritten", "1")
+}
+
+// Runs the requests in input through rewriteRequestLoop with rewrite,
+// answering upgrade requests with switched, and returns what the local
+// service reads
+func rewriteTestRequests(t *testing.T, input string, switched bool, rewrite func(*http.Request)) (string, int) {
+	sent := make(chan *sentRequest, maxPipelinedRequests)
+	requests := make(chan int)
+	go func() {
+		n := 0
+		for req := range sent {
+			n++
+			if req.upgraded != nil {
+				req.upgraded <- switched
+			}
+		}
+		requests <- n
+	}()
+
+	rd := bufio.NewReader(strings.NewReader(input))
+	pr, pw := io.Pipe()
+	go rewriteRequestLoop(rd, pw, rewrite, sent)
+
+	out, err := ioutil.ReadAll(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out), <-requests
+}
+
+func TestRewriteRequestLoop(t *testing.T) {
+	upgrade := "GET /ws HTTP/1.1\r\nHost: foo.ngrok.test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"
+	next := "GET /next HTTP/1.1\r\nHost: foo.ngrok.test\r\n\r\n"
+
+	// a declined upgrade keeps the connection speaking HTTP/1
+	out, n := rewriteTestRequests(t, upgrade+next, false, markRequest)
+	if n != 2 || strings.Count(out, "X-Rewritten: 1") != 2 {
+		t.Fatalf("Declined upgrade passed on %d requests:\n%s", n, out)
+	}
+
+	// a switched connection is passed through untouched
+	out, n = rewriteTestRequests(t, upgrade+next, true, markRequest)
+	if n != 1 || strings.Count(out, "X-Rewritten: 1") != 1 || !strings.HasSuffix(out, "\r\n\r\n"+next) {
+		t.Fatalf("Switched connection passed on %d requests:\n%s", n, out)
+	}
+
+	// as is h2c
+	h2c := http2RequestLine + "\r\n\r\nSM\r\n\r\n" + next
+	if out, n = rewriteTestRequests(t, h2c, false, markRequest); n != 0 || out != h2c {
+		t.Fatalf("h2c passed on %d requests:\n%s", n, out)
+	}
+
+	// requests without a User-Agent don't get Go's
+	if out, _ = rewriteTestRequests(t, next, false, markRequest); strings.Contains(out, "User-Agent") {
+		t.Fatalf("User-Agent was added:\n%s", out)
+	}
+
+	// host_header replaces the Host of every request, keeping the public one
+	for _, c := range []struct {
+		hostHeader, host string
+	}{
+		{"rewrite", "127.0.0.1:8080"},
+		{"app.local", "app.local"},
+	} {
+		out, n = rewriteTestRequests(t, next+next, false, func(req *http.Request) {
+			rewriteHost(req, c.hostHeader, "127.0.0.1:8080")
+		})
+		if n != 2 || strings.Count(out, "Host: "+c.host+"\r\n") != 2 ||
+			strings.Count(out, "X-Forwarded-Host: foo.ngrok.test\r\n") != 2 || strings.Contains(out, "\nHost: foo.ngrok.test") {
+			t.Errorf("host_header %s passed on %d requests:\n%s", c.hostHeader, n, out)
+		}
+	}
+}
+
+func TestRewriteResponseLoop(t *testing.T) {
+	get := func(upgrade bool) *sentRequest {
+		req, _ := http.NewRequest("GET", "http://foo.ngrok.test/ws", nil)
+		r := &sentRequest{Request: req}
+		if upgrade {
+			req.Header.Set("Upgrade", "websocket")
+			r.upgraded = make(chan bool, 1)
+		}
+		return r
+	}
+
+	for _, c := range []struct {
+		name     string
+		input    string
+		switched bool
+	}{
+		{"switched", "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\nHTTP/1.1 raw frames", true},
+		{"declined", "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", false},
+	} {
+		upgrade, after := get(true), get(false)
+		sent := make(chan *sentRequest, 2)
+		sent <- upgrade
+		sent <- after
+		close(sent)
+
+		rd := bufio.NewReader(strings.NewReader(c.input))
+		pr, pw := io.Pipe()
+		go rewriteResponseLoop(rd, pw, func(resp *http.Response) {
+			resp.Header.Set("X-Rewritten", "1")
+		}, sent)
+
+		out, err := ioutil.ReadAll(pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if switched := <-upgrade.upgraded; switched != c.switched {
+			t.Errorf("%s: upgrade was reported as switched %v", c.name, switched)
+		}
+
+		rewritten := strings.Count(string(out), "X-Rewritten: 1")
+		if c.switched && (rewritten != 1 || !strings.HasSuffix(string(out), "\r\n\r\nHTTP/1.1 raw frames")) {
+			t.Errorf("%s: switched connection wasn't passed through:\n%s", c.name, out)
+		}
+		if !c.switched && rewritten != 2 {
+			t.Errorf("%s: %d responses were rewritten:\n%s", c.name, rewritten, out)
+		}
+	}
+
+	// requests which never get a response don't wait on it
+	upgrade := get(true)
+	sent := make(chan *sentRequest, 1)
+	sent <- upgrade
+	close(sent)
+	_, pw := io.Pipe()
+	go rewriteResponseLoop(bufio.NewReader(strings.NewReader("")), pw, func(*http.Response) {}, sent)
+	if <-upgrade.upgraded {
+		t.Errorf("Upgrade without a response was reported as switched")
+	}
+}
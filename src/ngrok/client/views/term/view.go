@@ -2,6 +2,7 @@
 package term
 
 import (
+	"fmt"
 	termbox "github.com/nsf/termbox-go"
 	"ngrok/client/mvc"
 	"ngrok/log"
@@ -104,7 +105,11 @@ func (v *TermView) draw() {
 	v.Printf(0, 3, "%-30s%s/%s", "Version", state.GetClientVersion(), state.GetServerVersion())
 	var i int = 4
 	for _, t := range state.GetTunnels() {
-		v.Printf(0, i, "%-30s%s -> %s", "Forwarding", t.PublicUrl, t.LocalAddr)
+		if t.RateLimit > 0 {
+			v.Printf(0, i, "%-30s%s -> %s (%s)", "Forwarding", t.PublicUrl, t.LocalAddr, formatRate(t.RateLimit))
+		} else {
+			v.Printf(0, i, "%-30s%s -> %s", "Forwarding", t.PublicUrl, t.LocalAddr)
+		}
 		i++
 	}
 	v.Printf(0, i+0, "%-30s%s", "Web Interface", v.ctl.GetWebInspectAddr())
@@ -118,6 +123,18 @@ func (v *TermView) draw() {
 	termbox.Flush()
 }
 
+// Formats a rate limit in bytes a second like 1.5 MB/s
+func formatRate(rate int64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+	v := float64(rate)
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.4g %s/s", v, units[i])
+}
+
 func (v *TermView) run() {
 	defer close(v.shutdown)
 	defer termbox.Close()
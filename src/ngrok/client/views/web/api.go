@@ -0,0 +1,163 @@
+package web
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"ngrok/client/mvc"
+	"strings"
+)
+
+// A tunnel as reported by the local api
+type ApiTunnel struct {
+	Name      string
+	PublicUrl string
+	Proto     string
+	LocalAddr string
+}
+
+func newApiTunnels(tunnels []mvc.Tunnel) []ApiTunnel {
+	apiTunnels := make([]ApiTunnel, 0, len(tunnels))
+	for _, t := range tunnels {
+		apiTunnels = append(apiTunnels, ApiTunnel{
+			Name:      t.Name,
+			PublicUrl: t.PublicUrl,
+			Proto:     t.Protocol.GetName(),
+			LocalAddr: t.LocalAddr,
+		})
+	}
+	return apiTunnels
+}
+
+// Registers a JSON api for starting and stopping tunnels at runtime:
+//
+//	GET    /api/tunnels         list open tunnels
+//	POST   /api/tunnels         start a tunnel, the body is the tunnel's configuration
+//	                            as in the config file plus its name, for example:
+//	                            {"name": "www", "proto": {"http": "8080"}}
+//	DELETE /api/tunnels/<name>  stop all of the tunnels with the given name
+//
+// Any web page the user visits can send requests to the api, so it only
+// answers requests for the inspector's own address, see guardApi.
+func (wv *WebView) registerApi() {
+	writeJson := func(w http.ResponseWriter, status int, v interface{}) {
+		buf, err := json.Marshal(v)
+		if err != nil {
+			wv.Error("Failed to serialize api response: %v", err)
+			http.Error(w, http.StatusText(500), 500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(buf)
+	}
+
+	http.HandleFunc("/api/tunnels", wv.guardApi(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			writeJson(w, 200, newApiTunnels(wv.ctl.State().GetTunnels()))
+
+		case "POST":
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+
+			var req struct {
+				Name string `json:"name"`
+			}
+			if err = json.Unmarshal(body, &req); err != nil {
+				http.Error(w, "Invalid JSON: "+err.Error(), 400)
+				return
+			}
+
+			if req.Name == "" {
+				http.Error(w, "A tunnel name is required", 400)
+				return
+			}
+
+			tunnels, err := wv.ctl.StartTunnel(req.Name, body)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			writeJson(w, 201, newApiTunnels(tunnels))
+
+		default:
+			http.Error(w, http.StatusText(405), 405)
+		}
+	}))
+
+	http.HandleFunc("/api/tunnels/", wv.guardApi(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			http.Error(w, http.StatusText(405), 405)
+			return
+		}
+
+		name := strings.TrimPrefix(r.URL.Path, "/api/tunnels/")
+		if err := wv.ctl.StopTunnel(name); err != nil {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+		w.WriteHeader(204)
+	}))
+}
+
+// Rejects api requests which a web page could have sent. Their Host must be
+// the inspector's address or localhost, which keeps DNS rebinding out, a
+// page of another origin gives itself away by its Origin, and bodies must be
+// JSON, which pages can't send without a CORS preflight the api never allows.
+func (wv *WebView) guardApi(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !wv.isInspectHost(r.Host) {
+			wv.Warn("Rejected api request for host %s", r.Host)
+			http.Error(w, http.StatusText(403), 403)
+			return
+		}
+
+		if origin := r.Header.Get("Origin"); origin != "" && origin != "http://"+r.Host {
+			wv.Warn("Rejected api request from origin %s", origin)
+			http.Error(w, http.StatusText(403), 403)
+			return
+		}
+
+		if r.Method == "POST" {
+			if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+				http.Error(w, "Content-Type must be application/json", 415)
+				return
+			}
+		}
+
+		h(w, r)
+	}
+}
+
+// Whether host names the address the inspector is served on
+func (wv *WebView) isInspectHost(host string) bool {
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return false
+	}
+
+	addrHost, addrPort, err := net.SplitHostPort(wv.addr)
+	if err != nil || port != addrPort {
+		return false
+	}
+
+	switch strings.ToLower(hostname) {
+	case "localhost", "127.0.0.1", "::1":
+		return true
+	}
+
+	// an inspector listening on every interface is reached by any of
+	// their addresses, but never by a name which could be rebound
+	ip := net.ParseIP(hostname)
+	if addrHost == "" || net.ParseIP(addrHost).IsUnspecified() {
+		return ip != nil
+	}
+	return ip != nil && ip.Equal(net.ParseIP(addrHost)) || strings.EqualFold(hostname, addrHost)
+}
@@ -0,0 +1,59 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"ngrok/log"
+	"strings"
+	"testing"
+)
+
+func TestGuardApi(t *testing.T) {
+	for _, c := range []struct {
+		name         string
+		addr         string
+		method, host string
+		origin       string
+		contentType  string
+		status       int
+	}{
+		{"curl", "127.0.0.1:4040", "POST", "127.0.0.1:4040", "", "application/json", 200},
+		{"localhost", "127.0.0.1:4040", "POST", "localhost:4040", "", "application/json; charset=utf-8", 200},
+		{"ipv6", "127.0.0.1:4040", "GET", "[::1]:4040", "", "", 200},
+		{"inspector page", "127.0.0.1:4040", "DELETE", "127.0.0.1:4040", "http://127.0.0.1:4040", "", 200},
+		{"cross origin post", "127.0.0.1:4040", "POST", "127.0.0.1:4040", "https://evil.example", "application/json", 403},
+		{"cross origin delete", "127.0.0.1:4040", "DELETE", "127.0.0.1:4040", "https://evil.example", "", 403},
+		{"opaque origin", "127.0.0.1:4040", "POST", "127.0.0.1:4040", "null", "application/json", 403},
+		{"other port origin", "127.0.0.1:4040", "POST", "127.0.0.1:4040", "http://127.0.0.1:8080", "application/json", 403},
+		{"rebound name", "127.0.0.1:4040", "GET", "evil.example:4040", "", "", 403},
+		{"rebound post", "127.0.0.1:4040", "POST", "evil.example:4040", "http://evil.example:4040", "application/json", 403},
+		{"no port", "127.0.0.1:4040", "GET", "localhost", "", "", 403},
+		{"other port", "127.0.0.1:4040", "GET", "localhost:8080", "", "", 403},
+		{"simple post", "127.0.0.1:4040", "POST", "127.0.0.1:4040", "", "text/plain", 415},
+		{"form post", "127.0.0.1:4040", "POST", "127.0.0.1:4040", "", "application/x-www-form-urlencoded", 415},
+		{"no content type", "127.0.0.1:4040", "POST", "127.0.0.1:4040", "", "", 415},
+		{"any interface", "0.0.0.0:4040", "GET", "192.168.1.5:4040", "", "", 200},
+		{"any interface name", ":4040", "GET", "evil.example:4040", "", "", 403},
+		{"named address", "inspect.lan:4040", "GET", "inspect.lan:4040", "", "", 200},
+	} {
+		wv := &WebView{Logger: log.NewPrefixLogger("view", "web"), addr: c.addr}
+		h := wv.guardApi(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(200)
+		})
+
+		req := httptest.NewRequest(c.method, "http://"+c.host+"/api/tunnels", strings.NewReader(`{"name":"x","subdomain":"evil","proto":{"http":"8080"}}`))
+		req.Host = c.host
+		if c.origin != "" {
+			req.Header.Set("Origin", c.origin)
+		}
+		if c.contentType != "" {
+			req.Header.Set("Content-Type", c.contentType)
+		}
+
+		w := httptest.NewRecorder()
+		h(w, req)
+		if w.Code != c.status {
+			t.Errorf("%s: got %d, expected %d", c.name, w.Code, c.status)
+		}
+	}
+}
@@ -142,6 +142,30 @@ func makeBody(h http.Header, body []byte) SerializedBody {
 	return b
 }
 
+func serializeRequest(r *proto.HttpRequest) (SerializedRequest, error) {
+	rawReq, err := proto.DumpRequestOut(r.Request, true)
+	if err != nil {
+		return SerializedRequest{}, err
+	}
+
+	// Go keeps the Host header out of Header, show it along with
+	// X-Forwarded-Host when the tunnel rewrites it
+	header := make(http.Header, len(r.Header)+1)
+	for k, v := range r.Header {
+		header[k] = v
+	}
+	header.Set("Host", r.Host)
+
+	return SerializedRequest{
+		MethodPath: r.Method + " " + r.URL.Path,
+		Raw:        base64.StdEncoding.EncodeToString(rawReq),
+		Params:     r.URL.Query(),
+		Header:     header,
+		Body:       makeBody(r.Header, r.BodyBytes),
+		Binary:     !utf8.Valid(rawReq),
+	}, nil
+}
+
 func (whv *WebHttpView) updateHttp() {
 	// open channels for incoming http state changes
 	// and broadcasts
@@ -154,24 +178,16 @@ func (whv *WebHttpView) updateHttp() {
 		// we haven't processed this transaction yet if we haven't set the
 		// user data
 		if htxn.UserCtx == nil {
-			rawReq, err := proto.DumpRequestOut(htxn.Req.Request, true)
+			req, err := serializeRequest(htxn.Req)
 			if err != nil {
 				whv.Error("Failed to dump request: %v", err)
 				continue
 			}
 
-			body := makeBody(htxn.Req.Header, htxn.Req.BodyBytes)
 			whtxn := &SerializedTxn{
 				Id:      util.RandId(8),
 				HttpTxn: htxn,
-				Req: SerializedRequest{
-					MethodPath: htxn.Req.Method + " " + htxn.Req.URL.Path,
-					Raw:        base64.StdEncoding.EncodeToString(rawReq),
-					Params:     htxn.Req.URL.Query(),
-					Header:     htxn.Req.Header,
-					Body:       body,
-					Binary:     !utf8.Valid(rawReq),
-				},
+				Req:     req,
 				Start:   htxn.Start.Unix(),
 				ConnCtx: htxn.ConnUserCtx.(mvc.ConnectionContext),
 			}
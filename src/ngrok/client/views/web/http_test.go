@@ -0,0 +1,30 @@
+package web
+
+import (
+	"encoding/base64"
+	"net/http"
+	"ngrok/proto"
+	"strings"
+	"testing"
+)
+
+func TestSerializeRequestHost(t *testing.T) {
+	// a request whose host the tunnel rewrote
+	r, _ := http.NewRequest("GET", "http://127.0.0.1:8080/path?q=1", nil)
+	r.Host = "127.0.0.1:8080"
+	r.Header.Set("X-Forwarded-Host", "foo.ngrok.test")
+
+	req, err := serializeRequest(&proto.HttpRequest{Request: r})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req.Header.Get("Host") != "127.0.0.1:8080" || req.Header.Get("X-Forwarded-Host") != "foo.ngrok.test" {
+		t.Errorf("Inspector shows the headers %v", req.Header)
+	}
+
+	raw, _ := base64.StdEncoding.DecodeString(req.Raw)
+	if !strings.Contains(string(raw), "Host: 127.0.0.1:8080\r\n") || !strings.Contains(string(raw), "X-Forwarded-Host: foo.ngrok.test\r\n") {
+		t.Errorf("Inspector shows the raw request:\n%s", raw)
+	}
+}
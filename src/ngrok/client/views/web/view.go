@@ -2,6 +2,8 @@
 package web
 
 import (
+	"bytes"
+	"encoding/json"
 	"github.com/gorilla/websocket"
 	"net/http"
 	"ngrok/client/assets"
@@ -17,6 +19,9 @@ type WebView struct {
 
 	ctl mvc.Controller
 
+	// the address the web interface is served on
+	addr string
+
 	// messages sent over this broadcast are sent to all websocket connections
 	wsMessages *util.Broadcast
 }
@@ -26,6 +31,7 @@ func NewWebView(ctl mvc.Controller, addr string) *WebView {
 		Logger:     log.NewPrefixLogger("view", "web"),
 		wsMessages: util.NewBroadcast(),
 		ctl:        ctl,
+		addr:       addr,
 	}
 
 	// for now, always redirect to the http view
@@ -65,11 +71,43 @@ func NewWebView(ctl mvc.Controller, addr string) *WebView {
 		w.Write(buf)
 	})
 
+	// json api for managing tunnels
+	wv.registerApi()
+
+	// push changes to the list of tunnels to the websocket connections
+	ctl.Go(wv.updateTunnels)
+
 	wv.Info("Serving web interface on %s", addr)
 	wv.ctl.Go(func() { http.ListenAndServe(addr, nil) })
 	return wv
 }
 
+func (wv *WebView) updateTunnels() {
+	updates := wv.ctl.Updates().Reg()
+	defer wv.ctl.Updates().UnReg(updates)
+
+	var last []byte
+	for obj := range updates {
+		state := obj.(mvc.State)
+
+		payload, err := json.Marshal(struct {
+			UiState SerializedUiState
+		}{
+			UiState: SerializedUiState{Tunnels: state.GetTunnels()},
+		})
+		if err != nil {
+			wv.Error("Failed to serialize tunnels for websocket: %v", err)
+			continue
+		}
+
+		// the model updates frequently, only send when the tunnels changed
+		if !bytes.Equal(payload, last) {
+			last = payload
+			wv.wsMessages.In() <- payload
+		}
+	}
+}
+
 func (wv *WebView) NewHttpView(proto *proto.Http) *WebHttpView {
 	return newWebHttpView(wv.ctl, wv, proto)
 }
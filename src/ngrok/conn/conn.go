@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"encoding/base64"
 	"fmt"
+	"github.com/hashicorp/yamux"
 	vhost "github.com/inconshreveable/go-vhost"
 	"io"
 	"math/rand"
@@ -13,6 +14,7 @@ import (
 	"net/url"
 	"ngrok/log"
 	"sync"
+	"sync/atomic"
 )
 
 type Conn interface {
@@ -29,22 +31,36 @@ type loggedConn struct {
 	log.Logger
 	id  int32
 	typ string
+
+	// address of the public client when the connection was forwarded
+	// by another ngrokd node, nil to use the address of the peer
+	remoteAddr net.Addr
 }
 
 type Listener struct {
 	net.Addr
 	Conns chan *loggedConn
+
+	listener net.Listener
+	closing  int32
 }
 
 func wrapConn(conn net.Conn, typ string) *loggedConn {
 	switch c := conn.(type) {
 	case *vhost.HTTPConn:
 		wrapped := c.Conn.(*loggedConn)
-		return &loggedConn{wrapped.tcp, conn, wrapped.Logger, wrapped.id, wrapped.typ}
+		return &loggedConn{wrapped.tcp, conn, wrapped.Logger, wrapped.id, wrapped.typ, wrapped.remoteAddr}
+	case *vhost.TLSConn:
+		wrapped := c.Conn.(*loggedConn)
+		return &loggedConn{wrapped.tcp, conn, wrapped.Logger, wrapped.id, wrapped.typ, wrapped.remoteAddr}
 	case *loggedConn:
 		return c
 	case *net.TCPConn:
-		wrapped := &loggedConn{c, conn, log.NewPrefixLogger(), rand.Int31(), typ}
+		wrapped := &loggedConn{c, conn, log.NewPrefixLogger(), rand.Int31(), typ, nil}
+		wrapped.AddLogPrefix(wrapped.Id())
+		return wrapped
+	case *yamux.Stream:
+		wrapped := &loggedConn{nil, conn, log.NewPrefixLogger(), rand.Int31(), typ, nil}
 		wrapped.AddLogPrefix(wrapped.Id())
 		return wrapped
 	}
@@ -60,14 +76,21 @@ func Listen(addr, typ string, tlsCfg *tls.Config) (l *Listener, err error) {
 	}
 
 	l = &Listener{
-		Addr:  listener.Addr(),
-		Conns: make(chan *loggedConn),
+		Addr:     listener.Addr(),
+		Conns:    make(chan *loggedConn),
+		listener: listener,
 	}
 
 	go func() {
 		for {
 			rawConn, err := listener.Accept()
 			if err != nil {
+				// not an error, the listener was closed on purpose
+				if atomic.LoadInt32(&l.closing) == 1 {
+					close(l.Conns)
+					return
+				}
+
 				log.Error("Failed to accept new TCP connection of type %s: %v", typ, err)
 				continue
 			}
@@ -83,6 +106,15 @@ func Listen(addr, typ string, tlsCfg *tls.Config) (l *Listener, err error) {
 	return
 }
 
+// Stops accepting new connections. Conns is closed once the
+// connection being accepted, if any, has been handed off.
+func (l *Listener) Close() error {
+	if !atomic.CompareAndSwapInt32(&l.closing, 0, 1) {
+		return nil
+	}
+	return l.listener.Close()
+}
+
 func Wrap(conn net.Conn, typ string) *loggedConn {
 	return wrapConn(conn, typ)
 }
@@ -165,6 +197,46 @@ func (c *loggedConn) StartTLS(tlsCfg *tls.Config) {
 	c.Conn = tls.Client(c.Conn, tlsCfg)
 }
 
+func (c *loggedConn) StartTLSServer(tlsCfg *tls.Config) {
+	c.Conn = tls.Server(c.Conn, tlsCfg)
+}
+
+// Completes the handshake of a connection upgraded with StartTLS or
+// StartTLSServer and returns the protocol negotiated with ALPN
+func (c *loggedConn) Handshake() (string, error) {
+	tlsConn, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return "", fmt.Errorf("Connection %s is not a TLS connection", c.Id())
+	}
+
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+	return tlsConn.ConnectionState().NegotiatedProtocol, nil
+}
+
+// Exports keying material from the TLS session of a connection, completing
+// the handshake first, so that both ends can bind a shared secret to it
+func (c *loggedConn) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	tlsConn, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return nil, fmt.Errorf("Connection %s is not a TLS connection", c.Id())
+	}
+
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	state := tlsConn.ConnectionState()
+	return state.ExportKeyingMaterial(label, context, length)
+}
+
+// Terminates TLS on c as the server, logging like c
+func TLSServer(c Conn, tlsCfg *tls.Config) Conn {
+	wrapped := c.(*loggedConn)
+	return &loggedConn{wrapped.tcp, tls.Server(wrapped, tlsCfg), wrapped.Logger, wrapped.id, wrapped.typ, wrapped.remoteAddr}
+}
+
 func (c *loggedConn) Close() (err error) {
 	if err := c.Conn.Close(); err == nil {
 		c.Debug("Closing")
@@ -172,6 +244,19 @@ func (c *loggedConn) Close() (err error) {
 	return
 }
 
+func (c *loggedConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// Reports addr as the remote address of a connection which another
+// ngrokd node forwarded on behalf of a public client
+func (c *loggedConn) SetRemoteAddr(addr net.Addr) {
+	c.remoteAddr = addr
+}
+
 func (c *loggedConn) Id() string {
 	return fmt.Sprintf("%s:%x", c.typ, c.id)
 }
@@ -189,6 +274,9 @@ func (c *loggedConn) CloseRead() error {
 	// connection termination. Unfortunately, when I've tried that, I've observed
 	// failures where the connection was closed *before* flushing its write buffer,
 	// set with SetLinger() set properly (which it is by default).
+	if c.tcp == nil {
+		return fmt.Errorf("CloseRead is not supported on multiplexed stream %s", c.Id())
+	}
 	return c.tcp.CloseRead()
 }
 
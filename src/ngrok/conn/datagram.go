@@ -0,0 +1,39 @@
+package conn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The largest datagram which can be carried over a stream
+const MaxDatagramSize = 65535
+
+// Writes a datagram to a stream as a 2 byte big-endian length followed by
+// its payload, so that udp tunnels can carry datagrams over proxy connections
+func WriteDatagram(w io.Writer, p []byte) error {
+	if len(p) > MaxDatagramSize {
+		return fmt.Errorf("Datagram of %d bytes is too large", len(p))
+	}
+
+	frame := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[2:], p)
+	_, err := w.Write(frame)
+	return err
+}
+
+// Reads a datagram written by WriteDatagram into buf, which must be able
+// to hold MaxDatagramSize bytes, and returns the payload
+func ReadDatagram(r io.Reader, buf []byte) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+
+	n := int(binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
@@ -0,0 +1,62 @@
+package conn
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDatagramFraming(t *testing.T) {
+	var stream bytes.Buffer
+	datagrams := [][]byte{
+		{},
+		[]byte("hello"),
+		bytes.Repeat([]byte{0xff}, 1500),
+		bytes.Repeat([]byte{'x'}, MaxDatagramSize),
+	}
+
+	for _, p := range datagrams {
+		if err := WriteDatagram(&stream, p); err != nil {
+			t.Fatalf("Failed to write %d bytes: %v", len(p), err)
+		}
+	}
+
+	// datagrams keep their boundaries on the stream
+	buf := make([]byte, MaxDatagramSize)
+	for _, expected := range datagrams {
+		p, err := ReadDatagram(&stream, buf)
+		if err != nil {
+			t.Fatalf("Failed to read %d bytes: %v", len(expected), err)
+		}
+		if !bytes.Equal(p, expected) {
+			t.Fatalf("Read %d bytes, expected %d", len(p), len(expected))
+		}
+	}
+
+	if _, err := ReadDatagram(&stream, buf); err != io.EOF {
+		t.Errorf("Read past the last datagram returned %v, expected EOF", err)
+	}
+}
+
+func TestDatagramFramingErrors(t *testing.T) {
+	var stream bytes.Buffer
+	if err := WriteDatagram(&stream, make([]byte, MaxDatagramSize+1)); err == nil {
+		t.Errorf("Oversized datagram was written")
+	}
+	if stream.Len() != 0 {
+		t.Errorf("Oversized datagram left %d bytes on the stream", stream.Len())
+	}
+
+	buf := make([]byte, MaxDatagramSize)
+	for _, c := range []struct {
+		name  string
+		frame []byte
+	}{
+		{"short length", []byte{0}},
+		{"short payload", []byte{0, 5, 'h', 'e'}},
+	} {
+		if _, err := ReadDatagram(bytes.NewReader(c.frame), buf); err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: read returned %v, expected an unexpected EOF", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package conn
+
+import (
+	"github.com/hashicorp/yamux"
+	"net"
+	"ngrok/log"
+	"strings"
+)
+
+// yamux logs through an io.Writer, send its messages to the connection's logger
+type muxLogWriter struct {
+	log.Logger
+}
+
+func (w *muxLogWriter) Write(p []byte) (int, error) {
+	w.Warn("%s", strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// The stream carrying control messages lives as long as the session,
+// so closing it tears down the session and all of its proxy streams
+type ctlStream struct {
+	net.Conn
+	session *yamux.Session
+}
+
+func (s *ctlStream) Close() error {
+	return s.session.Close()
+}
+
+// Starts a multiplexed session over a control connection once both sides
+// have agreed to it in Auth/AuthResp. The server opens the first stream of
+// the session which carries control messages from then on and is returned
+// in place of c. Every other stream is a proxy connection opened by the server.
+func StartMux(c Conn, isServer bool) (ctl Conn, session *yamux.Session, err error) {
+	config := yamux.DefaultConfig()
+	config.LogOutput = &muxLogWriter{c}
+
+	var stream net.Conn
+	if isServer {
+		if session, err = yamux.Server(c, config); err != nil {
+			return
+		}
+		stream, err = session.OpenStream()
+	} else {
+		if session, err = yamux.Client(c, config); err != nil {
+			return
+		}
+		stream, err = session.AcceptStream()
+	}
+
+	if err != nil {
+		session.Close()
+		return
+	}
+
+	parent := c.(*loggedConn)
+	ctl = &loggedConn{parent.tcp, &ctlStream{stream, session}, parent.Logger, parent.id, parent.typ, nil}
+	c.Debug("Multiplexing proxy connections over the control connection")
+	return
+}
@@ -0,0 +1,151 @@
+package conn
+
+import (
+	"sync"
+	"time"
+)
+
+// A token bucket which shapes bytes to a rate a second, letting up to
+// burst bytes through at once. A nil limiter doesn't limit.
+type RateLimiter struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Returns nil if rate isn't positive. The burst defaults to the rate.
+func NewRateLimiter(rate, burst int64) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	l := &RateLimiter{last: time.Now()}
+	l.SetRate(rate, burst)
+	l.tokens = l.burst
+	return l
+}
+
+// Changes the rate and burst, the bytes already let through still count
+func (l *RateLimiter) SetRate(rate, burst int64) {
+	if burst <= 0 {
+		burst = rate
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	l.rate = float64(rate)
+	l.burst = float64(burst)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// Bytes a second, 0 for a nil limiter
+func (l *RateLimiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	return int64(l.rate)
+}
+
+func (l *RateLimiter) Burst() int64 {
+	if l == nil {
+		return 0
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	return int64(l.burst)
+}
+
+// Takes n bytes from the bucket, sleeping until the rate allows them.
+// Bytes beyond what's in the bucket are borrowed from the bucket's
+// future, so every caller waits in turn.
+func (l *RateLimiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.Unlock()
+
+	time.Sleep(wait)
+}
+
+// Takes n bytes from the bucket if it holds them, never waits. Returns
+// false without taking anything if the rate doesn't allow them yet.
+func (l *RateLimiter) Allow(n int) bool {
+	if l == nil || n <= 0 {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens < float64(n) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+// A connection whose reads are shaped by rate limiters
+type limitedConn struct {
+	Conn
+	limiters []*RateLimiter
+}
+
+// Shapes the bytes read from c by every one of the limiters, nil ones
+// are skipped. Returns c itself if none of them limits.
+func Limit(c Conn, limiters ...*RateLimiter) Conn {
+	var active []*RateLimiter
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+
+	if len(active) == 0 {
+		return c
+	}
+	return &limitedConn{Conn: c, limiters: active}
+}
+
+func (c *limitedConn) Read(p []byte) (n int, err error) {
+	// read no more at once than a burst, so that the bytes are let
+	// through evenly instead of in big chunks after long waits
+	for _, l := range c.limiters {
+		if burst := int(l.Burst()); burst > 0 && len(p) > burst {
+			p = p[:burst]
+		}
+	}
+
+	n, err = c.Conn.Read(p)
+	for _, l := range c.limiters {
+		l.Wait(n)
+	}
+	return
+}
@@ -0,0 +1,98 @@
+package conn
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterWait(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		rate, burst int64
+		waits       []int
+		min, max    time.Duration
+	}{
+		{"within burst", 100000, 10000, []int{5000, 5000}, 0, 50 * time.Millisecond},
+		{"default burst", 100000, 0, []int{100000}, 0, 50 * time.Millisecond},
+		{"beyond burst", 100000, 10000, []int{10000, 20000}, 150 * time.Millisecond, 400 * time.Millisecond},
+		{"borrowed", 100000, 10000, []int{30000}, 150 * time.Millisecond, 400 * time.Millisecond},
+		{"nothing", 1, 1, []int{0, -5}, 0, 50 * time.Millisecond},
+	} {
+		l := NewRateLimiter(c.rate, c.burst)
+		start := time.Now()
+		for _, n := range c.waits {
+			l.Wait(n)
+		}
+
+		if elapsed := time.Since(start); elapsed < c.min || elapsed > c.max {
+			t.Errorf("%s: waited %v, expected between %v and %v", c.name, elapsed, c.min, c.max)
+		}
+	}
+}
+
+func TestRateLimiterConcurrentWait(t *testing.T) {
+	// callers take turns, the bytes of all of them are shaped together
+	l := NewRateLimiter(100000, 10000)
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.Wait(10000)
+		}()
+	}
+	wg.Wait()
+
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond || elapsed > 600*time.Millisecond {
+		t.Errorf("4 callers waited %v, expected about 300ms", elapsed)
+	}
+}
+
+func TestRateLimiterSettings(t *testing.T) {
+	var none *RateLimiter
+	none.Wait(1 << 20)
+	if none.Rate() != 0 || none.Burst() != 0 {
+		t.Errorf("Nil limiter reports a rate")
+	}
+
+	if l := NewRateLimiter(0, 100); l != nil {
+		t.Errorf("Limiter created without a rate")
+	}
+
+	// lowering the burst drops the tokens above it
+	l := NewRateLimiter(100000, 50000)
+	l.SetRate(100000, 1000)
+	if l.Rate() != 100000 || l.Burst() != 1000 {
+		t.Fatalf("SetRate left rate %d and burst %d", l.Rate(), l.Burst())
+	}
+
+	start := time.Now()
+	l.Wait(11000)
+	if elapsed := time.Since(start); elapsed < 70*time.Millisecond {
+		t.Errorf("Waited %v after the burst was lowered, expected about 100ms", elapsed)
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	var none *RateLimiter
+	if !none.Allow(1 << 20) {
+		t.Errorf("Nil limiter refused bytes")
+	}
+
+	l := NewRateLimiter(10, 2)
+	if !l.Allow(1) || !l.Allow(1) {
+		t.Fatalf("Limiter refused bytes within its burst")
+	}
+	if l.Allow(1) {
+		t.Fatalf("Limiter allowed bytes beyond its burst")
+	}
+
+	// refused bytes aren't borrowed, the bucket refills as usual
+	time.Sleep(150 * time.Millisecond)
+	if !l.Allow(1) {
+		t.Errorf("Limiter refused bytes after refilling")
+	}
+}
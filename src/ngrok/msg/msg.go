@@ -15,6 +15,9 @@ func init() {
 	TypeMap["AuthResp"] = t((*AuthResp)(nil))
 	TypeMap["ReqTunnel"] = t((*ReqTunnel)(nil))
 	TypeMap["NewTunnel"] = t((*NewTunnel)(nil))
+	TypeMap["CloseTunnel"] = t((*CloseTunnel)(nil))
+	TypeMap["TunnelClosed"] = t((*TunnelClosed)(nil))
+	TypeMap["ServerGoingAway"] = t((*ServerGoingAway)(nil))
 	TypeMap["RegProxy"] = t((*RegProxy)(nil))
 	TypeMap["ReqProxy"] = t((*ReqProxy)(nil))
 	TypeMap["StartProxy"] = t((*StartProxy)(nil))
@@ -39,6 +42,7 @@ type Auth struct {
 	OS        string
 	Arch      string
 	ClientId  string // empty for new sessions
+	Mux       bool   // client can multiplex proxy connections over the control connection
 }
 
 // A server responds to an Auth message with an
@@ -51,11 +55,16 @@ type Auth struct {
 // The server response includes a unique ClientId
 // that is used to associate and authenticate future
 // proxy connections via the same field in RegProxy messages.
+//
+// If Mux is true the server has agreed to multiplex proxy
+// connections over the control connection. The AuthResp is then
+// the last message sent over the raw connection, see conn.StartMux.
 type AuthResp struct {
 	Version   string
 	MmVersion string
 	ClientId  string
 	Error     string
+	Mux       bool
 }
 
 // A client sends this message to the server over the control channel
@@ -71,8 +80,62 @@ type ReqTunnel struct {
 	Subdomain string
 	HttpAuth  string
 
+	// more credentials requests must present, users are user:password
+	// where the password may be a bcrypt hash and so may tokens
+	HttpAuthUsers  []string
+	HttpAuthTokens []string
+	HttpAuthRealm  string
+
+	// browsers must log in with an OpenID Connect provider
+	Oidc *OidcOptions
+
+	// CIDRs public connections are allowed from and denied from,
+	// deny takes precedence and an empty allow list allows everyone
+	AllowCIDRs []string
+	DenyCIDRs  []string
+
+	// https only, the client terminates TLS itself so the
+	// server passes connections through still encrypted
+	ClientTLS bool
+
+	// http only, what the server speaks over proxy connections for
+	// requests which arrive over HTTP/2: http1 or http2, which is h2c
+	// and is what gRPC services need
+	AppProtocol string
+
+	// http, https and tls only, tunnels of any client which ask for the
+	// same hostname with the same group secret share it and the server
+	// balances public connections across them: round_robin, the default,
+	// or least_connections
+	GroupSecret string
+	Balance     string
+
+	// http and https members of a tunnel group only, requests with the
+	// header, "Name: value", or the cookie, "name=value", are routed to
+	// this member and it gets weight percent of the rest. HTTP/1.1
+	// connections are routed by their first request.
+	RouteHeader string
+	RouteCookie string
+	Weight      int
+
 	// tcp only
 	RemotePort uint16
+
+	// the client asked for the tunnel after it connected, so failing to
+	// open it doesn't end the session the way failing its initial ones does
+	Optional bool
+}
+
+// The OpenID Connect provider browsers log in with before requests reach
+// an http tunnel. When EmailDomains and Subjects are both empty anyone who
+// can log in with the provider is allowed, otherwise the ID token's subject
+// must be listed or its verified email must be in one of the domains.
+type OidcOptions struct {
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	EmailDomains []string
+	Subjects     []string
 }
 
 // When the server opens a new tunnel on behalf of
@@ -82,16 +145,53 @@ type ReqTunnel struct {
 // A client may receive *multiple* NewTunnel messages from a single
 // ReqTunnel. (ex. A client opens an https tunnel and the server
 // chooses to open an http tunnel of the same name as well)
+//
+// If Error is not the empty string, the server failed to open the
+// tunnel and will not send any more NewTunnel messages for the ReqTunnel.
+//
+// ClientTLS confirms that the server passes connections to an https
+// tunnel through without decrypting them, as asked for in the ReqTunnel.
+//
+// RateLimit is the number of bytes a second the server lets the tunnel
+// carry in each direction, 0 if it's unlimited.
 type NewTunnel struct {
-	ReqId    string
-	Url      string
-	Protocol string
-	Error    string
+	ReqId     string
+	Url       string
+	Protocol  string
+	Error     string
+	ClientTLS bool
+	RateLimit int64
+}
+
+// A client sends this message to the server over the control channel
+// to close one of its tunnels without closing the control connection.
+type CloseTunnel struct {
+	Url string
+}
+
+// The server sends this message over the control channel when it has
+// closed a tunnel, either in response to a CloseTunnel message or because
+// the server decided to close it on its own.
+//
+// If Error is not the empty string, the tunnel could not be closed.
+type TunnelClosed struct {
+	Url   string
+	Error string
+}
+
+// The server sends this message over the control channel when it is
+// shutting down. It stops accepting connections, but those already joined
+// with a proxy connection may continue until the server exits, so the client
+// should keep the control connection open until the server closes it while
+// it immediately reconnects and requests its tunnels again.
+type ServerGoingAway struct {
+	Reason string
 }
 
 // When the server wants to initiate a new tunneled connection, it sends
 // this message over the control channel to the client. When a client receives
 // this message, it must initiate a new proxy connection to the server.
+// It is never sent on multiplexed sessions, the server opens a stream instead.
 type ReqProxy struct {
 }
 
@@ -102,7 +202,8 @@ type RegProxy struct {
 }
 
 // This message is sent by the server to the client over a *proxy* connection before it
-// begins to send the bytes of the proxied request.
+// begins to send the bytes of the proxied request. On multiplexed sessions
+// it is the first message of each stream the server opens.
 type StartProxy struct {
 	Url        string // URL of the tunnel this connection connection is being proxied for
 	ClientAddr string // Network address of the client initiating the connection to the tunnel
@@ -72,8 +72,15 @@ func (h *Http) WrapConn(c conn.Conn, ctx interface{}) conn.Conn {
 func (h *Http) readRequests(tee *conn.Tee, lastTxn chan *HttpTxn, connCtx interface{}) {
 	defer close(lastTxn)
 
+	// requests ngrokd proxies to h2c services are decoded frame by frame
+	wr := tee.WriteBuffer()
+	if isHttp2(wr) {
+		h.readHttp2(wr, tee.ReadBuffer(), connCtx)
+		return
+	}
+
 	for {
-		req, err := http.ReadRequest(tee.WriteBuffer())
+		req, err := http.ReadRequest(wr)
 		if err != nil {
 			// no more requests to be read, we're done
 			break
@@ -0,0 +1,238 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the size of the hpack dynamic table until a peer changes it
+const http2HeaderTableSize = 4096
+
+// Whether a connection starts with the HTTP/2 client preface. Only as many
+// bytes are peeked as match it, so HTTP/1 requests are never waited on.
+func isHttp2(rd *bufio.Reader) bool {
+	preface := []byte(http2.ClientPreface)
+	for i := 1; i <= len(preface); i++ {
+		b, err := rd.Peek(i)
+		if err != nil || !bytes.Equal(b, preface[:i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// A stream of an h2c connection being decoded into a transaction
+type http2Stream struct {
+	txn      *HttpTxn
+	reqBody  bytes.Buffer
+	respBody bytes.Buffer
+	reqDone  bool
+	respDone bool
+}
+
+// The streams of an h2c connection, shared by the goroutines decoding
+// the frames sent in either direction
+type http2Conn struct {
+	sync.Mutex
+	*Http
+	connCtx interface{}
+	streams map[uint32]*http2Stream
+}
+
+// Decodes the streams of a proxy connection which carries h2c into
+// transactions. A request is reported once the public client has sent
+// all of it, its response once the local service has sent all of that.
+func (h *Http) readHttp2(requests, responses *bufio.Reader, connCtx interface{}) {
+	c := &http2Conn{
+		Http:    h,
+		connCtx: connCtx,
+		streams: make(map[uint32]*http2Stream),
+	}
+
+	// the client preface isn't a frame
+	requests.Discard(len(http2.ClientPreface))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		c.readFrames(responses, false)
+		wg.Done()
+	}()
+
+	c.readFrames(requests, true)
+	wg.Wait()
+}
+
+func (c *http2Conn) readFrames(rd io.Reader, requests bool) {
+	// whatever can't be decoded must still be read, otherwise the tee
+	// blocks the connection
+	defer io.Copy(ioutil.Discard, rd)
+
+	fr := http2.NewFramer(nil, rd)
+	fr.ReadMetaHeaders = hpack.NewDecoder(http2HeaderTableSize, nil)
+
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			return
+		}
+
+		c.Lock()
+		switch f := f.(type) {
+		case *http2.MetaHeadersFrame:
+			c.headers(f, requests)
+		case *http2.DataFrame:
+			c.data(f, requests)
+		case *http2.RSTStreamFrame:
+			c.reset(f.StreamID)
+		}
+		c.Unlock()
+	}
+}
+
+// Handles a request or response header block, or the trailers after them
+func (c *http2Conn) headers(f *http2.MetaHeadersFrame, request bool) {
+	s, ok := c.streams[f.StreamID]
+	if !ok {
+		// the response may be decoded before its request
+		s = &http2Stream{txn: &HttpTxn{Start: time.Now(), ConnUserCtx: c.connCtx}}
+		c.streams[f.StreamID] = s
+	}
+
+	header := make(http.Header)
+	for _, hf := range f.RegularFields() {
+		header.Add(http.CanonicalHeaderKey(hf.Name), hf.Value)
+	}
+
+	if request {
+		if s.txn.Req == nil {
+			u, err := url.ParseRequestURI(f.PseudoValue("path"))
+			if err != nil {
+				u = new(url.URL)
+			}
+			u.Scheme = "http"
+			u.Host = f.PseudoValue("authority")
+
+			s.txn.Start = time.Now()
+			s.txn.Req = &HttpRequest{Request: &http.Request{
+				Method:     f.PseudoValue("method"),
+				URL:        u,
+				Proto:      "HTTP/2.0",
+				ProtoMajor: 2,
+				Header:     header,
+				Host:       u.Host,
+			}}
+		} else {
+			s.txn.Req.Trailer = header
+		}
+	} else {
+		status, _ := strconv.Atoi(f.PseudoValue("status"))
+		if s.txn.Resp == nil {
+			// informational responses like 100 Continue aren't reported
+			if status >= 100 && status < 200 {
+				return
+			}
+
+			s.txn.Resp = &HttpResponse{Response: &http.Response{
+				Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+				StatusCode: status,
+				Proto:      "HTTP/2.0",
+				ProtoMajor: 2,
+				Header:     header,
+			}}
+		} else {
+			s.txn.Resp.Trailer = header
+		}
+	}
+
+	if f.StreamEnded() {
+		c.end(f.StreamID, s, request)
+	}
+}
+
+func (c *http2Conn) data(f *http2.DataFrame, request bool) {
+	s, ok := c.streams[f.StreamID]
+	if !ok {
+		return
+	}
+
+	if request {
+		s.reqBody.Write(f.Data())
+	} else {
+		s.respBody.Write(f.Data())
+	}
+
+	if f.StreamEnded() {
+		c.end(f.StreamID, s, request)
+	}
+}
+
+// Handles one side finishing a stream. The response is reported once
+// both have, since it may be decoded before the end of its request.
+func (c *http2Conn) end(id uint32, s *http2Stream, request bool) {
+	if request {
+		c.endRequest(s)
+	} else {
+		s.respDone = true
+	}
+	c.endResponse(id, s)
+}
+
+// Handles either side resetting a stream. Streams of bidirectional calls
+// are often reset by the client once it has the whole response.
+func (c *http2Conn) reset(id uint32) {
+	s, ok := c.streams[id]
+	if !ok {
+		return
+	}
+	delete(c.streams, id)
+
+	if s.respDone {
+		c.endRequest(s)
+		c.endResponse(id, s)
+	}
+}
+
+func (c *http2Conn) endRequest(s *http2Stream) {
+	if s.reqDone || s.txn.Req == nil {
+		return
+	}
+	s.reqDone = true
+
+	req := s.txn.Req
+	req.BodyBytes = s.reqBody.Bytes()
+	req.Body = ioutil.NopCloser(bytes.NewReader(req.BodyBytes))
+	req.ContentLength = int64(len(req.BodyBytes))
+
+	c.reqMeter.Mark(1)
+	c.Txns.In() <- s.txn
+}
+
+func (c *http2Conn) endResponse(id uint32, s *http2Stream) {
+	if !s.reqDone || !s.respDone || s.txn.Resp == nil {
+		return
+	}
+	delete(c.streams, id)
+
+	txn := s.txn
+	txn.Duration = time.Since(txn.Start)
+	c.reqTimer.Update(txn.Duration)
+
+	resp := txn.Resp
+	resp.Request = txn.Req.Request
+	resp.BodyBytes = s.respBody.Bytes()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(resp.BodyBytes))
+	resp.ContentLength = int64(len(resp.BodyBytes))
+
+	c.Txns.In() <- txn
+}
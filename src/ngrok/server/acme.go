@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"ngrok/conn"
+	"ngrok/log"
+	"strings"
+	"sync"
+)
+
+const (
+	acmeChallengePrefix = "/.well-known/acme-challenge/"
+
+	// autocert caches the key authorization of an http-01 challenge
+	// under the token with this suffix while the challenge is pending
+	acmeTokenSuffix = "+http-01"
+)
+
+// AcmeManager obtains and renews certificates for the hostnames of https
+// tunnels from an ACME certificate authority like Let's Encrypt. Challenges
+// are answered with http-01 on the public http listener, so ngrokd must be
+// reachable on port 80 of every hostname it requests a certificate for.
+//
+// Hostnames the static certificate is valid for keep using it, so a wildcard
+// certificate for the server's domain still serves all of its subdomains.
+type AcmeManager struct {
+	log.Logger
+	manager   *autocert.Manager
+	challenge http.Handler
+	static    *x509.Certificate
+	cache     *challengeCache
+}
+
+func NewAcmeManager(opts *Options, tlsConfig *tls.Config) (*AcmeManager, error) {
+	if opts.acmeCache == "" {
+		return nil, fmt.Errorf("-acmeCache must be specified to use ACME")
+	}
+
+	client := &acme.Client{DirectoryURL: opts.acmeDirectory}
+
+	// test servers like pebble sign their directory with their own CA
+	if opts.acmeCA != "" {
+		pem, err := ioutil.ReadFile(opts.acmeCA)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read ACME CA file %s: %v", opts.acmeCA, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in ACME CA file %s", opts.acmeCA)
+		}
+
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		}
+	}
+
+	m := &AcmeManager{
+		Logger: log.NewPrefixLogger("acme"),
+		cache: &challengeCache{
+			Cache:   autocert.DirCache(opts.acmeCache),
+			pending: make(map[string]bool),
+		},
+	}
+
+	m.manager = &autocert.Manager{
+		Client:     client,
+		Prompt:     autocert.AcceptTOS,
+		Cache:      m.cache,
+		HostPolicy: m.hostPolicy,
+		Email:      opts.acmeEmail,
+	}
+
+	// this also enables the http-01 challenge type
+	m.challenge = m.manager.HTTPHandler(http.NotFoundHandler())
+
+	if len(tlsConfig.Certificates) > 0 {
+		static, err := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse TLS certificate: %v", err)
+		}
+		m.static = static
+	}
+
+	m.Info("Issuing certificates for https tunnels from %s, caching them in %s", opts.acmeDirectory, opts.acmeCache)
+	return m, nil
+}
+
+// Only request certificates for hostnames which have an https tunnel
+func (m *AcmeManager) hostPolicy(ctx context.Context, host string) error {
+	if tunnelRegistry.Peek("https://"+host) == nil {
+		return fmt.Errorf("No https tunnel for %s", host)
+	}
+	return nil
+}
+
+// Picks the certificate for a TLS handshake by SNI. Returning nil makes the
+// handshake fall back to the static certificate.
+func (m *AcmeManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.ToLower(hello.ServerName)
+	if host == "" {
+		return nil, nil
+	}
+
+	if m.static != nil && m.static.VerifyHostname(host) == nil {
+		return nil, nil
+	}
+
+	if m.hostPolicy(context.Background(), host) != nil {
+		return nil, nil
+	}
+
+	cert, err := m.manager.GetCertificate(hello)
+	if err != nil {
+		m.Error("Failed to get certificate for %s: %v", host, err)
+		return nil, nil
+	}
+	return cert, nil
+}
+
+// Whether the request is for a challenge this server answers: the host
+// must have an https tunnel to have asked for a certificate, or the token
+// must belong to a challenge which is still pending. Other requests for
+// the challenge path are routed to the host's http tunnel like any other,
+// so that a client may answer challenges for certificates of its own.
+func (m *AcmeManager) IsChallenge(req *http.Request) bool {
+	if !strings.HasPrefix(req.URL.Path, acmeChallengePrefix) {
+		return false
+	}
+
+	if m.cache.Pending(strings.TrimPrefix(req.URL.Path, acmeChallengePrefix)) {
+		return true
+	}
+
+	host := strings.ToLower(req.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return m.hostPolicy(context.Background(), host) == nil
+}
+
+// Answers an http-01 challenge request which arrived on a public http connection
+func (m *AcmeManager) ServeChallenge(c conn.Conn, req *http.Request) {
+	c.Info("Answering ACME challenge for %s", req.Host)
+
+	w := &bufferedResponse{header: make(http.Header), status: 200}
+	m.challenge.ServeHTTP(w, req)
+
+	if err := writeHttpResponse(c, w.status, w.header, w.body.String()); err != nil {
+		c.Warn("Failed to write ACME challenge response: %v", err)
+	}
+}
+
+// Collects the response of an http.Handler so that it can be written
+// to a raw connection
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponse) Write(p []byte) (int, error) {
+	return w.body.Write(p)
+}
+
+func (w *bufferedResponse) WriteHeader(status int) {
+	w.status = status
+}
+
+// Wraps the certificate cache to keep track of the tokens of the http-01
+// challenges autocert is waiting on
+type challengeCache struct {
+	autocert.Cache
+	pending map[string]bool
+	sync.Mutex
+}
+
+func (c *challengeCache) Put(ctx context.Context, key string, data []byte) error {
+	if token := strings.TrimSuffix(key, acmeTokenSuffix); token != key {
+		c.Lock()
+		c.pending[token] = true
+		c.Unlock()
+	}
+	return c.Cache.Put(ctx, key, data)
+}
+
+func (c *challengeCache) Delete(ctx context.Context, key string) error {
+	if token := strings.TrimSuffix(key, acmeTokenSuffix); token != key {
+		c.Lock()
+		delete(c.pending, token)
+		c.Unlock()
+	}
+	return c.Cache.Delete(ctx, key)
+}
+
+func (c *challengeCache) Pending(token string) bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.pending[token]
+}
@@ -0,0 +1,307 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"ngrok/conn"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testAcmeToken = "Ipz6ZaN1mEXnTBi6xvPqmB4cYj1nGEvb"
+
+// A test ACME certificate authority which validates http-01 challenges by
+// asking the public http listener at addr for them. It offers a single
+// order with a single authorization.
+type testAcmeServer struct {
+	*httptest.Server
+	t      *testing.T
+	public string
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	sync.Mutex
+	domain    string
+	validated bool
+	cert      []byte
+}
+
+func newTestAcmeServer(t *testing.T, public string) *testAcmeServer {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test acme ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(der)
+
+	s := &testAcmeServer{t: t, public: public, caKey: caKey, caCert: caCert}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *testAcmeServer) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", time.Now().UnixNano()))
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.URL.Path == "/dir" {
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   s.URL + "/nonce",
+			"newAccount": s.URL + "/account",
+			"newOrder":   s.URL + "/order",
+			"revokeCert": s.URL + "/revoke",
+			"keyChange":  s.URL + "/key",
+		})
+		return
+	}
+
+	if r.Method != "POST" {
+		return
+	}
+
+	var jws struct{ Payload string }
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+	s.Lock()
+	defer s.Unlock()
+
+	switch r.URL.Path {
+	case "/account":
+		w.Header().Set("Location", s.URL+"/account/1")
+		w.WriteHeader(201)
+		fmt.Fprint(w, `{"status":"valid"}`)
+
+	case "/order":
+		var order struct {
+			Identifiers []struct{ Value string }
+		}
+		json.Unmarshal(payload, &order)
+		s.domain = order.Identifiers[0].Value
+		w.Header().Set("Location", s.URL+"/order/1")
+		w.WriteHeader(201)
+		s.writeOrder(w)
+
+	case "/order/1":
+		s.writeOrder(w)
+
+	case "/authz/1":
+		status := "pending"
+		if s.validated {
+			status = "valid"
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":     status,
+			"identifier": map[string]string{"type": "dns", "value": s.domain},
+			"challenges": []map[string]string{s.challenge()},
+		})
+
+	case "/chal/1":
+		// ask the public listener for the key authorization, the way
+		// a real certificate authority would
+		req, _ := http.NewRequest("GET", "http://"+s.public+acmeChallengePrefix+testAcmeToken, nil)
+		req.Host = s.domain
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			s.t.Errorf("Failed to fetch challenge: %v", err)
+		} else {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			s.validated = resp.StatusCode == 200 && strings.HasPrefix(string(body), testAcmeToken+".")
+		}
+		json.NewEncoder(w).Encode(s.challenge())
+
+	case "/finalize/1":
+		var finalize struct{ Csr string }
+		json.Unmarshal(payload, &finalize)
+		der, _ := base64.RawURLEncoding.DecodeString(finalize.Csr)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		if s.cert, err = x509.CreateCertificate(rand.Reader, tmpl, s.caCert, csr.PublicKey, s.caKey); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		s.writeOrder(w)
+
+	case "/cert/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: s.cert})
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *testAcmeServer) challenge() map[string]string {
+	status := "pending"
+	if s.validated {
+		status = "valid"
+	}
+	return map[string]string{"type": "http-01", "url": s.URL + "/chal/1", "token": testAcmeToken, "status": status}
+}
+
+func (s *testAcmeServer) writeOrder(w http.ResponseWriter) {
+	order := map[string]interface{}{
+		"status":         "pending",
+		"identifiers":    []map[string]string{{"type": "dns", "value": s.domain}},
+		"authorizations": []string{s.URL + "/authz/1"},
+		"finalize":       s.URL + "/finalize/1",
+	}
+
+	switch {
+	case s.cert != nil:
+		order["status"] = "valid"
+		order["certificate"] = s.URL + "/cert/1"
+	case s.validated:
+		order["status"] = "ready"
+	}
+	json.NewEncoder(w).Encode(order)
+}
+
+func TestAcmeCertificate(t *testing.T) {
+	tunnelRegistry = NewTunnelRegistry(16, "", nil)
+	tunnelRegistry.tunnels["https://foo.example.com"] = &Tunnel{url: "https://foo.example.com"}
+	tunnelRegistry.tunnels["http://bar.example.com"] = &Tunnel{url: "http://bar.example.com"}
+
+	// the public http listener the challenges are answered on
+	public, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	go func() {
+		for {
+			c, err := public.Accept()
+			if err != nil {
+				return
+			}
+			go httpHandler(conn.Wrap(c, "pub"), "http")
+		}
+	}()
+
+	ca := newTestAcmeServer(t, public.Addr().String())
+	defer ca.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	acmeManager, err = NewAcmeManager(&Options{
+		acmeDirectory: ca.URL + "/dir",
+		acmeCache:     t.TempDir(),
+		acmeCA:        caFile,
+	}, &tls.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { acmeManager = nil }()
+
+	cert, err := acmeManager.GetCertificate(&tls.ClientHelloInfo{ServerName: "foo.example.com"})
+	if err != nil || cert == nil {
+		t.Fatalf("No certificate was issued: %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.VerifyHostname("foo.example.com"); err != nil {
+		t.Fatalf("Issued certificate is for the wrong host: %v", err)
+	}
+
+	// the challenge is over, so its path is only intercepted for hosts with
+	// an https tunnel and other hosts' tunnels may answer challenges of
+	// their own
+	for _, c := range []struct {
+		host      string
+		challenge bool
+	}{
+		{"foo.example.com", true},
+		{"FOO.example.com:80", true},
+		{"bar.example.com", false},
+		{"unknown.example.com", false},
+	} {
+		req, _ := http.NewRequest("GET", "http://"+c.host+acmeChallengePrefix+testAcmeToken, nil)
+		if got := acmeManager.IsChallenge(req); got != c.challenge {
+			t.Errorf("IsChallenge for %s is %v, expected %v", c.host, got, c.challenge)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "http://foo.example.com/index.html", nil)
+	if acmeManager.IsChallenge(req) {
+		t.Errorf("Request for another path was taken for a challenge")
+	}
+}
+
+func TestChallengeCachePending(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewAcmeManager(&Options{acmeCache: dir}, &tls.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnelRegistry = NewTunnelRegistry(16, "", nil)
+	req, _ := http.NewRequest("GET", "http://gone.example.com"+acmeChallengePrefix+"abc", nil)
+	if m.IsChallenge(req) {
+		t.Fatalf("Challenge for a host without an https tunnel was intercepted")
+	}
+
+	// a pending challenge is answered even if its tunnel is gone
+	m.cache.Put(req.Context(), "abc"+acmeTokenSuffix, []byte("abc.key"))
+	if !m.IsChallenge(req) {
+		t.Fatalf("Pending challenge was not intercepted")
+	}
+
+	m.cache.Delete(req.Context(), "abc"+acmeTokenSuffix)
+	if m.IsChallenge(req) {
+		t.Fatalf("Finished challenge was still intercepted")
+	}
+}
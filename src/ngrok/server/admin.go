@@ -0,0 +1,285 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"ngrok/log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A control connection as reported by the admin api
+type adminSession struct {
+	ClientId      string
+	User          string
+	RemoteAddr    string
+	OS            string
+	Arch          string
+	Version       string
+	Uptime        float64 // seconds
+	ProxyPoolSize int
+	Mux           bool // proxy connections are multiplexed over the control connection
+	Tunnels       []string
+}
+
+// A tunnel as reported by the admin api
+type adminTunnel struct {
+	Url               string
+	Protocol          string
+	ClientId          string
+	User              string
+	Uptime            float64 // seconds
+	Connections       int64
+	ActiveConnections int64
+	BytesIn           int64
+	BytesOut          int64
+	Rejected          int64
+	Balance           string // round_robin or least_connections for the members of a group
+	RateLimit         int64  // bytes a second in each direction, 0 if unlimited
+}
+
+type AdminServer struct {
+	log.Logger
+	mux *http.ServeMux
+}
+
+// Serves a JSON api for inspecting and managing live sessions and tunnels:
+//
+//	GET    /api/sessions          list control sessions
+//	GET    /api/sessions/<id>     show a single control session
+//	DELETE /api/sessions/<id>     close a control session and all of its tunnels
+//	GET    /api/tunnels           list tunnels
+//	DELETE /api/tunnels?url=<url> close a single tunnel or all members of a group, the clients are notified
+//	GET    /api/reservations      list reservations
+//	POST   /api/reservations      reserve a url to a user, the body is {"Url": ..., "User": ...}
+//	DELETE /api/reservations?url=<url>  remove the reservation of a url
+//
+// A node running the memory cluster registry also lists its claims, the other
+// nodes use the registry through the cluster listener instead:
+//
+//	GET    /api/cluster/tunnels   list claims on tunnel urls
+//
+// The api is unauthenticated, so only bind it to a trusted address.
+func startAdminServer(addr string) *AdminServer {
+	a := &AdminServer{
+		Logger: log.NewPrefixLogger("admin"),
+		mux:    http.NewServeMux(),
+	}
+
+	a.mux.HandleFunc("/api/sessions", a.sessions)
+	a.mux.HandleFunc("/api/sessions/", a.session)
+	a.mux.HandleFunc("/api/tunnels", a.tunnels)
+	a.mux.HandleFunc("/api/reservations", a.reservations)
+	a.mux.HandleFunc("/api/cluster/tunnels", a.clusterTunnels)
+
+	a.Info("Serving admin api on %s", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, a.mux); err != nil {
+			a.Error("Admin api failed: %v", err)
+		}
+	}()
+
+	return a
+}
+
+func (a *AdminServer) writeJson(w http.ResponseWriter, v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		a.Error("Failed to serialize response: %v", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+func (a *AdminServer) sessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	// group tunnels by the control connection which owns them
+	tunnelsByCtl := make(map[*Control][]string)
+	for _, t := range tunnelRegistry.All() {
+		tunnelsByCtl[t.ctl] = append(tunnelsByCtl[t.ctl], t.url)
+	}
+
+	sessions := make([]*adminSession, 0)
+	for _, c := range controlRegistry.All() {
+		sessions = append(sessions, newAdminSession(c, tunnelsByCtl[c]))
+	}
+
+	a.writeJson(w, sessions)
+}
+
+func (a *AdminServer) session(w http.ResponseWriter, r *http.Request) {
+	clientId := strings.TrimPrefix(r.URL.Path, "/api/sessions/")
+	c := controlRegistry.Get(clientId)
+	if c == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		tunnels := make([]string, 0)
+		for _, t := range tunnelRegistry.All() {
+			if t.ctl == c {
+				tunnels = append(tunnels, t.url)
+			}
+		}
+		a.writeJson(w, newAdminSession(c, tunnels))
+
+	case "DELETE":
+		a.Info("Closing session %s", clientId)
+		c.shutdown.Begin()
+		w.WriteHeader(204)
+
+	default:
+		http.Error(w, http.StatusText(405), 405)
+	}
+}
+
+func (a *AdminServer) tunnels(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		tunnels := make([]*adminTunnel, 0)
+		for _, t := range tunnelRegistry.All() {
+			tunnels = append(tunnels, newAdminTunnel(t))
+		}
+		a.writeJson(w, tunnels)
+
+	case "DELETE":
+		url := r.URL.Query().Get("url")
+		members := tunnelRegistry.Members(url)
+		if len(members) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		// closing a group closes the tunnels of all of its members
+		a.Info("Closing tunnel %s", url)
+		for _, t := range members {
+			if err := t.ctl.CloseTunnel(url); err != nil {
+				// the control connection is shutting down, which closes the tunnel anyway
+				a.Info("Control for tunnel %s is already closing: %v", url, err)
+			}
+		}
+		w.WriteHeader(204)
+
+	default:
+		http.Error(w, http.StatusText(405), 405)
+	}
+}
+
+func (a *AdminServer) reservations(w http.ResponseWriter, r *http.Request) {
+	store := tunnelRegistry.reservations
+	if store == nil {
+		http.Error(w, "No reservation store configured, run ngrokd with -reservations", 404)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		reservations, err := store.List()
+		if err != nil {
+			a.Error("Failed to list reservations: %v", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		a.writeJson(w, reservations)
+
+	case "POST":
+		var req struct {
+			Url  string
+			User string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), 400)
+			return
+		}
+
+		if req.Url == "" {
+			http.Error(w, "A url is required", 400)
+			return
+		}
+
+		res, err := store.Add(req.Url, req.User)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		a.writeJson(w, res)
+
+	case "DELETE":
+		if err := store.Revoke(r.URL.Query().Get("url")); err != nil {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+		w.WriteHeader(204)
+
+	default:
+		http.Error(w, http.StatusText(405), 405)
+	}
+}
+
+func (a *AdminServer) clusterTunnels(w http.ResponseWriter, r *http.Request) {
+	var registry *MemoryClusterRegistry
+	if cluster != nil {
+		registry, _ = cluster.registry.(*MemoryClusterRegistry)
+	}
+
+	if registry == nil {
+		http.Error(w, "This node doesn't run the cluster registry, run ngrokd with -clusterRegistry=memory", 404)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+	a.writeJson(w, registry.List())
+}
+
+func newAdminSession(c *Control, tunnels []string) *adminSession {
+	if tunnels == nil {
+		tunnels = make([]string, 0)
+	}
+
+	return &adminSession{
+		ClientId:      c.Id(),
+		User:          c.account.User,
+		RemoteAddr:    c.conn.RemoteAddr().String(),
+		OS:            c.auth.OS,
+		Arch:          c.auth.Arch,
+		Version:       c.auth.MmVersion,
+		Uptime:        time.Since(c.start).Seconds(),
+		ProxyPoolSize: len(c.proxies),
+		Mux:           c.mux != nil,
+		Tunnels:       tunnels,
+	}
+}
+
+func newAdminTunnel(t *Tunnel) *adminTunnel {
+	at := &adminTunnel{
+		Url:               t.url,
+		Protocol:          t.req.Protocol,
+		ClientId:          t.ctl.Id(),
+		User:              t.ctl.account.User,
+		Uptime:            time.Since(t.start).Seconds(),
+		Connections:       atomic.LoadInt64(&t.connections),
+		ActiveConnections: atomic.LoadInt64(&t.activeConnections),
+		BytesIn:           atomic.LoadInt64(&t.bytesIn),
+		BytesOut:          atomic.LoadInt64(&t.bytesOut),
+		Rejected:          atomic.LoadInt64(&t.rejected),
+		RateLimit:         t.RateLimit(),
+	}
+
+	if t.group != nil {
+		at.Balance = t.group.balance
+	}
+	return at
+}
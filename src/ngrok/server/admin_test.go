@@ -0,0 +1,245 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/hashicorp/yamux"
+	"net/http"
+	"net/http/httptest"
+	"ngrok/conn"
+	"ngrok/log"
+	"ngrok/msg"
+	"ngrok/version"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Sets up the globals which control sessions need, on top of the tunnel ones
+func testControlGlobals(t *testing.T) {
+	testTunnelGlobals(t)
+	opts.mux = true
+	authenticator = new(OpenAuthenticator)
+	controlRegistry = NewControlRegistry()
+}
+
+// Authenticates a client over loopback tcp and returns its end of the
+// control connection once the control is registered and managed, along
+// with its multiplexed session if the server agreed to one. The session
+// is shut down when the test ends.
+func testSession(t *testing.T, mux bool) (conn.Conn, *yamux.Session, *Control) {
+	serverConn, raw := testConnPair(t)
+	var client conn.Conn = conn.Wrap(raw, "cli")
+	go NewControl(serverConn, &msg.Auth{Version: version.Proto, Mux: mux})
+
+	var resp msg.AuthResp
+	if err := msg.ReadMsgInto(client, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error != "" {
+		t.Fatalf("Failed to authenticate: %s", resp.Error)
+	}
+
+	var session *yamux.Session
+	if resp.Mux {
+		var err error
+		if client, session, err = conn.StartMux(client, false); err != nil {
+			t.Fatal(err)
+		}
+	} else if _, ok := testReadMsg(t, client).(*msg.ReqProxy); !ok {
+		t.Fatalf("Expected a ReqProxy after authenticating")
+	}
+
+	// the manager only answers once the control is registered
+	if err := msg.WriteMsg(client, &msg.Ping{}); err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := testReadMsg(t, client).(*msg.Pong); !ok {
+		t.Fatalf("Got %v, expected a Pong", m)
+	}
+
+	ctl := controlRegistry.Get(resp.ClientId)
+	if ctl == nil {
+		t.Fatalf("Control %s isn't registered", resp.ClientId)
+	}
+	t.Cleanup(func() {
+		raw.Close()
+		ctl.shutdown.WaitComplete()
+	})
+	return client, session, ctl
+}
+
+func testReadMsg(t *testing.T, c conn.Conn) msg.Message {
+	m, err := msg.ReadMsg(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// Opens a tunnel over a session's control connection and returns its url
+func testSessionTunnel(t *testing.T, client conn.Conn, req *msg.ReqTunnel) string {
+	if err := msg.WriteMsg(client, req); err != nil {
+		t.Fatal(err)
+	}
+
+	m, ok := testReadMsg(t, client).(*msg.NewTunnel)
+	if !ok {
+		t.Fatalf("Got %v, expected a NewTunnel", reflect.TypeOf(m))
+	}
+	if m.Error != "" {
+		t.Fatalf("Failed to open tunnel: %s", m.Error)
+	}
+	return m.Url
+}
+
+func testAdminServer() *AdminServer {
+	return &AdminServer{Logger: log.NewPrefixLogger("admin"), mux: http.NewServeMux()}
+}
+
+func testAdminCall(handler http.HandlerFunc, method, url, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+	return w
+}
+
+func TestAdminSessions(t *testing.T) {
+	testControlGlobals(t)
+	a := testAdminServer()
+
+	client, _, ctl := testSession(t, true)
+	url := testSessionTunnel(t, client, &msg.ReqTunnel{Protocol: "http", Subdomain: "foo"})
+
+	w := testAdminCall(a.sessions, "GET", "/api/sessions", "")
+	var sessions []adminSession
+	if err := json.Unmarshal(w.Body.Bytes(), &sessions); err != nil {
+		t.Fatalf("Failed to decode %q: %v", w.Body.String(), err)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("Listed %d sessions, expected 1", len(sessions))
+	}
+	if s := sessions[0]; s.ClientId != ctl.Id() || !s.Mux || !reflect.DeepEqual(s.Tunnels, []string{url}) {
+		t.Errorf("Listed session %+v, expected %s with mux and tunnel %s", s, ctl.Id(), url)
+	}
+
+	if w := testAdminCall(a.sessions, "POST", "/api/sessions", ""); w.Code != 405 {
+		t.Errorf("POST /api/sessions answered %d, expected 405", w.Code)
+	}
+
+	w = testAdminCall(a.session, "GET", "/api/sessions/"+ctl.Id(), "")
+	var session adminSession
+	if err := json.Unmarshal(w.Body.Bytes(), &session); err != nil {
+		t.Fatalf("Failed to decode %q: %v", w.Body.String(), err)
+	}
+	if session.ClientId != ctl.Id() || !reflect.DeepEqual(session.Tunnels, []string{url}) {
+		t.Errorf("Showed session %+v, expected %s with tunnel %s", session, ctl.Id(), url)
+	}
+
+	if w := testAdminCall(a.session, "GET", "/api/sessions/unknown", ""); w.Code != 404 {
+		t.Errorf("Unknown session answered %d, expected 404", w.Code)
+	}
+	if w := testAdminCall(a.session, "PUT", "/api/sessions/"+ctl.Id(), ""); w.Code != 405 {
+		t.Errorf("PUT on a session answered %d, expected 405", w.Code)
+	}
+
+	// closing the session closes its tunnels too
+	if w := testAdminCall(a.session, "DELETE", "/api/sessions/"+ctl.Id(), ""); w.Code != 204 {
+		t.Fatalf("DELETE on a session answered %d, expected 204", w.Code)
+	}
+	ctl.shutdown.WaitComplete()
+
+	if controlRegistry.Get(ctl.Id()) != nil {
+		t.Errorf("Closed session is still registered")
+	}
+	if tunnelRegistry.Get(url) != nil {
+		t.Errorf("Tunnel %s of the closed session is still registered", url)
+	}
+}
+
+func TestAdminTunnels(t *testing.T) {
+	testControlGlobals(t)
+	a := testAdminServer()
+
+	client, _, ctl := testSession(t, false)
+	url := testSessionTunnel(t, client, &msg.ReqTunnel{Protocol: "http", Subdomain: "foo"})
+
+	w := testAdminCall(a.tunnels, "GET", "/api/tunnels", "")
+	var tunnels []adminTunnel
+	if err := json.Unmarshal(w.Body.Bytes(), &tunnels); err != nil {
+		t.Fatalf("Failed to decode %q: %v", w.Body.String(), err)
+	}
+	if len(tunnels) != 1 || tunnels[0].Url != url || tunnels[0].Protocol != "http" || tunnels[0].ClientId != ctl.Id() {
+		t.Fatalf("Listed tunnels %+v, expected only %s of %s", tunnels, url, ctl.Id())
+	}
+
+	if w := testAdminCall(a.tunnels, "DELETE", "/api/tunnels?url=http://bar.ngrok.test", ""); w.Code != 404 {
+		t.Errorf("DELETE of an unknown tunnel answered %d, expected 404", w.Code)
+	}
+	if w := testAdminCall(a.tunnels, "PUT", "/api/tunnels", ""); w.Code != 405 {
+		t.Errorf("PUT /api/tunnels answered %d, expected 405", w.Code)
+	}
+
+	// the client is told about the closed tunnel and its session stays up
+	if w := testAdminCall(a.tunnels, "DELETE", "/api/tunnels?url="+url, ""); w.Code != 204 {
+		t.Fatalf("DELETE of %s answered %d, expected 204", url, w.Code)
+	}
+	m, ok := testReadMsg(t, client).(*msg.TunnelClosed)
+	if !ok || m.Url != url || m.Error != "" {
+		t.Fatalf("Client got %+v, expected TunnelClosed for %s", m, url)
+	}
+	if tunnelRegistry.Get(url) != nil {
+		t.Errorf("Closed tunnel %s is still registered", url)
+	}
+	if controlRegistry.Get(ctl.Id()) == nil {
+		t.Errorf("Closing a tunnel closed its session")
+	}
+}
+
+func TestAdminReservations(t *testing.T) {
+	testControlGlobals(t)
+	a := testAdminServer()
+
+	if w := testAdminCall(a.reservations, "GET", "/api/reservations", ""); w.Code != 404 {
+		t.Errorf("Reservations without a store answered %d, expected 404", w.Code)
+	}
+
+	store, err := OpenReservationStore(filepath.Join(t.TempDir(), "reservations.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	tunnelRegistry = NewTunnelRegistry(16, "", store)
+
+	for _, c := range []struct {
+		body string
+		code int
+	}{
+		{`{"Url": "http://FOO.ngrok.test", "User": "alice"}`, 200},
+		{`{"Url": "http://foo.ngrok.test/path", "User": "alice"}`, 400},
+		{`{"User": "alice"}`, 400},
+		{`{"Url": `, 400},
+	} {
+		if w := testAdminCall(a.reservations, "POST", "/api/reservations", c.body); w.Code != c.code {
+			t.Errorf("POST %s answered %d, expected %d: %s", c.body, w.Code, c.code, w.Body.String())
+		}
+	}
+
+	w := testAdminCall(a.reservations, "GET", "/api/reservations", "")
+	var reservations []Reservation
+	if err := json.Unmarshal(w.Body.Bytes(), &reservations); err != nil {
+		t.Fatalf("Failed to decode %q: %v", w.Body.String(), err)
+	}
+	if len(reservations) != 1 || reservations[0].Url != "http://foo.ngrok.test" || reservations[0].User != "alice" {
+		t.Fatalf("Listed reservations %+v, expected http://foo.ngrok.test for alice", reservations)
+	}
+
+	if w := testAdminCall(a.reservations, "DELETE", "/api/reservations?url=HTTP://foo.ngrok.test", ""); w.Code != 204 {
+		t.Errorf("DELETE answered %d, expected 204: %s", w.Code, w.Body.String())
+	}
+	if w := testAdminCall(a.reservations, "DELETE", "/api/reservations?url=http://foo.ngrok.test", ""); w.Code != 404 {
+		t.Errorf("Second DELETE answered %d, expected 404", w.Code)
+	}
+	if w := testAdminCall(a.reservations, "PUT", "/api/reservations", ""); w.Code != 405 {
+		t.Errorf("PUT /api/reservations answered %d, expected 405", w.Code)
+	}
+}
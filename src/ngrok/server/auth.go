@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v1"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"ngrok/log"
+	"ngrok/msg"
+	"sync"
+	"time"
+)
+
+const (
+	webhookTimeout = 10 * time.Second
+)
+
+// Account is the identity a control connection is attributed to once it
+// has authenticated, along with any limits placed on it.
+type Account struct {
+	// name of the user, used for logging and authorization decisions
+	User string `yaml:"user"`
+
+	// maximum number of tunnels the user may have open at once, 0 means unlimited
+	MaxTunnels int `yaml:"max_tunnels,omitempty"`
+
+	// bytes a second all of the user's tunnels together, and each one of
+	// them, may carry in each direction. 0 means the server's default.
+	Rate        int64 `yaml:"rate,omitempty"`
+	Burst       int64 `yaml:"burst,omitempty"`
+	TunnelRate  int64 `yaml:"tunnel_rate,omitempty"`
+	TunnelBurst int64 `yaml:"tunnel_burst,omitempty"`
+}
+
+// An Authenticator decides whether a client may open a control connection.
+// It is consulted before the AuthResp is sent. A non-nil error rejects the
+// client and its message is sent back to it in AuthResp.Error.
+type Authenticator interface {
+	Authenticate(auth *msg.Auth, remoteAddr net.Addr) (*Account, error)
+}
+
+func NewAuthenticator(opts *Options) (Authenticator, error) {
+	switch {
+	case opts.authTokens != "" && opts.authWebhook != "":
+		return nil, fmt.Errorf("Only one of -authTokens and -authWebhook may be specified")
+	case opts.authTokens != "":
+		return NewTokenFileAuthenticator(opts.authTokens)
+	case opts.authWebhook != "":
+		return NewWebhookAuthenticator(opts.authWebhook), nil
+	default:
+		log.Info("No authentication backend specified, accepting all clients")
+		return new(OpenAuthenticator), nil
+	}
+}
+
+// OpenAuthenticator accepts every client. This is the behavior when no
+// authentication backend is configured.
+type OpenAuthenticator struct{}
+
+func (a *OpenAuthenticator) Authenticate(auth *msg.Auth, remoteAddr net.Addr) (*Account, error) {
+	return new(Account), nil
+}
+
+// TokenFileAuthenticator accepts clients whose auth token is listed in a YAML
+// file which maps each token to an account:
+//
+//	5f2a9c4e1b:
+//	  user: alice
+//	  max_tunnels: 4
+//	  rate: 1048576
+//
+// The file is re-read on Reload().
+type TokenFileAuthenticator struct {
+	log.Logger
+	sync.RWMutex
+	path   string
+	tokens map[string]*Account
+}
+
+func NewTokenFileAuthenticator(path string) (*TokenFileAuthenticator, error) {
+	a := &TokenFileAuthenticator{
+		Logger: log.NewPrefixLogger("auth", "tokens"),
+		path:   path,
+	}
+
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *TokenFileAuthenticator) Reload() error {
+	buf, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return fmt.Errorf("Failed to read auth token file %s: %v", a.path, err)
+	}
+
+	tokens := make(map[string]*Account)
+	if err = yaml.Unmarshal(buf, &tokens); err != nil {
+		return fmt.Errorf("Error parsing auth token file %s: %v", a.path, err)
+	}
+
+	for token, account := range tokens {
+		if account == nil || account.User == "" {
+			return fmt.Errorf("Auth token file %s: token %s does not specify a user", a.path, token)
+		}
+	}
+
+	a.Lock()
+	a.tokens = tokens
+	a.Unlock()
+
+	a.Info("Loaded %d auth tokens from %s", len(tokens), a.path)
+	return nil
+}
+
+func (a *TokenFileAuthenticator) Authenticate(auth *msg.Auth, remoteAddr net.Addr) (*Account, error) {
+	if auth.User == "" {
+		return nil, fmt.Errorf("This server requires an auth token. Specify one with -authtoken or auth_token in your config file.")
+	}
+
+	a.RLock()
+	account, ok := a.tokens[auth.User]
+	a.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("The auth token you specified is not valid for this server.")
+	}
+
+	// return a copy so that a reload doesn't change the limits of live sessions
+	acct := *account
+	return &acct, nil
+}
+
+// WebhookAuthenticator asks an HTTP endpoint whether to accept each client.
+// It POSTs a JSON webhookRequest to the url and expects a 200 response with a
+// JSON webhookResponse body.
+type WebhookAuthenticator struct {
+	log.Logger
+	url    string
+	client http.Client
+}
+
+type webhookRequest struct {
+	User       string
+	Password   string
+	ClientId   string
+	OS         string
+	Arch       string
+	Version    string
+	RemoteAddr string
+}
+
+type webhookResponse struct {
+	Allow bool
+	Error string
+	Account
+}
+
+func NewWebhookAuthenticator(url string) *WebhookAuthenticator {
+	return &WebhookAuthenticator{
+		Logger: log.NewPrefixLogger("auth", "webhook"),
+		url:    url,
+		client: http.Client{Timeout: webhookTimeout},
+	}
+}
+
+func (a *WebhookAuthenticator) Authenticate(auth *msg.Auth, remoteAddr net.Addr) (*Account, error) {
+	payload, err := json.Marshal(&webhookRequest{
+		User:       auth.User,
+		Password:   auth.Password,
+		ClientId:   auth.ClientId,
+		OS:         auth.OS,
+		Arch:       auth.Arch,
+		Version:    auth.MmVersion,
+		RemoteAddr: remoteAddr.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		a.Error("Request to %s failed: %v", a.url, err)
+		return nil, fmt.Errorf("Authentication is temporarily unavailable, please try again later.")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		a.Error("Got %v response from %s: %s", resp.StatusCode, a.url, body)
+		return nil, fmt.Errorf("Authentication is temporarily unavailable, please try again later.")
+	}
+
+	var result webhookResponse
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		a.Error("Failed to parse response from %s: %v", a.url, err)
+		return nil, fmt.Errorf("Authentication is temporarily unavailable, please try again later.")
+	}
+
+	if !result.Allow {
+		if result.Error == "" {
+			result.Error = "The auth token you specified is not valid for this server."
+		}
+		return nil, fmt.Errorf("%s", result.Error)
+	}
+
+	return &result.Account, nil
+}
@@ -2,20 +2,67 @@ package server
 
 import (
 	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
 )
 
+const usage = `Usage: %s [OPTIONS] [command]
+
+Commands:
+	ngrokd                                      Run the server
+	ngrokd reservations list                    List reservations in the -reservations store
+	ngrokd reservations add <url> <user>        Reserve a tunnel url to a user
+	ngrokd reservations revoke <url>            Remove the reservation of a tunnel url
+
+Options:
+`
+
 type Options struct {
-	httpAddr   string
-	httpsAddr  string
-	tunnelAddr string
-	domain     string
-	tlsCrt     string
-	tlsKey     string
-	logto      string
-	loglevel   string
+	config              string
+	httpAddr            string
+	httpsAddr           string
+	tunnelAddr          string
+	domain              string
+	tlsCrt              string
+	tlsKey              string
+	logto               string
+	loglevel            string
+	authTokens          string
+	authWebhook         string
+	policy              string
+	adminAddr           string
+	prometheusAddr      string
+	mux                 bool
+	acmeDirectory       string
+	acmeEmail           string
+	acmeCache           string
+	acmeCA              string
+	reservations        string
+	metrics             string
+	maxTunnels          int
+	maxTunnelsPerClient int
+	tunnelRate          int64
+	tunnelBurst         int64
+	userRate            int64
+	userBurst           int64
+	drainTimeout        time.Duration
+	clusterAddr         string
+	clusterRegistry     string
+	clusterSecret       string
+	oidcIssuers         []string
+	args                []string
+
+	// only set by the configuration file or the environment
+	vhost             string
+	registryCacheFile string
+	keenApiKey        string
+	keenProjectToken  string
 }
 
 func parseArgs() *Options {
+	config := flag.String("config", "", "Path to a YAML configuration file, flags override the settings in it")
 	httpAddr := flag.String("httpAddr", ":80", "Public address for HTTP connections, empty string to disable")
 	httpsAddr := flag.String("httpsAddr", ":443", "Public address listening for HTTPS connections, emptry string to disable")
 	tunnelAddr := flag.String("tunnelAddr", ":4443", "Public address listening for ngrok client")
@@ -24,16 +71,79 @@ func parseArgs() *Options {
 	tlsKey := flag.String("tlsKey", "", "Path to a TLS key file")
 	logto := flag.String("log", "stdout", "Write log messages to this file. 'stdout' and 'none' have special meanings")
 	loglevel := flag.String("log-level", "DEBUG", "The level of messages to log. One of: DEBUG, INFO, WARNING, ERROR")
+	authTokens := flag.String("authTokens", "", "Path to a YAML file of auth tokens allowed to connect, reloaded on SIGHUP")
+	authWebhook := flag.String("authWebhook", "", "URL of an HTTP endpoint which decides whether to allow clients to connect")
+	policy := flag.String("policy", "", "Path to a YAML file reserving hostnames, subdomains and TCP ports to users, reloaded on SIGHUP")
+	adminAddr := flag.String("adminAddr", "", "Address to serve the admin API on, empty string to disable")
+	prometheusAddr := flag.String("prometheusAddr", "", "Address to serve prometheus metrics on at /metrics, empty string to disable")
+	mux := flag.Bool("mux", true, "Allow clients to multiplex proxy connections over their control connection")
+	acmeDirectory := flag.String("acmeDirectory", "", "URL of an ACME directory to obtain certificates for https tunnels from, empty string to disable")
+	acmeEmail := flag.String("acmeEmail", "", "Contact email address for the ACME account")
+	acmeCache := flag.String("acmeCache", "", "Directory to cache ACME account keys and certificates in")
+	acmeCA := flag.String("acmeCA", "", "Path to a PEM file of CA certificates to trust for the ACME directory, for test servers")
+	reservations := flag.String("reservations", "", "Path to a file to durably store tunnel url reservations in, replaces REGISTRY_CACHE_FILE")
+	metrics := flag.String("metrics", "", "Metrics backend, one of: local, keen, prometheus. Chosen from -prometheusAddr and KEEN_API_KEY when empty")
+	maxTunnels := flag.Int("maxTunnels", 0, "Tunnels a named account may have open when its auth backend sets no limit, 0 for unlimited")
+	drainTimeout := flag.Duration("drainTimeout", 30*time.Second, "How long to let connections finish after SIGTERM before exiting")
+	clusterAddr := flag.String("clusterAddr", "", "Address other nodes of the cluster forward connections to this node on, like 10.0.0.1:4444")
+	clusterRegistry := flag.String("clusterRegistry", "", "Registry shared by the nodes of the cluster: 'memory' to run it in this node, or the -clusterAddr of the node which runs it. Empty string to disable clustering")
+	clusterSecret := flag.String("clusterSecret", "", "Secret shared by the nodes of the cluster to authenticate each other and calls to the registry, required for clustering")
+	maxTunnelsPerClient := flag.Int("maxTunnelsPerClient", 0, "Tunnels a single client connection may have open, 0 for unlimited")
+	tunnelRate := flag.Int64("tunnelRate", 0, "Bytes a second each tunnel may carry in each direction when its account sets no limit, 0 for unlimited")
+	tunnelBurst := flag.Int64("tunnelBurst", 0, "Bytes a tunnel may carry at once above -tunnelRate, 0 for as many as the rate")
+	userRate := flag.Int64("userRate", 0, "Bytes a second all of a user's tunnels together may carry in each direction when its account sets no limit, 0 for unlimited")
+	userBurst := flag.Int64("userBurst", 0, "Bytes a user's tunnels may carry at once above -userRate, 0 for as many as the rate")
+	oidcIssuers := flag.String("oidcIssuers", "", "Comma separated OpenID Connect issuer urls tunnels may require logins with, empty string to allow any https issuer")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	return &Options{
-		httpAddr:   *httpAddr,
-		httpsAddr:  *httpsAddr,
-		tunnelAddr: *tunnelAddr,
-		domain:     *domain,
-		tlsCrt:     *tlsCrt,
-		tlsKey:     *tlsKey,
-		logto:      *logto,
-		loglevel:   *loglevel,
+		config:              *config,
+		httpAddr:            *httpAddr,
+		httpsAddr:           *httpsAddr,
+		tunnelAddr:          *tunnelAddr,
+		domain:              *domain,
+		tlsCrt:              *tlsCrt,
+		tlsKey:              *tlsKey,
+		logto:               *logto,
+		loglevel:            *loglevel,
+		authTokens:          *authTokens,
+		authWebhook:         *authWebhook,
+		policy:              *policy,
+		adminAddr:           *adminAddr,
+		prometheusAddr:      *prometheusAddr,
+		mux:                 *mux,
+		acmeDirectory:       *acmeDirectory,
+		acmeEmail:           *acmeEmail,
+		acmeCache:           *acmeCache,
+		acmeCA:              *acmeCA,
+		reservations:        *reservations,
+		metrics:             *metrics,
+		maxTunnels:          *maxTunnels,
+		maxTunnelsPerClient: *maxTunnelsPerClient,
+		tunnelRate:          *tunnelRate,
+		tunnelBurst:         *tunnelBurst,
+		userRate:            *userRate,
+		userBurst:           *userBurst,
+		drainTimeout:        *drainTimeout,
+		clusterAddr:         *clusterAddr,
+		clusterRegistry:     *clusterRegistry,
+		clusterSecret:       *clusterSecret,
+		oidcIssuers:         splitList(*oidcIssuers),
+		args:                flag.Args(),
+	}
+}
+
+// Splits a comma separated flag, an empty string is an empty list
+func splitList(s string) (list []string) {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
 	}
+	return
 }
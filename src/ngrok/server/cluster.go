@@ -0,0 +1,713 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"ngrok/conn"
+	"ngrok/log"
+	"ngrok/msg"
+	"ngrok/util"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// how long a node's claim on a tunnel url lasts unless it's renewed,
+	// nodes renew their claims three times as often
+	clusterClaimTTL = 30 * time.Second
+
+	clusterRequestTimeout = 5 * time.Second
+
+	// how far the clock of a node calling the registry api may be off
+	// before its signed requests are rejected as replays. Nonces are
+	// remembered for twice as long, which covers every time accepted.
+	clusterRequestSkew = 30 * time.Second
+
+	// label of the keying material the cluster secret is bound to on
+	// connections between nodes
+	clusterExporterLabel = "EXPORTER-ngrok-cluster"
+)
+
+var cluster *Cluster
+
+// A ClusterRegistry records which ngrokd node each tunnel url lives on.
+// Nodes are identified by the address other nodes forward public
+// connections to. Claims expire unless they're renewed, so the urls
+// of a node which dies become available again.
+type ClusterRegistry interface {
+	// Claims url for node, fails if another node holds it
+	Claim(url, node string, ttl time.Duration) error
+
+	// Releases url if node holds it
+	Release(url, node string) error
+
+	// Returns the node url lives on, or "" if it isn't claimed
+	Lookup(url string) (string, error)
+}
+
+// The registry couldn't be reached at all, as opposed to refusing a claim
+type clusterUnavailableError struct {
+	err error
+}
+
+func (e *clusterUnavailableError) Error() string {
+	return fmt.Sprintf("Cluster registry unavailable: %v", e.err)
+}
+
+func NewClusterRegistry(spec, secret string) (ClusterRegistry, error) {
+	if spec == "memory" {
+		return NewMemoryClusterRegistry(), nil
+	}
+
+	if !isClusterNode(spec) {
+		return nil, fmt.Errorf("Unknown cluster registry %s, expected memory or the cluster address of the node which runs it", spec)
+	}
+	return NewPeerClusterRegistry(spec, secret), nil
+}
+
+// Whether addr is a host and port other nodes can connect to
+func isClusterNode(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || net.ParseIP(host).IsUnspecified() {
+		return false
+	}
+
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536
+}
+
+type clusterClaim struct {
+	Url     string
+	Node    string
+	Expires time.Time
+}
+
+// MemoryClusterRegistry keeps claims in the memory of the ngrokd process.
+// It's what a single node uses to test clustering with, and other nodes can
+// share it through the cluster listener of the node running it.
+type MemoryClusterRegistry struct {
+	sync.Mutex
+	claims map[string]*clusterClaim
+}
+
+func NewMemoryClusterRegistry() *MemoryClusterRegistry {
+	return &MemoryClusterRegistry{claims: make(map[string]*clusterClaim)}
+}
+
+func (r *MemoryClusterRegistry) live(url string) *clusterClaim {
+	claim := r.claims[url]
+	if claim != nil && time.Now().After(claim.Expires) {
+		delete(r.claims, url)
+		return nil
+	}
+	return claim
+}
+
+func (r *MemoryClusterRegistry) Claim(url, node string, ttl time.Duration) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if claim := r.live(url); claim != nil && claim.Node != node {
+		return fmt.Errorf("The tunnel %s is already registered on another server.", url)
+	}
+
+	r.claims[url] = &clusterClaim{Url: url, Node: node, Expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (r *MemoryClusterRegistry) Release(url, node string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if claim := r.live(url); claim != nil && claim.Node == node {
+		delete(r.claims, url)
+	}
+	return nil
+}
+
+func (r *MemoryClusterRegistry) Lookup(url string) (string, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if claim := r.live(url); claim != nil {
+		return claim.Node, nil
+	}
+	return "", nil
+}
+
+// Returns a snapshot of the live claims
+func (r *MemoryClusterRegistry) List() []*clusterClaim {
+	r.Lock()
+	defer r.Unlock()
+
+	claims := make([]*clusterClaim, 0, len(r.claims))
+	for url, _ := range r.claims {
+		if claim := r.live(url); claim != nil {
+			claims = append(claims, claim)
+		}
+	}
+	return claims
+}
+
+// Signs a call of the registry api with the cluster secret, over the
+// method, the query, the time of the call and a nonce which is only
+// accepted once
+func signClusterRequest(secret, method, query string, at int64, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s", method, query, at, nonce)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// The nonces of the registry calls a node accepted recently
+type clusterNonces struct {
+	sync.Mutex
+	seen map[string]time.Time
+}
+
+// Remembers nonce, returns false if it was already used
+func (n *clusterNonces) use(nonce string) bool {
+	n.Lock()
+	defer n.Unlock()
+
+	now := time.Now()
+	if n.seen == nil {
+		n.seen = make(map[string]time.Time)
+	}
+	for k, at := range n.seen {
+		if now.Sub(at) > 2*clusterRequestSkew {
+			delete(n.seen, k)
+		}
+	}
+
+	if _, ok := n.seen[nonce]; ok {
+		return false
+	}
+	n.seen[nonce] = now
+	return true
+}
+
+// Checks the signature of a call of the registry api
+func (c *Cluster) verifyRequest(r *http.Request) error {
+	at, err := strconv.ParseInt(r.Header.Get("X-Ngrok-Cluster-Time"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Missing request time")
+	}
+
+	if skew := time.Since(time.Unix(at, 0)); skew > clusterRequestSkew || skew < -clusterRequestSkew {
+		return fmt.Errorf("Request time is off by %v", skew)
+	}
+
+	nonce := r.Header.Get("X-Ngrok-Cluster-Nonce")
+	if nonce == "" {
+		return fmt.Errorf("Missing nonce")
+	}
+
+	expected := signClusterRequest(c.secret, r.Method, r.URL.RawQuery, at, nonce)
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Ngrok-Cluster-Signature"))) {
+		return fmt.Errorf("Bad signature")
+	}
+
+	// only checked once the signature is, so that nobody else can use up nonces
+	if !c.nonces.use(nonce) {
+		return fmt.Errorf("Replayed request")
+	}
+	return nil
+}
+
+// PeerClusterRegistry uses the registry of another node over connections
+// to its cluster listener, which are authenticated like forwarded ones.
+// Calls are signed with the cluster secret as well, which isn't sent itself.
+type PeerClusterRegistry struct {
+	endpoint string
+	secret   string
+	client   http.Client
+}
+
+func NewPeerClusterRegistry(node, secret string) *PeerClusterRegistry {
+	r := &PeerClusterRegistry{
+		endpoint: "http://" + node + "/api/cluster/tunnels",
+		secret:   secret,
+	}
+
+	r.client = http.Client{
+		Timeout: clusterRequestTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialPeer(node, secret, "registry", "")
+			},
+
+			// the node closes idle connections after clusterClaimTTL
+			IdleConnTimeout: clusterClaimTTL / 2,
+		},
+	}
+	return r
+}
+
+// Makes a signed call of the registry api
+func (r *PeerClusterRegistry) newRequest(method string, params url.Values) (*http.Request, error) {
+	query := params.Encode()
+	req, err := http.NewRequest(method, r.endpoint+"?"+query, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	at, nonce := time.Now().Unix(), util.RandId(16)
+	req.Header.Set("X-Ngrok-Cluster-Time", strconv.FormatInt(at, 10))
+	req.Header.Set("X-Ngrok-Cluster-Nonce", nonce)
+	req.Header.Set("X-Ngrok-Cluster-Signature", signClusterRequest(r.secret, method, query, at, nonce))
+	return req, nil
+}
+
+func (r *PeerClusterRegistry) do(method string, params url.Values) (*http.Response, error) {
+	req, err := r.newRequest(method, params)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, &clusterUnavailableError{err}
+	}
+
+	if resp.StatusCode >= 500 {
+		resp.Body.Close()
+		return nil, &clusterUnavailableError{fmt.Errorf("%s", resp.Status)}
+	}
+	return resp, nil
+}
+
+func (r *PeerClusterRegistry) Claim(tunnelUrl, node string, ttl time.Duration) error {
+	resp, err := r.do("PUT", url.Values{
+		"url":  {tunnelUrl},
+		"node": {node},
+		"ttl":  {fmt.Sprintf("%d", int(ttl.Seconds()))},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 204 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s", strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (r *PeerClusterRegistry) Release(tunnelUrl, node string) error {
+	resp, err := r.do("DELETE", url.Values{"url": {tunnelUrl}, "node": {node}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 204 {
+		return fmt.Errorf("Cluster registry release failed: %s", resp.Status)
+	}
+	return nil
+}
+
+func (r *PeerClusterRegistry) Lookup(tunnelUrl string) (string, error) {
+	resp, err := r.do("GET", url.Values{"url": {tunnelUrl}})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+		var claim clusterClaim
+		if err = json.NewDecoder(resp.Body).Decode(&claim); err != nil {
+			return "", err
+		}
+		return claim.Node, nil
+	case 404:
+		return "", nil
+	default:
+		return "", fmt.Errorf("Cluster registry lookup failed: %s", resp.Status)
+	}
+}
+
+// The first message on a connection one node forwards to another. The
+// forwarding node proves that it knows the cluster secret with Mac, which
+// is bound to the TLS session between the nodes so that it can't be
+// replayed on another connection.
+type peerForward struct {
+	Mac        string
+	Proto      string // http, https before TLS is terminated, or registry for calls of the registry api
+	ClientAddr string
+}
+
+// The answer of the node a connection was forwarded to, proving that it
+// knows the cluster secret too before the connection is handed to it
+type peerAccept struct {
+	Mac string
+}
+
+// A connection between nodes, which always runs over TLS
+type peerConn interface {
+	conn.Conn
+	ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error)
+}
+
+// Cluster connects this node to the others sharing its registry. Tunnel urls
+// are claimed in the registry when they're registered, and public connections
+// for tunnels whose control connection lives on another node are forwarded
+// to it still unparsed, so that node handles them like its own. Only
+// connections to the http and https listeners are forwarded, tcp and udp
+// tunnels are only reachable on the node their client is connected to.
+type Cluster struct {
+	log.Logger
+	node      string
+	secret    string
+	registry  ClusterRegistry
+	listener  *conn.Listener
+	tlsConfig *tls.Config
+	leaving   int32
+	nonces    clusterNonces
+}
+
+func NewCluster(opts *Options, tlsConfig *tls.Config) (*Cluster, error) {
+	registry, err := NewClusterRegistry(opts.clusterRegistry, opts.clusterSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cluster{
+		Logger:    log.NewPrefixLogger("cluster"),
+		node:      opts.clusterAddr,
+		secret:    opts.clusterSecret,
+		registry:  registry,
+		tlsConfig: tlsConfig,
+	}
+
+	// connections between nodes are encrypted with the server's own
+	// certificate, public connections are only negotiated on inside
+	peerConfig := tlsConfig.Clone()
+	peerConfig.NextProtos = nil
+	if c.listener, err = conn.Listen(opts.clusterAddr, "peer", peerConfig); err != nil {
+		return nil, err
+	}
+
+	c.Info("Listening for connections forwarded by other nodes on %s", c.node)
+	go c.listen()
+	go c.renew()
+	return c, nil
+}
+
+// Authenticates one end of a connection between nodes: a MAC of the
+// keying material of its TLS session under the cluster secret
+func peerMac(secret string, pc peerConn, role string) (string, error) {
+	ekm, err := pc.ExportKeyingMaterial(clusterExporterLabel, nil, 32)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(role))
+	mac.Write(ekm)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Claims a tunnel url for this node. If the registry can't be reached the
+// url is registered on this node alone, so that losing the registry only
+// stops other nodes from finding new tunnels instead of stopping them from
+// being opened at all. The url is claimed once the registry is back.
+func (c *Cluster) Claim(url string) error {
+	err := c.registry.Claim(url, c.node, clusterClaimTTL)
+	if _, ok := err.(*clusterUnavailableError); ok {
+		c.Warn("Registering %s on this node only: %v", url, err)
+		return nil
+	}
+	return err
+}
+
+func (c *Cluster) Release(url string) {
+	if err := c.registry.Release(url, c.node); err != nil {
+		c.Warn("Failed to release %s: %v", url, err)
+	}
+}
+
+// Renews the claims on this node's tunnels before they expire
+func (c *Cluster) renew() {
+	for {
+		time.Sleep(clusterClaimTTL / 3)
+		if atomic.LoadInt32(&c.leaving) == 1 {
+			return
+		}
+
+		for _, t := range tunnelRegistry.All() {
+			if err := c.Claim(t.url); err != nil {
+				t.Warn("Failed to renew cluster claim: %v", err)
+			}
+		}
+	}
+}
+
+// Stops accepting forwarded connections and releases every tunnel url
+// so that clients can register them on other nodes right away
+func (c *Cluster) Leave() {
+	if !atomic.CompareAndSwapInt32(&c.leaving, 0, 1) {
+		return
+	}
+
+	c.listener.Close()
+	for _, t := range tunnelRegistry.All() {
+		c.Release(t.url)
+	}
+}
+
+// Forwards a public connection to the node of the first of the urls which
+// lives on another node. Returns false if none do. proto tells the other
+// node how to handle the connection.
+func (c *Cluster) Forward(pc conn.Conn, proto string, urls ...string) bool {
+	var node string
+	for _, url := range urls {
+		n, err := c.registry.Lookup(url)
+		if err != nil {
+			pc.Warn("Failed to look up %s in the cluster: %v", url, err)
+			return false
+		}
+
+		if n != "" {
+			node = n
+			break
+		}
+	}
+
+	if node == "" || node == c.node {
+		return false
+	}
+
+	peer, err := dialPeer(node, c.secret, proto, pc.RemoteAddr().String())
+	if err != nil {
+		pc.Warn("Failed to forward connection to node %s: %v", node, err)
+		return false
+	}
+	defer peer.Close()
+
+	pc.Info("Forwarding connection to node %s", node)
+	pc.SetDeadline(time.Time{})
+	conn.Join(pc, peer)
+	return true
+}
+
+// Connects to another node and tells it what the connection is for,
+// checking that it knows the cluster secret
+func dialPeer(node, secret, proto, clientAddr string) (conn.Conn, error) {
+	// nodes are addressed by ip and don't have certificates for it, the
+	// other node is authenticated by the cluster secret instead
+	peer, err := conn.Dial(node, "peer", &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = handshake(peer, secret, proto, clientAddr); err != nil {
+		peer.Close()
+		return nil, err
+	}
+	return peer, nil
+}
+
+// Tells the node at the other end of peer about a forwarded connection and
+// checks that it knows the cluster secret
+func handshake(peer peerConn, secret, proto, clientAddr string) error {
+	peer.SetDeadline(time.Now().Add(connReadTimeout))
+	defer peer.SetDeadline(time.Time{})
+
+	mac, err := peerMac(secret, peer, "forward")
+	if err != nil {
+		return err
+	}
+
+	if err = msg.WriteMsg(peer, &peerForward{Mac: mac, Proto: proto, ClientAddr: clientAddr}); err != nil {
+		return err
+	}
+
+	var accept peerAccept
+	if err = msg.ReadMsgInto(peer, &accept); err != nil {
+		return err
+	}
+
+	if expected, _ := peerMac(secret, peer, "accept"); !hmac.Equal([]byte(expected), []byte(accept.Mac)) {
+		return fmt.Errorf("The node doesn't know the cluster secret")
+	}
+	return nil
+}
+
+func (c *Cluster) listen() {
+	for pc := range c.listener.Conns {
+		go c.handlePeer(pc)
+	}
+}
+
+// Handles a connection forwarded by another node as if it were a public
+// connection, coming from the address of the public client
+func (c *Cluster) handlePeer(pc peerConn) {
+	defer func() {
+		if r := recover(); r != nil {
+			pc.Warn("handlePeer failed with error %v", r)
+			pc.Close()
+		}
+	}()
+
+	pc.SetReadDeadline(time.Now().Add(connReadTimeout))
+
+	var fwd peerForward
+	if err := msg.ReadMsgInto(pc, &fwd); err != nil {
+		pc.Warn("Failed to read forwarded connection: %v", err)
+		pc.Close()
+		return
+	}
+
+	if expected, err := peerMac(c.secret, pc, "forward"); err != nil || !hmac.Equal([]byte(expected), []byte(fwd.Mac)) {
+		pc.Warn("Rejected forwarded connection with the wrong cluster secret")
+		pc.Close()
+		return
+	}
+
+	mac, err := peerMac(c.secret, pc, "accept")
+	if err == nil {
+		err = msg.WriteMsg(pc, &peerAccept{Mac: mac})
+	}
+	if err != nil {
+		pc.Warn("Failed to accept forwarded connection: %v", err)
+		pc.Close()
+		return
+	}
+	pc.SetReadDeadline(time.Time{})
+
+	if fwd.Proto == "registry" {
+		c.serveRegistry(pc)
+		return
+	}
+
+	clientAddr, err := net.ResolveTCPAddr("tcp", fwd.ClientAddr)
+	if err != nil {
+		pc.Warn("Invalid client address %s: %v", fwd.ClientAddr, err)
+		pc.Close()
+		return
+	}
+
+	wrapped := conn.Wrap(pc, "pub")
+	wrapped.SetRemoteAddr(clientAddr)
+	wrapped.Debug("Connection from %v forwarded by another node", clientAddr)
+
+	switch fwd.Proto {
+	case "http":
+		httpHandler(wrapped, "http")
+	case "https":
+		httpsHandler(wrapped, c.tlsConfig)
+	default:
+		wrapped.Warn("Can't handle forwarded %s connection", fwd.Proto)
+		wrapped.Close()
+	}
+}
+
+// Serves calls of the registry api from another node on pc until it's
+// idle for longer than a claim lasts
+func (c *Cluster) serveRegistry(pc conn.Conn) {
+	defer pc.Close()
+
+	br := bufio.NewReader(pc)
+	for {
+		pc.SetReadDeadline(time.Now().Add(clusterClaimTTL))
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			pc.Debug("Stopped serving registry calls: %v", err)
+			return
+		}
+		req.RemoteAddr = pc.RemoteAddr().String()
+
+		w := &bufferedResponse{header: make(http.Header), status: 200}
+		c.registryCall(w, req)
+		req.Body.Close()
+
+		resp := &http.Response{
+			StatusCode:    w.status,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Request:       req,
+			Header:        w.header,
+			Body:          ioutil.NopCloser(bytes.NewReader(w.body.Bytes())),
+			ContentLength: int64(w.body.Len()),
+			Close:         req.Close,
+		}
+		if err = resp.Write(pc); err != nil || req.Close {
+			return
+		}
+	}
+}
+
+// Answers a call of the registry api:
+//
+//	GET    /api/cluster/tunnels?url=<url>                             look up the node a url lives on
+//	PUT    /api/cluster/tunnels?url=<url>&node=<node>&ttl=<seconds>  claim a url for a node
+//	DELETE /api/cluster/tunnels?url=<url>&node=<node>                release a node's claim
+func (c *Cluster) registryCall(w http.ResponseWriter, r *http.Request) {
+	registry, ok := c.registry.(*MemoryClusterRegistry)
+	if !ok {
+		http.Error(w, "This node doesn't run the cluster registry, run ngrokd with -clusterRegistry=memory", 404)
+		return
+	}
+
+	if r.URL.Path != "/api/cluster/tunnels" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := c.verifyRequest(r); err != nil {
+		c.Warn("Rejected cluster registry call from %s: %v", r.RemoteAddr, err)
+		http.Error(w, http.StatusText(401), 401)
+		return
+	}
+
+	q := r.URL.Query()
+	url, node := q.Get("url"), q.Get("node")
+
+	switch r.Method {
+	case "GET":
+		if node, _ = registry.Lookup(url); node == "" {
+			http.Error(w, "No node has claimed "+url, 404)
+			return
+		}
+
+		buf, _ := json.Marshal(&clusterClaim{Url: url, Node: node})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(buf)
+
+	case "PUT":
+		ttl, err := strconv.Atoi(q.Get("ttl"))
+		if err != nil || url == "" || node == "" {
+			http.Error(w, "A url, node and ttl are required", 400)
+			return
+		}
+
+		if err = registry.Claim(url, node, time.Duration(ttl)*time.Second); err != nil {
+			http.Error(w, err.Error(), 409)
+			return
+		}
+		w.WriteHeader(204)
+
+	case "DELETE":
+		registry.Release(url, node)
+		w.WriteHeader(204)
+
+	default:
+		http.Error(w, http.StatusText(405), 405)
+	}
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"ngrok/conn"
+	"ngrok/log"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a self-signed certificate for ngrok.test
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ngrok.test"},
+		DNSNames:     []string{"ngrok.test", "*.ngrok.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// Starts a node running the memory registry, which serves it to the
+// other nodes on its cluster listener
+func testRegistryNode(t *testing.T, secret string) *Cluster {
+	tunnelRegistry = NewTunnelRegistry(16, "", nil)
+	node, err := NewCluster(&Options{
+		clusterAddr:     "127.0.0.1:0",
+		clusterRegistry: "memory",
+		clusterSecret:   secret,
+	}, testTLSConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.node = node.listener.Addr.String()
+
+	cluster = node
+	t.Cleanup(func() {
+		node.Leave()
+		cluster = nil
+	})
+	return node
+}
+
+func TestPeerClusterRegistry(t *testing.T) {
+	node := testRegistryNode(t, "s3cret")
+
+	b := NewPeerClusterRegistry(node.node, "s3cret")
+	c := NewPeerClusterRegistry(node.node, "s3cret")
+
+	if err := b.Claim("http://foo.ngrok.test", "b", time.Minute); err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+
+	if node, err := c.Lookup("http://foo.ngrok.test"); err != nil || node != "b" {
+		t.Fatalf("Lookup found %q, %v, expected b", node, err)
+	}
+
+	err := c.Claim("http://foo.ngrok.test", "c", time.Minute)
+	if err == nil {
+		t.Fatalf("Another node claimed a url which is already claimed")
+	}
+	if _, ok := err.(*clusterUnavailableError); ok {
+		t.Fatalf("A refused claim was taken for an unavailable registry")
+	}
+
+	// only the node holding the claim can release it
+	c.Release("http://foo.ngrok.test", "c")
+	if node, _ := c.Lookup("http://foo.ngrok.test"); node != "b" {
+		t.Fatalf("Another node released the claim")
+	}
+
+	if err = b.Release("http://foo.ngrok.test", "b"); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if node, err := c.Lookup("http://foo.ngrok.test"); err != nil || node != "" {
+		t.Fatalf("Released url is still claimed by %q, %v", node, err)
+	}
+
+	// nodes without the secret can't even connect
+	wrong := NewPeerClusterRegistry(node.node, "wrong")
+	if err = wrong.Claim("http://bar.ngrok.test", "x", time.Minute); err == nil {
+		t.Errorf("Claim with the wrong secret succeeded")
+	}
+	if _, err = wrong.Lookup("http://foo.ngrok.test"); err == nil {
+		t.Errorf("Lookup with the wrong secret succeeded")
+	}
+
+	// the registry isn't served on the admin api anymore
+	admin := &AdminServer{Logger: log.NewPrefixLogger("admin")}
+	w := httptest.NewRecorder()
+	admin.clusterTunnels(w, httptest.NewRequest("PUT", "/api/cluster/tunnels?url=http://bar.ngrok.test&node=x&ttl=60", nil))
+	if w.Code != 405 {
+		t.Errorf("Claim through the admin api was answered with %d, expected 405", w.Code)
+	}
+}
+
+func TestPeerClusterRegistrySignatures(t *testing.T) {
+	node := testRegistryNode(t, "s3cret")
+	r := NewPeerClusterRegistry(node.node, "s3cret")
+
+	call := func(req *http.Request) int {
+		resp, err := r.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// unsigned calls are turned away even on an authenticated connection
+	unsigned, _ := http.NewRequest("GET", r.endpoint+"?url=http://foo.ngrok.test", nil)
+	if status := call(unsigned); status != 401 {
+		t.Errorf("Unsigned call was answered with %d, expected 401", status)
+	}
+
+	// signed calls can't be replayed, neither right away nor later on
+	req, _ := r.newRequest("GET", url.Values{"url": {"http://foo.ngrok.test"}})
+	if status := call(req); status != 404 {
+		t.Fatalf("Signed call was answered with %d, expected 404", status)
+	}
+	replay, _ := http.NewRequest("GET", req.URL.String(), nil)
+	replay.Header = req.Header
+	if status := call(replay); status != 401 {
+		t.Errorf("Replayed call was answered with %d, expected 401", status)
+	}
+
+	at := time.Now().Add(-2 * clusterRequestSkew).Unix()
+	stale, _ := http.NewRequest("GET", r.endpoint, nil)
+	stale.Header.Set("X-Ngrok-Cluster-Time", strconv.FormatInt(at, 10))
+	stale.Header.Set("X-Ngrok-Cluster-Nonce", "stale")
+	stale.Header.Set("X-Ngrok-Cluster-Signature", signClusterRequest("s3cret", "GET", "", at, "stale"))
+	if status := call(stale); status != 401 {
+		t.Errorf("Stale call was answered with %d, expected 401", status)
+	}
+}
+
+func TestClusterClaimFailsOpen(t *testing.T) {
+	node := testRegistryNode(t, "s3cret")
+	c := &Cluster{Logger: log.NewPrefixLogger("cluster"), node: "b", secret: "s3cret", registry: NewPeerClusterRegistry(node.node, "s3cret")}
+
+	// another node's url is still refused
+	node.registry.Claim("http://foo.ngrok.test", "a", time.Minute)
+	if err := c.Claim("http://foo.ngrok.test"); err == nil {
+		t.Fatalf("Claim of another node's url succeeded")
+	}
+
+	// while the registry is down urls are registered locally
+	node.Leave()
+	c.registry = NewPeerClusterRegistry(node.node, "s3cret")
+	if err := c.Claim("http://bar.ngrok.test"); err != nil {
+		t.Fatalf("Claim failed while the registry was down: %v", err)
+	}
+}
+
+// Forwards a public http request from a node without the tunnel to the
+// node which claimed it, over a real localhost connection between them
+func forwardRequest(t *testing.T, from *Cluster, host string) (bool, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	public, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forwarded := make(chan bool, 1)
+	go func() {
+		pc := conn.Wrap(public, "pub")
+		ok := from.Forward(pc, "http", "http://"+host)
+		pc.Close()
+		forwarded <- ok
+	}()
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+	status, _ := bufio.NewReader(client).ReadString('\n')
+	return <-forwarded, status
+}
+
+func TestClusterForward(t *testing.T) {
+	// the node holding the tunnel, it answers with a 404 since no
+	// client is connected to it in the test
+	a := testRegistryNode(t, "s3cret")
+	if err := a.registry.Claim("http://foo.ngrok.test", a.node, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// the node the public connection arrives at
+	b := &Cluster{Logger: log.NewPrefixLogger("cluster"), node: "127.0.0.1:2", secret: "s3cret", registry: a.registry}
+	ok, status := forwardRequest(t, b, "foo.ngrok.test")
+	if !ok || !strings.Contains(status, "404") {
+		t.Fatalf("Forwarded request got %q, forwarded %v, expected the other node's 404", status, ok)
+	}
+
+	// urls nobody claimed aren't forwarded
+	if b.Forward(testConn(t, "pub"), "http", "http://bar.ngrok.test") {
+		t.Fatalf("Connection for an unclaimed url was forwarded")
+	}
+
+	// a node with the wrong secret can't forward connections
+	wrong := &Cluster{Logger: log.NewPrefixLogger("cluster"), node: "127.0.0.1:3", secret: "wrong", registry: a.registry}
+	if ok, _ = forwardRequest(t, wrong, "foo.ngrok.test"); ok {
+		t.Fatalf("Node with the wrong secret forwarded a connection")
+	}
+}
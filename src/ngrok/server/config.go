@@ -0,0 +1,333 @@
+package server
+
+import (
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v1"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"time"
+)
+
+// The ngrokd configuration file. Every setting may also be given with
+// the flag named in its comment, and flags override the file.
+type Configuration struct {
+	HttpAddr   *string `yaml:"http_addr,omitempty"`   // -httpAddr
+	HttpsAddr  *string `yaml:"https_addr,omitempty"`  // -httpsAddr
+	TunnelAddr string  `yaml:"tunnel_addr,omitempty"` // -tunnelAddr
+	AdminAddr  string  `yaml:"admin_addr,omitempty"`  // -adminAddr
+	Domain     string  `yaml:"domain,omitempty"`      // -domain
+
+	// address tunnel urls are built from if it differs from the domain
+	// and listening port, replaces the VHOST environment variable
+	Vhost string `yaml:"vhost,omitempty"`
+
+	TlsCrt string `yaml:"tls_crt,omitempty"` // -tlsCrt
+	TlsKey string `yaml:"tls_key,omitempty"` // -tlsKey
+
+	Log      string `yaml:"log,omitempty"`       // -log
+	LogLevel string `yaml:"log_level,omitempty"` // -log-level
+
+	AuthTokens  string `yaml:"auth_tokens,omitempty"`  // -authTokens
+	AuthWebhook string `yaml:"auth_webhook,omitempty"` // -authWebhook
+	Policy      string `yaml:"policy,omitempty"`       // -policy
+	Mux         *bool  `yaml:"mux,omitempty"`          // -mux
+
+	// replaces the REGISTRY_CACHE_FILE environment variable
+	RegistryCacheFile string `yaml:"registry_cache_file,omitempty"`
+	Reservations      string `yaml:"reservations,omitempty"` // -reservations
+
+	// how long connections may finish after SIGTERM, like 30s
+	DrainTimeout string `yaml:"drain_timeout,omitempty"` // -drainTimeout
+
+	// the only OpenID Connect issuers tunnels may require logins with
+	OidcIssuers []string `yaml:"oidc_issuers,omitempty"` // -oidcIssuers
+
+	Acme    *AcmeConfiguration    `yaml:"acme,omitempty"`
+	Metrics *MetricsConfiguration `yaml:"metrics,omitempty"`
+	Limits  *LimitsConfiguration  `yaml:"limits,omitempty"`
+	Cluster *ClusterConfiguration `yaml:"cluster,omitempty"`
+}
+
+type AcmeConfiguration struct {
+	Directory string `yaml:"directory,omitempty"` // -acmeDirectory
+	Email     string `yaml:"email,omitempty"`     // -acmeEmail
+	Cache     string `yaml:"cache,omitempty"`     // -acmeCache
+	CA        string `yaml:"ca,omitempty"`        // -acmeCA
+}
+
+type MetricsConfiguration struct {
+	// one of local, keen or prometheus
+	Backend        string `yaml:"backend,omitempty"`         // -metrics
+	PrometheusAddr string `yaml:"prometheus_addr,omitempty"` // -prometheusAddr
+
+	// replace the KEEN_API_KEY and KEEN_PROJECT_TOKEN environment variables
+	KeenApiKey       string `yaml:"keen_api_key,omitempty"`
+	KeenProjectToken string `yaml:"keen_project_token,omitempty"`
+}
+
+type ClusterConfiguration struct {
+	Addr     string `yaml:"addr,omitempty"`     // -clusterAddr
+	Registry string `yaml:"registry,omitempty"` // -clusterRegistry
+	Secret   string `yaml:"secret,omitempty"`   // -clusterSecret
+}
+
+type LimitsConfiguration struct {
+	// tunnels a named account may have open when its auth backend sets no limit
+	MaxTunnels int `yaml:"max_tunnels,omitempty"` // -maxTunnels
+
+	// tunnels a single control connection may have open
+	MaxTunnelsPerClient int `yaml:"max_tunnels_per_client,omitempty"` // -maxTunnelsPerClient
+
+	// bytes a second each tunnel, and all the tunnels of a user together,
+	// may carry in each direction when an account sets no limit
+	TunnelRate  int64 `yaml:"tunnel_rate,omitempty"`  // -tunnelRate
+	TunnelBurst int64 `yaml:"tunnel_burst,omitempty"` // -tunnelBurst
+	UserRate    int64 `yaml:"user_rate,omitempty"`    // -userRate
+	UserBurst   int64 `yaml:"user_burst,omitempty"`   // -userBurst
+}
+
+// Reads the configuration file named by -config, if any, into the options.
+// Settings given on the command line are left alone. The environment
+// variables ngrokd used to be configured with apply when the file doesn't
+// set them. The result is validated.
+func LoadConfiguration(opts *Options) (err error) {
+	if opts.config != "" {
+		var configBuf []byte
+		if configBuf, err = ioutil.ReadFile(opts.config); err != nil {
+			return fmt.Errorf("Failed to read configuration file %s: %v", opts.config, err)
+		}
+
+		config := new(Configuration)
+		if err = yaml.Unmarshal(configBuf, config); err != nil {
+			return fmt.Errorf("Error parsing configuration file %s: %v", opts.config, err)
+		}
+
+		if err = config.apply(opts); err != nil {
+			return fmt.Errorf("Invalid configuration in %s: %v", opts.config, err)
+		}
+	}
+
+	if opts.vhost == "" {
+		opts.vhost = os.Getenv("VHOST")
+	}
+
+	if opts.registryCacheFile == "" {
+		opts.registryCacheFile = os.Getenv("REGISTRY_CACHE_FILE")
+	}
+
+	if opts.keenApiKey == "" {
+		opts.keenApiKey = os.Getenv("KEEN_API_KEY")
+	}
+
+	if opts.keenProjectToken == "" {
+		opts.keenProjectToken = os.Getenv("KEEN_PROJECT_TOKEN")
+	}
+
+	if err = validateOptions(opts); err != nil {
+		if opts.config != "" {
+			err = fmt.Errorf("Invalid configuration in %s: %v", opts.config, err)
+		}
+		return
+	}
+
+	return
+}
+
+// Copy the file's settings into the options, except where a flag was given
+func (config *Configuration) apply(opts *Options) (err error) {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	str := func(name string, dst *string, v string) {
+		if v != "" && !set[name] {
+			*dst = v
+		}
+	}
+
+	// listeners may be disabled with an empty string, so tell that apart from unset
+	if config.HttpAddr != nil && !set["httpAddr"] {
+		opts.httpAddr = *config.HttpAddr
+	}
+	if config.HttpsAddr != nil && !set["httpsAddr"] {
+		opts.httpsAddr = *config.HttpsAddr
+	}
+	str("tunnelAddr", &opts.tunnelAddr, config.TunnelAddr)
+	str("adminAddr", &opts.adminAddr, config.AdminAddr)
+	str("domain", &opts.domain, config.Domain)
+	opts.vhost = config.Vhost
+
+	str("tlsCrt", &opts.tlsCrt, config.TlsCrt)
+	str("tlsKey", &opts.tlsKey, config.TlsKey)
+
+	str("log", &opts.logto, config.Log)
+	str("log-level", &opts.loglevel, config.LogLevel)
+
+	str("authTokens", &opts.authTokens, config.AuthTokens)
+	str("authWebhook", &opts.authWebhook, config.AuthWebhook)
+	str("policy", &opts.policy, config.Policy)
+	if config.Mux != nil && !set["mux"] {
+		opts.mux = *config.Mux
+	}
+
+	opts.registryCacheFile = config.RegistryCacheFile
+	str("reservations", &opts.reservations, config.Reservations)
+
+	if config.DrainTimeout != "" && !set["drainTimeout"] {
+		if opts.drainTimeout, err = time.ParseDuration(config.DrainTimeout); err != nil {
+			return fmt.Errorf("Invalid drain_timeout: %v", err)
+		}
+	}
+
+	if len(config.OidcIssuers) > 0 && !set["oidcIssuers"] {
+		opts.oidcIssuers = config.OidcIssuers
+	}
+
+	if a := config.Acme; a != nil {
+		str("acmeDirectory", &opts.acmeDirectory, a.Directory)
+		str("acmeEmail", &opts.acmeEmail, a.Email)
+		str("acmeCache", &opts.acmeCache, a.Cache)
+		str("acmeCA", &opts.acmeCA, a.CA)
+	}
+
+	if m := config.Metrics; m != nil {
+		str("metrics", &opts.metrics, m.Backend)
+		str("prometheusAddr", &opts.prometheusAddr, m.PrometheusAddr)
+		opts.keenApiKey = m.KeenApiKey
+		opts.keenProjectToken = m.KeenProjectToken
+	}
+
+	if c := config.Cluster; c != nil {
+		str("clusterAddr", &opts.clusterAddr, c.Addr)
+		str("clusterRegistry", &opts.clusterRegistry, c.Registry)
+		str("clusterSecret", &opts.clusterSecret, c.Secret)
+	}
+
+	if l := config.Limits; l != nil {
+		if l.MaxTunnels != 0 && !set["maxTunnels"] {
+			opts.maxTunnels = l.MaxTunnels
+		}
+		if l.MaxTunnelsPerClient != 0 && !set["maxTunnelsPerClient"] {
+			opts.maxTunnelsPerClient = l.MaxTunnelsPerClient
+		}
+
+		rate := func(name string, dst *int64, v int64) {
+			if v != 0 && !set[name] {
+				*dst = v
+			}
+		}
+		rate("tunnelRate", &opts.tunnelRate, l.TunnelRate)
+		rate("tunnelBurst", &opts.tunnelBurst, l.TunnelBurst)
+		rate("userRate", &opts.userRate, l.UserRate)
+		rate("userBurst", &opts.userBurst, l.UserBurst)
+	}
+
+	return
+}
+
+func validateAddress(addr, name string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("Invalid address for %s: %v", name, err)
+	}
+	return nil
+}
+
+func validateOptions(opts *Options) error {
+	if opts.tunnelAddr == "" {
+		return fmt.Errorf("A tunnel address to listen for clients on is required")
+	}
+
+	addrs := []struct{ addr, name string }{
+		{opts.httpAddr, "http_addr"},
+		{opts.httpsAddr, "https_addr"},
+		{opts.tunnelAddr, "tunnel_addr"},
+		{opts.adminAddr, "admin_addr"},
+		{opts.prometheusAddr, "prometheus_addr"},
+	}
+	for _, a := range addrs {
+		if a.addr == "" {
+			continue
+		}
+		if err := validateAddress(a.addr, a.name); err != nil {
+			return err
+		}
+	}
+
+	if opts.domain == "" {
+		return fmt.Errorf("A domain to host tunnels on is required")
+	}
+
+	if (opts.tlsCrt == "") != (opts.tlsKey == "") {
+		return fmt.Errorf("tls_crt and tls_key must be specified together")
+	}
+
+	switch opts.loglevel {
+	case "FINEST", "FINE", "DEBUG", "TRACE", "INFO", "WARNING", "ERROR", "CRITICAL":
+	default:
+		return fmt.Errorf("Unknown log level %s", opts.loglevel)
+	}
+
+	if opts.authTokens != "" && opts.authWebhook != "" {
+		return fmt.Errorf("Only one of auth_tokens and auth_webhook may be specified")
+	}
+
+	if opts.acmeDirectory != "" && opts.acmeCache == "" {
+		return fmt.Errorf("An ACME cache directory is required to obtain certificates")
+	}
+
+	switch opts.metrics {
+	case "", "local":
+	case "keen":
+		if opts.keenApiKey == "" {
+			return fmt.Errorf("The keen metrics backend requires a keen_api_key")
+		}
+	case "prometheus":
+		if opts.prometheusAddr == "" {
+			return fmt.Errorf("The prometheus metrics backend requires a prometheus_addr")
+		}
+	default:
+		return fmt.Errorf("Unknown metrics backend %s, expected local, keen or prometheus", opts.metrics)
+	}
+
+	if opts.clusterRegistry != "" {
+		if opts.clusterAddr == "" {
+			return fmt.Errorf("A cluster address other nodes can reach this node on is required")
+		}
+
+		if host, _, err := net.SplitHostPort(opts.clusterAddr); err != nil || host == "" || net.ParseIP(host).IsUnspecified() {
+			return fmt.Errorf("Invalid cluster address %s, other nodes must be able to connect to it", opts.clusterAddr)
+		}
+
+		if opts.clusterSecret == "" {
+			return fmt.Errorf("A cluster secret shared by the nodes is required")
+		}
+
+		if opts.clusterRegistry != "memory" && !isClusterNode(opts.clusterRegistry) {
+			return fmt.Errorf("Unknown cluster registry %s, expected memory or the cluster address of the node which runs it", opts.clusterRegistry)
+		}
+	}
+
+	for _, issuer := range opts.oidcIssuers {
+		if u, err := url.Parse(issuer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid OIDC issuer %s, expected an http or https url", issuer)
+		}
+	}
+
+	if opts.drainTimeout < 0 {
+		return fmt.Errorf("The drain timeout may not be negative")
+	}
+
+	if opts.maxTunnels < 0 || opts.maxTunnelsPerClient < 0 {
+		return fmt.Errorf("Tunnel limits may not be negative")
+	}
+
+	if opts.tunnelRate < 0 || opts.tunnelBurst < 0 || opts.userRate < 0 || opts.userBurst < 0 {
+		return fmt.Errorf("Rate limits may not be negative")
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the options ngrokd starts with when no flags are given
+func defaultOptions() *Options {
+	return &Options{
+		httpAddr:     ":80",
+		httpsAddr:    ":443",
+		tunnelAddr:   ":4443",
+		domain:       "ngrok.com",
+		logto:        "stdout",
+		loglevel:     "DEBUG",
+		mux:          true,
+		drainTimeout: 30 * time.Second,
+	}
+}
+
+func TestLoadConfiguration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ngrokd.yml")
+	err := ioutil.WriteFile(path, []byte(`
+http_addr: ""
+https_addr: ":8443"
+domain: example.com
+admin_addr: "127.0.0.1:4040"
+mux: false
+drain_timeout: 2m
+oidc_issuers: ["https://accounts.example.com"]
+metrics:
+  backend: prometheus
+  prometheus_addr: "127.0.0.1:9100"
+cluster:
+  addr: "10.0.0.1:4444"
+  registry: memory
+  secret: s3cret
+limits:
+  max_tunnels: 10
+  tunnel_rate: 1048576
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := defaultOptions()
+	opts.config = path
+	if err = LoadConfiguration(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name            string
+		value, expected interface{}
+	}{
+		{"http_addr", opts.httpAddr, ""},
+		{"https_addr", opts.httpsAddr, ":8443"},
+		{"tunnel_addr", opts.tunnelAddr, ":4443"},
+		{"domain", opts.domain, "example.com"},
+		{"admin_addr", opts.adminAddr, "127.0.0.1:4040"},
+		{"mux", opts.mux, false},
+		{"drain_timeout", opts.drainTimeout, 2 * time.Minute},
+		{"oidc_issuers", strings.Join(opts.oidcIssuers, ","), "https://accounts.example.com"},
+		{"metrics.backend", opts.metrics, "prometheus"},
+		{"metrics.prometheus_addr", opts.prometheusAddr, "127.0.0.1:9100"},
+		{"cluster.addr", opts.clusterAddr, "10.0.0.1:4444"},
+		{"cluster.registry", opts.clusterRegistry, "memory"},
+		{"cluster.secret", opts.clusterSecret, "s3cret"},
+		{"limits.max_tunnels", opts.maxTunnels, 10},
+		{"limits.tunnel_rate", opts.tunnelRate, int64(1048576)},
+		{"limits.user_rate", opts.userRate, int64(0)},
+	} {
+		if c.value != c.expected {
+			t.Errorf("%s is %v, expected %v", c.name, c.value, c.expected)
+		}
+	}
+
+	for _, c := range []struct {
+		config string
+		err    string
+	}{
+		{"domain: [", "Error parsing"},
+		{"drain_timeout: soon", "drain_timeout"},
+		{"http_addr: 80", "http_addr"},
+	} {
+		if err = ioutil.WriteFile(path, []byte(c.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		opts = defaultOptions()
+		opts.config = path
+		err = LoadConfiguration(opts)
+		if err == nil || !strings.Contains(err.Error(), c.err) || !strings.Contains(err.Error(), path) {
+			t.Errorf("%q: unexpected error %v", c.config, err)
+		}
+	}
+}
+
+func TestValidateOptions(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		modify func(*Options)
+		err    string
+	}{
+		{"defaults", func(o *Options) {}, ""},
+		{"no tunnel addr", func(o *Options) { o.tunnelAddr = "" }, "tunnel address"},
+		{"bad admin addr", func(o *Options) { o.adminAddr = "localhost" }, "admin_addr"},
+		{"no domain", func(o *Options) { o.domain = "" }, "domain"},
+		{"crt without key", func(o *Options) { o.tlsCrt = "ngrokd.crt" }, "tls_crt and tls_key"},
+		{"log level", func(o *Options) { o.loglevel = "LOUD" }, "log level"},
+		{"two auth backends", func(o *Options) { o.authTokens, o.authWebhook = "tokens.yml", "http://auth" }, "auth_tokens"},
+		{"acme without cache", func(o *Options) { o.acmeDirectory = "https://acme.test/dir" }, "ACME cache"},
+		{"keen without key", func(o *Options) { o.metrics = "keen" }, "keen_api_key"},
+		{"prometheus without addr", func(o *Options) { o.metrics = "prometheus" }, "prometheus_addr"},
+		{"unknown metrics", func(o *Options) { o.metrics = "statsd" }, "Unknown metrics"},
+		{"cluster", func(o *Options) {
+			o.clusterRegistry, o.clusterAddr, o.clusterSecret = "10.0.0.2:4444", "10.0.0.1:4444", "s3cret"
+		}, ""},
+		{"registry on the admin api", func(o *Options) {
+			o.clusterRegistry, o.clusterAddr, o.clusterSecret = "http://10.0.0.2:4040", "10.0.0.1:4444", "s3cret"
+		}, "Unknown cluster registry"},
+		{"cluster without addr", func(o *Options) { o.clusterRegistry, o.clusterSecret = "memory", "s3cret" }, "cluster address"},
+		{"cluster on any address", func(o *Options) {
+			o.clusterRegistry, o.clusterAddr, o.clusterSecret = "memory", "0.0.0.0:4444", "s3cret"
+		}, "Invalid cluster address"},
+		{"cluster without secret", func(o *Options) { o.clusterRegistry, o.clusterAddr = "memory", "10.0.0.1:4444" }, "cluster secret"},
+		{"unknown registry", func(o *Options) {
+			o.clusterRegistry, o.clusterAddr, o.clusterSecret = "etcd://10.0.0.2", "10.0.0.1:4444", "s3cret"
+		}, "Unknown cluster registry"},
+		{"oidc issuer", func(o *Options) { o.oidcIssuers = []string{"accounts.example.com"} }, "OIDC issuer"},
+		{"negative drain", func(o *Options) { o.drainTimeout = -time.Second }, "drain timeout"},
+		{"negative limit", func(o *Options) { o.maxTunnelsPerClient = -1 }, "Tunnel limits"},
+		{"negative rate", func(o *Options) { o.userBurst = -1 }, "Rate limits"},
+	} {
+		opts := defaultOptions()
+		c.modify(opts)
+		err := validateOptions(opts)
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s: %v", c.name, err)
+		case c.err != "" && err == nil:
+			t.Errorf("%s: expected an error", c.name)
+		case c.err != "" && !strings.Contains(err.Error(), c.err):
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		}
+	}
+}
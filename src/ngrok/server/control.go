@@ -2,6 +2,7 @@ package server
 
 import (
 	"fmt"
+	"github.com/hashicorp/yamux"
 	"io"
 	"ngrok/conn"
 	"ngrok/msg"
@@ -9,6 +10,7 @@ import (
 	"ngrok/version"
 	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,9 +26,19 @@ type Control struct {
 	// auth message
 	auth *msg.Auth
 
-	// actual connection
+	// the account this control connection authenticated as
+	account *Account
+
+	// bytes a second all of the user's tunnels may carry, nil if unlimited
+	rate *rateLimit
+
+	// actual connection, or the control stream of mux
 	conn conn.Conn
 
+	// multiplexed session over the control connection if the client
+	// negotiated one, proxy connections are streams opened inside it
+	mux *yamux.Session
+
 	// put a message in this channel to send it over
 	// conn to the client
 	out chan (msg.Message)
@@ -38,14 +50,19 @@ type Control struct {
 	// the last time we received a ping from the client - for heartbeats
 	lastPing time.Time
 
+	// time when the control connection was established
+	start time.Time
+
 	// all of the tunnels this control connection handles
 	tunnels []*Tunnel
 
 	// proxy connections
 	proxies chan conn.Conn
 
-	// identifier
-	id string
+	// identifier, cleared when the control is replaced, so read it with Id()
+	// once the control is registered
+	id     string
+	idLock sync.RWMutex
 
 	// synchronizer for controlled shutdown of writer()
 	writerShutdown *util.Shutdown
@@ -71,6 +88,7 @@ func NewControl(ctlConn conn.Conn, authMsg *msg.Auth) {
 		in:              make(chan msg.Message),
 		proxies:         make(chan conn.Conn, 10),
 		lastPing:        time.Now(),
+		start:           time.Now(),
 		writerShutdown:  util.NewShutdown(),
 		readerShutdown:  util.NewShutdown(),
 		managerShutdown: util.NewShutdown(),
@@ -101,6 +119,40 @@ func NewControl(ctlConn conn.Conn, authMsg *msg.Auth) {
 		return
 	}
 
+	// authenticate the client before we tell it anything else
+	if c.account, err = authenticator.Authenticate(authMsg, ctlConn.RemoteAddr()); err != nil {
+		ctlConn.Info("Authentication failed: %v", err)
+		failAuth(err)
+		return
+	}
+
+	if c.account.User != "" {
+		ctlConn.AddLogPrefix(c.account.User)
+	}
+	c.rate = userRateLimit(c.account)
+
+	authResp := &msg.AuthResp{
+		Version:   version.Proto,
+		MmVersion: version.MajorMinor(),
+		ClientId:  c.id,
+		Mux:       authMsg.Mux && opts.mux,
+	}
+
+	if authResp.Mux {
+		// the AuthResp is the last message sent over the raw connection
+		if err = msg.WriteMsg(ctlConn, authResp); err != nil {
+			ctlConn.Warn("Failed to write AuthResp: %v", err)
+			ctlConn.Close()
+			return
+		}
+
+		if c.conn, c.mux, err = conn.StartMux(ctlConn, true); err != nil {
+			ctlConn.Warn("Failed to start multiplexed session: %v", err)
+			ctlConn.Close()
+			return
+		}
+	}
+
 	// register the control
 	if replaced := controlRegistry.Add(c.id, c); replaced != nil {
 		replaced.shutdown.WaitComplete()
@@ -109,15 +161,13 @@ func NewControl(ctlConn conn.Conn, authMsg *msg.Auth) {
 	// start the writer first so that the following messages get sent
 	go c.writer()
 
-	// Respond to authentication
-	c.out <- &msg.AuthResp{
-		Version:   version.Proto,
-		MmVersion: version.MajorMinor(),
-		ClientId:  c.id,
-	}
+	if !authResp.Mux {
+		// Respond to authentication
+		c.out <- authResp
 
-	// As a performance optimization, ask for a proxy connection up front
-	c.out <- &msg.ReqProxy{}
+		// As a performance optimization, ask for a proxy connection up front
+		c.out <- &msg.ReqProxy{}
+	}
 
 	// manage the connection
 	go c.manager()
@@ -127,6 +177,27 @@ func NewControl(ctlConn conn.Conn, authMsg *msg.Auth) {
 
 // Register a new tunnel on this control connection
 func (c *Control) registerTunnel(rawTunnelReq *msg.ReqTunnel) {
+	// a client can't do without the tunnels it asked for when it connected,
+	// but one it asked for later only fails its own request
+	fail := func(err error) {
+		c.out <- &msg.NewTunnel{Error: err.Error(), ReqId: rawTunnelReq.ReqId}
+		if !rawTunnelReq.Optional && len(c.tunnels) == 0 {
+			c.shutdown.Begin()
+		}
+	}
+
+	// all the protocols of the request count as a single tunnel
+	slot, err := c.reserveTunnel()
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer tunnelRegistry.Release(slot)
+
+	// open every protocol before acknowledging any of them, so that if one
+	// of them fails the others are closed again instead of being left open
+	// under a request the client was told failed
+	var tunnels []*Tunnel
 	for _, proto := range strings.Split(rawTunnelReq.Protocol, "+") {
 		tunnelReq := *rawTunnelReq
 		tunnelReq.Protocol = proto
@@ -134,27 +205,77 @@ func (c *Control) registerTunnel(rawTunnelReq *msg.ReqTunnel) {
 		c.conn.Debug("Registering new tunnel")
 		t, err := NewTunnel(&tunnelReq, c)
 		if err != nil {
-			c.out <- &msg.NewTunnel{Error: err.Error()}
-			if len(c.tunnels) == 0 {
-				c.shutdown.Begin()
+			for _, sibling := range tunnels {
+				sibling.Shutdown()
 			}
+			fail(err)
 
 			// we're done
 			return
 		}
 
+		tunnelRegistry.Retain(slot)
+		t.slot = slot
+		tunnels = append(tunnels, t)
+
+		rawTunnelReq.Hostname = strings.Replace(t.url, proto+"://", "", 1)
+	}
+
+	for _, t := range tunnels {
 		// add it to the list of tunnels
 		c.tunnels = append(c.tunnels, t)
 
 		// acknowledge success
 		c.out <- &msg.NewTunnel{
-			Url:      t.url,
-			Protocol: proto,
-			ReqId:    rawTunnelReq.ReqId,
+			Url:       t.url,
+			Protocol:  t.req.Protocol,
+			ReqId:     rawTunnelReq.ReqId,
+			ClientTLS: t.req.ClientTLS,
+			RateLimit: t.RateLimit(),
 		}
+	}
+}
 
-		rawTunnelReq.Hostname = strings.Replace(t.url, proto+"://", "", 1)
+// Reserve a slot for a new tunnel, enforcing the account's and the server's
+// tunnel limits. The protocols of one request count as a single tunnel.
+func (c *Control) reserveTunnel() (*tunnelSlot, error) {
+	if max := opts.maxTunnelsPerClient; max > 0 {
+		slots := make(map[*tunnelSlot]bool)
+		for _, t := range c.tunnels {
+			slots[t.slot] = true
+		}
+
+		if len(slots) >= max {
+			return nil, fmt.Errorf("Each client is limited to %d open tunnels.", max)
+		}
 	}
+
+	max := c.account.MaxTunnels
+	if max == 0 && c.account.User != "" {
+		max = opts.maxTunnels
+	}
+
+	return tunnelRegistry.ReserveUser(c.account.User, max)
+}
+
+// Close a single tunnel on this control connection and let the client know
+func (c *Control) closeTunnel(url string) {
+	for i, t := range c.tunnels {
+		if t.url == url {
+			c.tunnels = append(c.tunnels[:i], c.tunnels[i+1:]...)
+			t.Shutdown()
+			c.out <- &msg.TunnelClosed{Url: url}
+			return
+		}
+	}
+
+	c.out <- &msg.TunnelClosed{Url: url, Error: fmt.Sprintf("No tunnel %s found on this session", url)}
+}
+
+// CloseTunnel asks the control connection to close one of its tunnels
+// as if the client had requested it. It is safe to call from any goroutine.
+func (c *Control) CloseTunnel(url string) error {
+	return util.PanicToError(func() { c.in <- &msg.CloseTunnel{Url: url} })
 }
 
 func (c *Control) manager() {
@@ -180,6 +301,7 @@ func (c *Control) manager() {
 		case <-reap.C:
 			if time.Since(c.lastPing) > pingTimeoutInterval {
 				c.conn.Info("Lost heartbeat")
+				metrics.LostHeartbeat(c)
 				c.shutdown.Begin()
 			}
 
@@ -193,6 +315,9 @@ func (c *Control) manager() {
 			case *msg.ReqTunnel:
 				c.registerTunnel(m)
 
+			case *msg.CloseTunnel:
+				c.closeTunnel(m.Url)
+
 			case *msg.Ping:
 				c.lastPing = time.Now()
 				c.out <- &msg.Pong{}
@@ -263,7 +388,7 @@ func (c *Control) stopper() {
 	c.shutdown.WaitBegin()
 
 	// remove ourself from the control registry
-	controlRegistry.Del(c.id)
+	controlRegistry.Del(c.Id())
 
 	// shutdown manager() so that we have no more work to do
 	close(c.in)
@@ -273,7 +398,8 @@ func (c *Control) stopper() {
 	close(c.out)
 	c.writerShutdown.WaitComplete()
 
-	// close connection fully
+	// close connection fully, for multiplexed sessions this also
+	// closes all of the proxy streams
 	c.conn.Close()
 
 	// shutdown all of the tunnels
@@ -292,7 +418,7 @@ func (c *Control) stopper() {
 }
 
 func (c *Control) RegisterProxy(conn conn.Conn) {
-	conn.AddLogPrefix(c.id)
+	conn.AddLogPrefix(c.Id())
 
 	conn.SetDeadline(time.Now().Add(proxyStaleDuration))
 	select {
@@ -309,9 +435,22 @@ func (c *Control) RegisterProxy(conn conn.Conn) {
 // and wait until it is available
 // Returns an error if we couldn't get a proxy because it took too long
 // or the tunnel is closing
+// On multiplexed sessions, a new stream is opened instead
 func (c *Control) GetProxy() (proxyConn conn.Conn, err error) {
 	var ok bool
 
+	if c.mux != nil {
+		var stream *yamux.Stream
+		if stream, err = c.mux.OpenStream(); err != nil {
+			err = fmt.Errorf("Failed to open proxy stream: %v", err)
+			return
+		}
+
+		proxyConn = conn.Wrap(stream, "pxy")
+		proxyConn.AddLogPrefix(c.Id())
+		return
+	}
+
 	// get a proxy connection from the pool
 	select {
 	case proxyConn, ok = <-c.proxies:
@@ -341,6 +480,27 @@ func (c *Control) GetProxy() (proxyConn conn.Conn, err error) {
 	return
 }
 
+// Tells the client that ngrokd is shutting down so it reconnects right away.
+// The control connection stays open until ngrokd exits so that the client's
+// proxy connections can finish.
+func (c *Control) GoingAway(reason string) {
+	c.conn.Info("Telling client the server is going away")
+	util.PanicToError(func() {
+		select {
+		case c.out <- &msg.ServerGoingAway{Reason: reason}:
+		case <-time.After(controlWriteTimeout):
+			c.conn.Warn("Timed out telling client the server is going away")
+		}
+	})
+}
+
+// The control's id, empty once it has been replaced
+func (c *Control) Id() string {
+	c.idLock.RLock()
+	defer c.idLock.RUnlock()
+	return c.id
+}
+
 // Called when this control is replaced by another control
 // this can happen if the network drops out and the client reconnects
 // before the old tunnel has lost its heartbeat
@@ -349,7 +509,9 @@ func (c *Control) Replaced(replacement *Control) {
 
 	// set the control id to empty string so that when stopper()
 	// calls registry.Del it won't delete the replacement
+	c.idLock.Lock()
 	c.id = ""
+	c.idLock.Unlock()
 
 	// tell the old one to shutdown
 	c.shutdown.Begin()
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"io"
+	"net"
+	"ngrok/conn"
+	"ngrok/msg"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestControlCloseTunnel(t *testing.T) {
+	testControlGlobals(t)
+	client, _, ctl := testSession(t, false)
+
+	httpUrl := testSessionTunnel(t, client, &msg.ReqTunnel{Protocol: "http", Subdomain: "foo"})
+	tcpUrl := testSessionTunnel(t, client, &msg.ReqTunnel{Protocol: "tcp"})
+	tcpAddr := "127.0.0.1" + tcpUrl[strings.LastIndex(tcpUrl, ":"):]
+
+	closeTunnel := func(url string) *msg.TunnelClosed {
+		if err := msg.WriteMsg(client, &msg.CloseTunnel{Url: url}); err != nil {
+			t.Fatal(err)
+		}
+		m, ok := testReadMsg(t, client).(*msg.TunnelClosed)
+		if !ok || m.Url != url {
+			t.Fatalf("Got %+v, expected TunnelClosed for %s", m, url)
+		}
+		return m
+	}
+
+	// the client closes its tcp tunnel, which stops listening
+	if m := closeTunnel(tcpUrl); m.Error != "" {
+		t.Fatalf("Failed to close %s: %s", tcpUrl, m.Error)
+	}
+	if tunnelRegistry.Get(tcpUrl) != nil {
+		t.Errorf("Closed tunnel %s is still registered", tcpUrl)
+	}
+	if c, err := net.Dial("tcp", tcpAddr); err == nil {
+		c.Close()
+		t.Errorf("Closed tunnel %s still accepts connections", tcpUrl)
+	}
+
+	// closing it again or closing a tunnel of another session fails
+	if m := closeTunnel(tcpUrl); m.Error == "" {
+		t.Errorf("Closing %s twice succeeded", tcpUrl)
+	}
+	if m := closeTunnel("http://bar.ngrok.test"); m.Error == "" {
+		t.Errorf("Closing an unknown tunnel succeeded")
+	}
+
+	// the server closes the other one the same way
+	if err := ctl.CloseTunnel(httpUrl); err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := testReadMsg(t, client).(*msg.TunnelClosed); !ok || m.Url != httpUrl || m.Error != "" {
+		t.Fatalf("Got %+v, expected TunnelClosed for %s", m, httpUrl)
+	}
+	if tunnelRegistry.Get(httpUrl) != nil {
+		t.Errorf("Closed tunnel %s is still registered", httpUrl)
+	}
+
+	// the session outlives its tunnels
+	if controlRegistry.Get(ctl.Id()) != ctl {
+		t.Fatalf("Closing tunnels closed the session")
+	}
+	testSessionTunnel(t, client, &msg.ReqTunnel{Protocol: "http", Subdomain: "foo"})
+
+	// and can't be asked to close anything once it has shut down
+	ctl.shutdown.Begin()
+	ctl.shutdown.WaitComplete()
+	if err := ctl.CloseTunnel(httpUrl); err == nil {
+		t.Errorf("Closed a tunnel of a session which has shut down")
+	}
+}
+
+func TestControlMuxNegotiation(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		server bool
+		client bool
+		mux    bool
+	}{
+		{"both", true, true, true},
+		{"old client", true, false, false},
+		{"server without mux", false, true, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			testControlGlobals(t)
+			opts.mux = c.server
+
+			client, session, ctl := testSession(t, c.client)
+			if (session != nil) != c.mux || (ctl.mux != nil) != c.mux {
+				t.Fatalf("Negotiated mux %v, expected %v", ctl.mux != nil, c.mux)
+			}
+
+			url := testSessionTunnel(t, client, &msg.ReqTunnel{Protocol: "tcp"})
+
+			// without mux, the client answers the ReqProxy it was sent up front
+			// by dialing a proxy connection
+			var pc conn.Conn
+			if !c.mux {
+				serverConn, raw := testConnPair(t)
+				ctl.proxies <- serverConn
+				pc = conn.Wrap(raw, "pxy")
+			}
+
+			public, err := net.Dial("tcp", "127.0.0.1"+url[strings.LastIndex(url, ":"):])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// with mux, the server opens a stream of the session instead
+			if c.mux {
+				stream, err := session.AcceptStream()
+				if err != nil {
+					t.Fatal(err)
+				}
+				pc = conn.Wrap(stream, "pxy")
+			}
+
+			var startPxy msg.StartProxy
+			if err := msg.ReadMsgInto(pc, &startPxy); err != nil {
+				t.Fatal(err)
+			}
+			if startPxy.Url != url {
+				t.Fatalf("Proxy connection started for %s, expected %s", startPxy.Url, url)
+			}
+
+			if _, err := pc.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(public, buf); err != nil || string(buf) != "hello" {
+				t.Fatalf("Public connection read %q, %v", buf, err)
+			}
+
+			// and is asked to replace the proxy connection it used up
+			if !c.mux {
+				if m, ok := testReadMsg(t, client).(*msg.ReqProxy); !ok {
+					t.Errorf("Got %+v, expected a ReqProxy", m)
+				}
+			}
+
+			// let the connection finish before the next case replaces the globals
+			public.Close()
+			pc.Close()
+			tun := tunnelRegistry.Get(url)
+			for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt64(&tun.activeConnections) != 0 && time.Now().Before(deadline); {
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
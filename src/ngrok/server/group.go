@@ -0,0 +1,254 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// how long a member whose client failed to provide a proxy connection
+	// is skipped while the group has other members to pick from
+	groupFailureBackoff = 30 * time.Second
+)
+
+// Tunnels of several control connections which registered the same url
+// with the same group secret. Public connections are balanced across the
+// members, round robin or to the one with the fewest active connections,
+// unless the routing rules of members pick one for an http request.
+//
+// A group lives on a single node of a cluster. Its url is claimed for the
+// node its first member registered with, members connecting to any other
+// node are refused, and connections only ever fail over between members
+// on the same node.
+type tunnelGroup struct {
+	url     string
+	secret  string
+	balance string
+
+	// must match for every member, they decide how https connections
+	// are routed and what is spoken over proxy connections
+	clientTLS   bool
+	appProtocol string
+
+	members []*Tunnel
+	failed  map[*Tunnel]time.Time
+
+	// rotates the member picking starts from
+	next int
+
+	sync.Mutex
+}
+
+func newTunnelGroup(url string, t *Tunnel) *tunnelGroup {
+	balance := t.req.Balance
+	if balance == "" {
+		balance = "round_robin"
+	}
+
+	return &tunnelGroup{
+		url:         url,
+		secret:      t.req.GroupSecret,
+		balance:     balance,
+		clientTLS:   t.req.ClientTLS,
+		appProtocol: t.req.AppProtocol,
+		members:     []*Tunnel{t},
+		failed:      make(map[*Tunnel]time.Time),
+	}
+}
+
+// Adds a tunnel to the group if it knows the group's secret and asks
+// for the same kind of balancing
+func (g *tunnelGroup) add(t *Tunnel) error {
+	if subtle.ConstantTimeCompare([]byte(t.req.GroupSecret), []byte(g.secret)) != 1 {
+		return fmt.Errorf("The tunnel %s is already registered.", g.url)
+	}
+
+	balance := t.req.Balance
+	if balance == "" {
+		balance = "round_robin"
+	}
+	if balance != g.balance {
+		return fmt.Errorf("The tunnel group %s balances with %s, not %s.", g.url, g.balance, balance)
+	}
+
+	if t.req.ClientTLS != g.clientTLS {
+		return fmt.Errorf("Either all or none of the tunnels of group %s must terminate TLS in the client.", g.url)
+	}
+
+	if t.req.AppProtocol != g.appProtocol {
+		return fmt.Errorf("All the tunnels of group %s must use the same app protocol.", g.url)
+	}
+
+	g.Lock()
+	defer g.Unlock()
+
+	weight := t.route.Weight()
+	for _, m := range g.members {
+		weight += m.route.Weight()
+	}
+	if weight > 100 {
+		return fmt.Errorf("The weights of the tunnels of group %s would add up to more than 100%%.", g.url)
+	}
+
+	g.members = append(g.members, t)
+	return nil
+}
+
+// Removes a tunnel from the group, returns whether it was the last one
+func (g *tunnelGroup) remove(t *Tunnel) (empty bool) {
+	g.Lock()
+	defer g.Unlock()
+
+	for i, m := range g.members {
+		if m == t {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	delete(g.failed, t)
+	return len(g.members) == 0
+}
+
+// Skips a member whose client failed to provide a proxy connection
+// for a while
+func (g *tunnelGroup) Failed(t *Tunnel) {
+	g.Lock()
+	defer g.Unlock()
+	g.failed[t] = time.Now()
+}
+
+// Picks the member the next public connection goes to, passing over the
+// excluded ones. Members which are draining or which failed recently are
+// only picked when no other member is left. Returns nil if none is.
+func (g *tunnelGroup) Pick(exclude ...*Tunnel) *Tunnel {
+	g.Lock()
+	defer g.Unlock()
+	return g.pick(g.members, exclude)
+}
+
+// Routes an http request by the members' routing rules. Members whose
+// header or cookie the request has get it first, then members with a
+// weight get their share, and the rest is balanced across the members
+// without rules. Members whose rules would leave the request unrouted
+// are only picked when none of those is left.
+func (g *tunnelGroup) Route(req *http.Request) *Tunnel {
+	g.Lock()
+	defer g.Unlock()
+
+	var matched, weighted, rest []*Tunnel
+	for _, m := range g.members {
+		switch {
+		case m.route.Matches(req):
+			matched = append(matched, m)
+		case m.route.Weight() > 0:
+			weighted = append(weighted, m)
+		case m.route == nil:
+			rest = append(rest, m)
+		}
+	}
+
+	if t := g.choose(g.healthy(matched)); t != nil {
+		return t
+	}
+
+	n := rand.Intn(100)
+	for _, m := range weighted {
+		if n < m.route.Weight() {
+			if t := g.choose(g.healthy([]*Tunnel{m})); t != nil {
+				return t
+			}
+			break
+		}
+		n -= m.route.Weight()
+	}
+
+	if t := g.choose(g.healthy(rest)); t != nil {
+		return t
+	}
+	return g.pick(g.members, nil)
+}
+
+// Picks one of the members, preferring the healthy ones. The caller
+// must hold the lock.
+func (g *tunnelGroup) pick(members, exclude []*Tunnel) *Tunnel {
+	var candidates []*Tunnel
+	for _, m := range members {
+		if atomic.LoadInt32(&m.closing) == 0 && !excluded(m, exclude) {
+			candidates = append(candidates, m)
+		}
+	}
+
+	if healthy := g.healthy(candidates); len(healthy) > 0 {
+		return g.choose(healthy)
+	}
+	return g.choose(candidates)
+}
+
+// Filters out the members which are closing, draining or failed
+// recently. The caller must hold the lock.
+func (g *tunnelGroup) healthy(members []*Tunnel) []*Tunnel {
+	var healthy []*Tunnel
+	for _, m := range members {
+		if atomic.LoadInt32(&m.closing) == 1 || atomic.LoadInt32(&m.draining) == 1 {
+			continue
+		}
+
+		if failedAt, ok := g.failed[m]; ok {
+			if time.Since(failedAt) < groupFailureBackoff {
+				continue
+			}
+			delete(g.failed, m)
+		}
+
+		healthy = append(healthy, m)
+	}
+	return healthy
+}
+
+// Balances between candidates, returns nil if there are none. The
+// caller must hold the lock.
+func (g *tunnelGroup) choose(candidates []*Tunnel) *Tunnel {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// start from a different member each time, so members with
+	// as few connections as each other take turns too
+	start := g.next % len(candidates)
+	g.next++
+
+	pick := candidates[start]
+	if g.balance == "least_connections" {
+		least := atomic.LoadInt64(&pick.activeConnections)
+		for i := 1; i < len(candidates); i++ {
+			m := candidates[(start+i)%len(candidates)]
+			if n := atomic.LoadInt64(&m.activeConnections); n < least {
+				pick, least = m, n
+			}
+		}
+	}
+	return pick
+}
+
+// Returns a snapshot of the group's members
+func (g *tunnelGroup) Members() []*Tunnel {
+	g.Lock()
+	defer g.Unlock()
+	members := make([]*Tunnel, len(g.members))
+	copy(members, g.members)
+	return members
+}
+
+func excluded(t *Tunnel, exclude []*Tunnel) bool {
+	for _, e := range exclude {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
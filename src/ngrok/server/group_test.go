@@ -0,0 +1,226 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"ngrok/conn"
+	"ngrok/log"
+	"ngrok/msg"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a member of g, its client is connected with ctl
+func testMember(g *tunnelGroup, ctl *Control, route *tunnelRoute) *Tunnel {
+	t := &Tunnel{
+		Logger: log.NewPrefixLogger(),
+		req:    &msg.ReqTunnel{GroupSecret: g.secret},
+		url:    g.url,
+		ctl:    ctl,
+		group:  g,
+		route:  route,
+	}
+	g.members = append(g.members, t)
+	return t
+}
+
+func testGroup(balance string) *tunnelGroup {
+	return &tunnelGroup{
+		url:     "https://app.ngrok.test",
+		secret:  "s3cret",
+		balance: balance,
+		failed:  make(map[*Tunnel]time.Time),
+	}
+}
+
+func TestGroupPick(t *testing.T) {
+	g := testGroup("round_robin")
+	a, b, c := testMember(g, nil, nil), testMember(g, nil, nil), testMember(g, nil, nil)
+
+	// round robin takes turns
+	picks := make(map[*Tunnel]int)
+	for i := 0; i < 30; i++ {
+		picks[g.Pick()]++
+	}
+	if picks[a] != 10 || picks[b] != 10 || picks[c] != 10 {
+		t.Errorf("Round robin picked %d, %d and %d times", picks[a], picks[b], picks[c])
+	}
+
+	// failed, draining and closing members are passed over
+	g.Failed(a)
+	atomic.StoreInt32(&b.draining, 1)
+	for i := 0; i < 5; i++ {
+		if m := g.Pick(); m != c {
+			t.Fatalf("Picked an unhealthy member")
+		}
+	}
+
+	// unhealthy members are better than none, closing ones aren't
+	if m := g.Pick(c); m != a && m != b {
+		t.Fatalf("No unhealthy member was picked when only those were left")
+	}
+	atomic.StoreInt32(&a.closing, 1)
+	atomic.StoreInt32(&b.closing, 1)
+	if m := g.Pick(c); m != nil {
+		t.Fatalf("Picked a closing member")
+	}
+
+	// members which failed long enough ago are healthy again
+	g = testGroup("least_connections")
+	a, b, c = testMember(g, nil, nil), testMember(g, nil, nil), testMember(g, nil, nil)
+	g.failed[a] = time.Now().Add(-2 * groupFailureBackoff)
+	atomic.StoreInt64(&b.activeConnections, 1)
+	atomic.StoreInt64(&c.activeConnections, 2)
+	for i := 0; i < 3; i++ {
+		if m := g.Pick(); m != a {
+			t.Fatalf("Least connections didn't pick the member with the fewest")
+		}
+	}
+}
+
+func TestGroupRoute(t *testing.T) {
+	g := testGroup("round_robin")
+	canary := testMember(g, nil, &tunnelRoute{weight: 20})
+	beta := testMember(g, nil, &tunnelRoute{header: "X-Beta", value: "1", cookie: "beta", cookieValue: "yes"})
+	rest := testMember(g, nil, nil)
+
+	req := func(header, cookie string) *http.Request {
+		r, _ := http.NewRequest("GET", g.url, nil)
+		if header != "" {
+			r.Header.Set("X-Beta", header)
+		}
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "beta", Value: cookie})
+		}
+		return r
+	}
+
+	for _, c := range []struct {
+		header, cookie string
+		member         *Tunnel
+	}{
+		{"1", "", beta},
+		{"", "yes", beta},
+		{"2", "no", nil},
+	} {
+		for i := 0; i < 20; i++ {
+			m := g.Route(req(c.header, c.cookie))
+			if c.member != nil && m != c.member {
+				t.Fatalf("Request with %q and %q wasn't routed to the member asking for it", c.header, c.cookie)
+			}
+			if c.member == nil && m == beta {
+				t.Fatalf("Request with %q and %q was routed to a member which didn't ask for it", c.header, c.cookie)
+			}
+		}
+	}
+
+	// weighted members get their share of the other requests
+	picks := make(map[*Tunnel]int)
+	for i := 0; i < 10000; i++ {
+		picks[g.Route(req("", ""))]++
+	}
+	if n := picks[canary]; n < 1700 || n > 2300 {
+		t.Errorf("Member with a weight of 20 got %d of 10000 requests", n)
+	}
+	if picks[canary]+picks[rest] != 10000 {
+		t.Errorf("Requests were routed to a member which didn't ask for them: %v", picks)
+	}
+
+	// members whose rules leave a request unrouted get it when nobody else can
+	atomic.StoreInt32(&rest.closing, 1)
+	atomic.StoreInt32(&canary.closing, 1)
+	if m := g.Route(req("", "")); m != beta {
+		t.Errorf("Request wasn't routed to the only member left")
+	}
+}
+
+// a pair of connected loopback tcp connections
+func testConnPair(t *testing.T) (conn.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped := conn.Wrap(accepted, "pub")
+	t.Cleanup(func() { wrapped.Close() })
+	return wrapped, c
+}
+
+func TestGroupFailoverAccounting(t *testing.T) {
+	testTunnelGlobals(t)
+	g := testGroup("round_robin")
+
+	// the client of the first member can't provide proxy connections
+	failing := &Control{out: make(chan msg.Message, 1), proxies: make(chan conn.Conn)}
+	close(failing.proxies)
+	a := testMember(g, failing, nil)
+
+	// the one of the second echoes whatever the public client sends
+	serving := &Control{out: make(chan msg.Message, 1), proxies: make(chan conn.Conn, 1)}
+	proxyConn, client := testConnPair(t)
+	serving.proxies <- proxyConn
+	b := testMember(g, serving, nil)
+
+	go func() {
+		var startPxy msg.StartProxy
+		if err := msg.ReadMsgInto(conn.Wrap(client, "pxy"), &startPxy); err != nil {
+			return
+		}
+		io.Copy(client, client)
+	}()
+
+	publicConn, public := testConnPair(t)
+	done := make(chan struct{})
+	go func() {
+		a.HandlePublicConnection(publicConn)
+		close(done)
+	}()
+
+	public.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	public.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(public, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("Public client read %q, %v", buf, err)
+	}
+	public.Close()
+	client.Close()
+	<-done
+
+	if _, ok := g.failed[a]; !ok {
+		t.Errorf("Failing member wasn't skipped")
+	}
+
+	for _, c := range []struct {
+		name                string
+		member              *Tunnel
+		connections, active int64
+		bytesIn             int64
+	}{
+		{"failing", a, 0, 0, 0},
+		{"serving", b, 1, 0, 4},
+	} {
+		m := c.member
+		if n := atomic.LoadInt64(&m.connections); n != c.connections {
+			t.Errorf("%s member counted %d connections, expected %d", c.name, n, c.connections)
+		}
+		if n := atomic.LoadInt64(&m.activeConnections); n != c.active {
+			t.Errorf("%s member has %d active connections, expected %d", c.name, n, c.active)
+		}
+		if n := atomic.LoadInt64(&m.bytesIn); n != c.bytesIn {
+			t.Errorf("%s member counted %d bytes in, expected %d", c.name, n, c.bytesIn)
+		}
+	}
+}
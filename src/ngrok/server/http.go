@@ -4,7 +4,9 @@ import (
 	"crypto/tls"
 	"fmt"
 	vhost "github.com/inconshreveable/go-vhost"
+	"io/ioutil"
 	//"net"
+	"net/http"
 	"ngrok/conn"
 	"ngrok/log"
 	"strings"
@@ -12,17 +14,16 @@ import (
 )
 
 const (
-	NotAuthorized = `HTTP/1.0 401 Not Authorized
-WWW-Authenticate: Basic realm="ngrok"
-Content-Length: 23
-
-Authorization required
-`
-
 	NotFound = `HTTP/1.0 404 Not Found
 Content-Length: %d
 
 Tunnel %s not found
+`
+
+	Forbidden = `HTTP/1.0 403 Forbidden
+Content-Length: 10
+
+Forbidden
 `
 
 	BadRequest = `HTTP/1.0 400 Bad Request
@@ -32,11 +33,30 @@ Bad Request
 `
 )
 
+// Writes a complete response to a public connection which is closed afterwards
+func writeHttpResponse(c conn.Conn, status int, header http.Header, body string) error {
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	resp := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+	return resp.Write(c)
+}
+
 // Listens for new http(s) connections from the public internet
 func startHttpListener(addr string, tlsCfg *tls.Config) (listener *conn.Listener) {
-	// bind/listen for incoming connections
+	// bind/listen for incoming connections, https connections are only
+	// decrypted once we know they aren't for a tls tunnel
 	var err error
-	if listener, err = conn.Listen(addr, "pub", tlsCfg); err != nil {
+	if listener, err = conn.Listen(addr, "pub", nil); err != nil {
 		panic(err)
 	}
 
@@ -48,13 +68,94 @@ func startHttpListener(addr string, tlsCfg *tls.Config) (listener *conn.Listener
 	log.Info("Listening for public %s connections on %v", proto, listener.Addr.String())
 	go func() {
 		for conn := range listener.Conns {
-			go httpHandler(conn, proto)
+			if tlsCfg != nil {
+				go httpsHandler(conn, tlsCfg)
+			} else {
+				go httpHandler(conn, proto)
+			}
 		}
 	}()
 
 	return
 }
 
+// Handles a new https connection from the public internet. Connections
+// whose SNI names a tls tunnel, or an https tunnel whose client terminates
+// TLS itself, are passed through still encrypted. The rest are decrypted
+// and handled like http connections.
+func httpsHandler(c conn.Conn, tlsCfg *tls.Config) {
+	defer func() {
+		// recover from failures
+		if r := recover(); r != nil {
+			c.Warn("httpsHandler failed with error %v", r)
+			c.Close()
+		}
+	}()
+
+	// Make sure we detect dead connections while we read the ClientHello
+	c.SetDeadline(time.Now().Add(connReadTimeout))
+
+	// peek at the SNI extension, the vhost library
+	tlsConn, err := vhost.TLS(c)
+	if err != nil {
+		c.Warn("Failed to read valid TLS ClientHello: %v", err)
+		c.Close()
+		return
+	}
+
+	host := strings.ToLower(tlsConn.Host())
+	tlsConn.Free()
+
+	// We need to read from the vhost conn now since it mucked around reading the stream
+	pc := conn.Wrap(tlsConn, "pub")
+
+	if host != "" {
+		tunnel := tunnelRegistry.Get("tls://" + host)
+
+		// so are https tunnels whose client terminates TLS itself
+		if t := tunnelRegistry.Peek("https://" + host); tunnel == nil && t != nil && t.req.ClientTLS {
+			tunnel = tunnelRegistry.Get("https://" + host)
+		}
+
+		if tunnel != nil {
+			if !tunnel.AllowConnection(pc) {
+				pc.Close()
+				return
+			}
+
+			pc.Debug("Passing through TLS connection for %s", host)
+			pc.SetDeadline(time.Time{})
+			tunnel.HandlePublicConnection(pc)
+			return
+		}
+
+		// tunnels on other nodes of the cluster terminate TLS there
+		if cluster != nil && tunnelRegistry.Peek("https://"+host) == nil {
+			if cluster.Forward(pc, "https", "tls://"+host, "https://"+host) {
+				pc.Close()
+				return
+			}
+		}
+	}
+
+	pc.StartTLSServer(tlsCfg)
+	proto, err := pc.Handshake()
+	if err != nil {
+		pc.Warn("TLS handshake failed: %v", err)
+		pc.Close()
+		return
+	}
+
+	// HTTP/2 connections carry streams for any of the hosts the certificate
+	// covers, so they're routed stream by stream instead
+	if proto == "h2" {
+		http2Handler(pc, host)
+		return
+	}
+
+	httpHandler(pc, "https")
+}
+
 // Handles a new http connection from the public internet
 func httpHandler(c conn.Conn, proto string) {
 	defer c.Close()
@@ -76,9 +177,16 @@ func httpHandler(c conn.Conn, proto string) {
 		return
 	}
 
+	// answer ACME challenges for the certificates of https tunnels
+	if proto == "http" && acmeManager != nil && acmeManager.IsChallenge(vhostConn.Request) {
+		acmeManager.ServeChallenge(c, vhostConn.Request)
+		return
+	}
+
 	// read out the Host header and auth from the request
 	host := strings.ToLower(vhostConn.Host())
-	auth := vhostConn.Request.Header.Get("Authorization")
+	req := vhostConn.Request
+	auth := req.Header.Get("Authorization")
 
 	// done reading mux data, free up the request memory
 	vhostConn.Free()
@@ -86,22 +194,50 @@ func httpHandler(c conn.Conn, proto string) {
 	// We need to read from the vhost conn now since it mucked around reading the stream
 	c = conn.Wrap(vhostConn, "pub")
 
-	// multiplex to find the right backend host
+	// multiplex to find the right backend host. The rest of the connection
+	// is proxied as it is, so any requests kept alive on it after this one
+	// reach the same member of a group whatever its routing rules say.
 	c.Debug("Found hostname %s in request", host)
-	tunnel := tunnelRegistry.Get(fmt.Sprintf("%s://%s", proto, host))
+	url := fmt.Sprintf("%s://%s", proto, host)
+	tunnel := tunnelRegistry.Route(url, req)
 	if tunnel == nil {
+		// https connections to other nodes were forwarded before TLS was terminated
+		if cluster != nil && proto == "http" && cluster.Forward(c, proto, url) {
+			return
+		}
+
 		c.Info("No tunnel found for hostname %s", host)
 		c.Write([]byte(fmt.Sprintf(NotFound, len(host)+18, host)))
 		return
 	}
 
+	if !tunnel.AllowConnection(c) {
+		c.Write([]byte(Forbidden))
+		return
+	}
+
 	// If the client specified http auth and it doesn't match this request's auth
 	// then fail the request with 401 Not Authorized and request the client reissue the
-	// request with basic authdeny the request
-	if tunnel.req.HttpAuth != "" && auth != tunnel.req.HttpAuth {
-		c.Info("Authentication failed: %s", auth)
-		c.Write([]byte(NotAuthorized))
-		return
+	// request with credentials
+	if tunnel.httpAuth != nil {
+		if ok, busy := tunnel.httpAuth.Authorize(auth); busy {
+			c.Info("Too many authentication attempts")
+			c.Write([]byte(AuthBusy))
+			return
+		} else if !ok {
+			c.Info("Authentication failed")
+			c.Write([]byte(tunnel.httpAuth.Challenge()))
+			return
+		}
+	}
+
+	// browsers must log in with the tunnel's OpenID Connect provider first
+	if tunnel.oidc != nil {
+		w := &bufferedResponse{header: make(http.Header), status: 200}
+		if !tunnel.oidc.Check(c, w, req, proto, host) {
+			writeHttpResponse(c, w.status, w.header, w.body.String())
+			return
+		}
 	}
 
 	// dead connections will now be handled by tunnel heartbeating and the client
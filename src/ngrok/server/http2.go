@@ -0,0 +1,258 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/net/http2"
+	"io"
+	"net"
+	"net/http"
+	"ngrok/conn"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// how long an HTTP/2 connection without any streams is kept open
+	http2IdleTimeout = 5 * time.Minute
+)
+
+// headers which only apply to a single connection and mustn't be copied
+// between a public HTTP/2 connection and a proxy connection
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Serves a public https connection which negotiated HTTP/2 with ALPN.
+// sni is the hostname the connection was opened for.
+func http2Handler(c conn.Conn, sni string) {
+	defer c.Close()
+	defer func() {
+		// recover from failures
+		if r := recover(); r != nil {
+			c.Warn("http2Handler failed with error %v", r)
+		}
+	}()
+
+	c.Debug("Negotiated HTTP/2 for %s", sni)
+
+	// the http2 server closes the connection once it goes idle
+	c.SetDeadline(time.Time{})
+
+	srv := &http2.Server{IdleTimeout: http2IdleTimeout}
+	srv.ServeConn(c, &http2.ServeConnOpts{
+		Handler: &http2Router{c: c, sni: sni},
+	})
+}
+
+// Routes the streams of a public HTTP/2 connection to tunnels by their
+// :authority, checking each of them like httpHandler checks a connection
+type http2Router struct {
+	c   conn.Conn
+	sni string
+}
+
+func (r *http2Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	c := r.c
+	host := strings.ToLower(req.Host)
+
+	tunnel := tunnelRegistry.Route("https://"+host, req)
+	if tunnel == nil {
+		// browsers reuse connections for every host the certificate covers,
+		// a 421 makes them retry on a connection of its own which is routed
+		// by its SNI, to another node of the cluster if need be
+		hostname := host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			hostname = h
+		}
+		if hostname != r.sni {
+			http.Error(w, "Misdirected request", 421)
+			return
+		}
+
+		c.Info("No tunnel found for hostname %s", host)
+		http.Error(w, fmt.Sprintf("Tunnel %s not found", host), 404)
+		return
+	}
+
+	// tunnels whose client terminates TLS itself can't take streams of a
+	// connection terminated here, on a connection of its own the browser's
+	// request is passed through to the client by its SNI
+	if tunnel.req.ClientTLS {
+		http.Error(w, "Misdirected request", 421)
+		return
+	}
+
+	if atomic.LoadInt32(&tunnel.draining) == 1 {
+		http.Error(w, "Service unavailable", 503)
+		return
+	}
+
+	if !tunnel.AllowConnection(c) {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+
+	if tunnel.httpAuth != nil {
+		if ok, busy := tunnel.httpAuth.Authorize(req.Header.Get("Authorization")); busy {
+			c.Info("Too many authentication attempts")
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many authentication attempts", 429)
+			return
+		} else if !ok {
+			c.Info("Authentication failed")
+			w.Header().Set("WWW-Authenticate", tunnel.httpAuth.WWWAuthenticate())
+			http.Error(w, "Authorization required", 401)
+			return
+		}
+	}
+
+	if tunnel.oidc != nil && !tunnel.oidc.Check(c, w, req, "https", host) {
+		return
+	}
+
+	tunnel.HandlePublicStream(c, w, req)
+}
+
+// Counts the bytes of a request body as they're sent to the client,
+// shaping them by the limiters
+type countingReader struct {
+	io.ReadCloser
+	n        int64
+	limiters []*conn.RateLimiter
+}
+
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	atomic.AddInt64(&r.n, int64(n))
+	for _, l := range r.limiters {
+		l.Wait(n)
+	}
+	return
+}
+
+// Proxies one stream of a public HTTP/2 connection. Each stream gets a
+// proxy connection of its own which carries the request as h2c if the
+// tunnel's app protocol is http2, or else as HTTP/1.1.
+func (t *Tunnel) HandlePublicStream(publicConn conn.Conn, w http.ResponseWriter, req *http.Request) {
+	startTime := time.Now()
+	atomic.AddInt64(&t.activeConnections, 1)
+	served, proxyConn, err := t.startProxy(publicConn.RemoteAddr().String())
+	defer atomic.AddInt64(&served.activeConnections, -1)
+
+	metrics.OpenConnection(served, publicConn)
+	atomic.AddInt64(&served.connections, 1)
+	if err != nil {
+		publicConn.Error("%v", err)
+		http.Error(w, "Bad gateway", 502)
+		return
+	}
+	defer proxyConn.Close()
+
+	// no timeouts while the stream is proxied
+	proxyConn.SetDeadline(time.Time{})
+
+	fromPublic, toPublic := served.rateLimiters()
+	body := &countingReader{ReadCloser: req.Body, limiters: fromPublic}
+	out := req.Clone(req.Context())
+	out.URL.Scheme = "http"
+	out.URL.Host = req.Host
+	out.RequestURI = ""
+	out.Body = body
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+
+	resp, err := served.roundTrip(conn.Limit(proxyConn, toPublic...), out)
+	if err != nil {
+		publicConn.Warn("Failed to proxy HTTP/2 request: %v", err)
+		http.Error(w, "Bad gateway", 502)
+		return
+	}
+	defer resp.Body.Close()
+
+	header := w.Header()
+	for k, vv := range resp.Header {
+		header[k] = vv
+	}
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	// flush as the body arrives so that streaming responses like
+	// those of gRPC reach the public client right away
+	var bytesIn int64
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				break
+			}
+			bytesIn += int64(n)
+			w.(http.Flusher).Flush()
+		}
+
+		if rerr != nil {
+			if rerr != io.EOF {
+				publicConn.Warn("Failed to read HTTP/2 response body: %v", rerr)
+			}
+			break
+		}
+	}
+
+	// trailers are only complete once the body has been read, those like
+	// gRPC's which weren't announced in the header are sent by their prefix
+	for k, vv := range resp.Trailer {
+		header[http.TrailerPrefix+k] = vv
+	}
+
+	bytesOut := atomic.LoadInt64(&body.n)
+	atomic.AddInt64(&served.bytesIn, bytesIn)
+	atomic.AddInt64(&served.bytesOut, bytesOut)
+	metrics.CloseConnection(served, publicConn, startTime, bytesIn, bytesOut)
+}
+
+// Sends a request over a proxy connection and reads the response
+func (t *Tunnel) roundTrip(proxyConn conn.Conn, req *http.Request) (*http.Response, error) {
+	// a request without a User-Agent mustn't get the one of Go's client
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header["User-Agent"] = nil
+	}
+
+	if t.req.AppProtocol == "http2" {
+		tr := &http2.Transport{AllowHTTP: true, DisableCompression: true}
+		cc, err := tr.NewClientConn(proxyConn)
+		if err != nil {
+			return nil, err
+		}
+		return cc.RoundTrip(req)
+	}
+
+	// the request body is written while the response is read, so that
+	// neither side of a streaming exchange waits on the other
+	go func() {
+		if err := req.Write(proxyConn); err != nil {
+			proxyConn.Debug("Failed to write request: %v", err)
+		}
+	}()
+
+	rd := bufio.NewReader(proxyConn)
+	for {
+		resp, err := http.ReadResponse(rd, req)
+		if err != nil {
+			return nil, err
+		}
+
+		// skip informational responses like 100 Continue
+		if resp.StatusCode >= 200 || resp.StatusCode == 101 {
+			return resp, nil
+		}
+	}
+}
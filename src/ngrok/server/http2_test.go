@@ -0,0 +1,210 @@
+package server
+
+import (
+	"golang.org/x/net/http2"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"ngrok/conn"
+	"ngrok/msg"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// Multiplexes the proxy connections of ctl over loopback tcp and serves
+// every proxy stream as h2c with handler, like a client of an http2 tunnel
+func testH2cClient(t *testing.T, ctl *Control, handler http.Handler) {
+	testMuxClient(t, ctl, func(pc conn.Conn) {
+		(&http2.Server{}).ServeConn(pc, &http2.ServeConnOpts{Handler: handler})
+	})
+}
+
+// Multiplexes the proxy connections of ctl over loopback tcp and hands
+// every proxy stream to serve once its StartProxy has been read
+func testMuxClient(t *testing.T, ctl *Control, serve func(pc conn.Conn)) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn := conn.Wrap(<-accepted, "ctl")
+	clientConn := conn.Wrap(c, "ctl")
+	t.Cleanup(func() {
+		serverConn.Close()
+		clientConn.Close()
+	})
+
+	errs := make(chan error, 1)
+	go func() {
+		_, session, err := conn.StartMux(clientConn, false)
+		errs <- err
+		if err != nil {
+			return
+		}
+
+		for {
+			stream, err := session.AcceptStream()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				pc := conn.Wrap(stream, "pxy")
+				var startPxy msg.StartProxy
+				if err := msg.ReadMsgInto(pc, &startPxy); err != nil {
+					pc.Close()
+					return
+				}
+				serve(pc)
+			}()
+		}
+	}()
+
+	if _, ctl.mux, err = conn.StartMux(serverConn, true); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandlePublicStreamTrailers(t *testing.T) {
+	ctl := testTunnelGlobals(t)
+
+	// a gRPC server which announces none of its trailers
+	testH2cClient(t, ctl, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/grpc" {
+			http.Error(w, "Not a gRPC request", 415)
+			return
+		}
+
+		io.Copy(ioutil.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(200)
+		w.Write([]byte("\x00\x00\x00\x00\x02hi"))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+	}))
+
+	tun, err := NewTunnel(&msg.ReqTunnel{Protocol: "https", Subdomain: "grpc", AppProtocol: "http2"}, ctl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Shutdown()
+
+	publicConn := testConn(t, "pub")
+	public := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tun.HandlePublicStream(publicConn, w, r)
+	}))
+	public.EnableHTTP2 = true
+	public.StartTLS()
+	defer public.Close()
+
+	req, _ := http.NewRequest("POST", public.URL+"/helloworld.Greeter/SayHello", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := public.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.ProtoMajor != 2 || resp.StatusCode != 200 || string(body) != "\x00\x00\x00\x00\x02hi" {
+		t.Fatalf("Got %s %d %q", resp.Proto, resp.StatusCode, body)
+	}
+
+	for k, v := range map[string]string{"Grpc-Status": "0", "Grpc-Message": "ok"} {
+		if resp.Trailer.Get(k) != v {
+			t.Errorf("Trailer %s is %q, expected %q (trailers %v)", k, resp.Trailer.Get(k), v, resp.Trailer)
+		}
+	}
+}
+
+func TestHandlePublicStreamBytes(t *testing.T) {
+	ctl := testTunnelGlobals(t)
+	testH2cClient(t, ctl, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.Write([]byte("response from the client"))
+	}))
+
+	tun, err := NewTunnel(&msg.ReqTunnel{Protocol: "https", Subdomain: "bytes", AppProtocol: "http2"}, ctl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Shutdown()
+
+	served := make(chan struct{})
+	publicConn := testConn(t, "pub")
+	public := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tun.HandlePublicStream(publicConn, w, r)
+		close(served)
+	}))
+	public.EnableHTTP2 = true
+	public.StartTLS()
+	defer public.Close()
+
+	resp, err := public.Client().Post(public.URL+"/", "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	<-served
+
+	// bytes in are those the client sent to the public connection, like conn.Join counts them
+	if in, out := atomic.LoadInt64(&tun.bytesIn), atomic.LoadInt64(&tun.bytesOut); in != int64(len(body)) || out != 4 {
+		t.Fatalf("Stream counted %d bytes in and %d bytes out, expected %d and 4", in, out, len(body))
+	}
+}
+
+func TestHttp2RouterMisdirected(t *testing.T) {
+	ctl := testTunnelGlobals(t)
+
+	for _, req := range []*msg.ReqTunnel{
+		{Protocol: "https", Subdomain: "passthrough", ClientTLS: true},
+		{Protocol: "https", Subdomain: "terminated"},
+	} {
+		tun, err := NewTunnel(req, ctl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tun.Shutdown()
+	}
+
+	for _, c := range []struct {
+		sni, host string
+		status    int
+	}{
+		// the tunnel's client terminates TLS, the connection must be its own
+		{"terminated.ngrok.test", "passthrough.ngrok.test", 421},
+		{"passthrough.ngrok.test", "passthrough.ngrok.test", 421},
+		{"terminated.ngrok.test", "missing.ngrok.test", 421},
+		{"missing.ngrok.test", "missing.ngrok.test", 404},
+	} {
+		r := &http2Router{c: testConn(t, "pub"), sni: c.sni}
+		req := httptest.NewRequest("GET", "https://"+c.host+"/", nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != c.status {
+			t.Errorf("Stream for %s on a connection for %s got %d, expected %d", c.host, c.sni, w.Code, c.status)
+		}
+	}
+}
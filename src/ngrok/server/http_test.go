@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"github.com/hashicorp/yamux"
+	"net/http"
+	"ngrok/conn"
+	"ngrok/msg"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Accepts the next proxy stream of a session and reads its StartProxy
+func testAcceptProxy(t *testing.T, session *yamux.Session) (conn.Conn, string) {
+	stream, err := session.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc := conn.Wrap(stream, "pxy")
+
+	var startPxy msg.StartProxy
+	if err := msg.ReadMsgInto(pc, &startPxy); err != nil {
+		t.Fatal(err)
+	}
+	return pc, startPxy.Url
+}
+
+func TestHttpsHandlerPassthrough(t *testing.T) {
+	testControlGlobals(t)
+	serverTLS, clientTLS := testTLSConfig(t), testTLSConfig(t)
+	client, session, _ := testSession(t, true)
+
+	testSessionTunnel(t, client, &msg.ReqTunnel{Protocol: "tls", Subdomain: "pass"})
+	testSessionTunnel(t, client, &msg.ReqTunnel{Protocol: "https", Subdomain: "client", ClientTLS: true})
+	testSessionTunnel(t, client, &msg.ReqTunnel{Protocol: "https", Subdomain: "term"})
+
+	// connects to the https listener and starts a TLS handshake for host
+	dial := func(host string) (*tls.Conn, chan error) {
+		pub, raw := testConnPair(t)
+		go httpsHandler(pub, serverTLS)
+
+		tc := tls.Client(raw, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+		handshake := make(chan error, 1)
+		go func() { handshake <- tc.Handshake() }()
+		return tc, handshake
+	}
+
+	// lets the connection finish before the test replaces the globals
+	finish := func(url string, tc *tls.Conn, pc conn.Conn) {
+		tc.Close()
+		pc.Close()
+		tun := tunnelRegistry.Get(url)
+		for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt64(&tun.activeConnections) != 0 && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// the ClientHello of tls tunnels and https tunnels whose client
+	// terminates TLS itself is passed through, so the public client
+	// shakes hands with the tunnel client
+	for _, host := range []string{"pass.ngrok.test", "client.ngrok.test"} {
+		tc, handshake := dial(host)
+		pc, url := testAcceptProxy(t, session)
+		if err := tls.Server(pc, clientTLS).Handshake(); err != nil {
+			t.Fatalf("%s: tunnel client handshake failed: %v", host, err)
+		}
+		if err := <-handshake; err != nil {
+			t.Fatalf("%s: public handshake failed: %v", host, err)
+		}
+
+		peer := tc.ConnectionState().PeerCertificates[0].Raw
+		if !bytes.Equal(peer, clientTLS.Certificates[0].Certificate[0]) {
+			t.Errorf("%s: TLS was terminated by the server, expected it to be passed through to %s", host, url)
+		}
+		finish(url, tc, pc)
+	}
+
+	// other https tunnels are terminated by the server
+	tc, handshake := dial("term.ngrok.test")
+	if err := <-handshake; err != nil {
+		t.Fatalf("Public handshake failed: %v", err)
+	}
+	if peer := tc.ConnectionState().PeerCertificates[0].Raw; !bytes.Equal(peer, serverTLS.Certificates[0].Certificate[0]) {
+		t.Errorf("TLS wasn't terminated by the server")
+	}
+
+	if _, err := tc.Write([]byte("GET / HTTP/1.1\r\nHost: term.ngrok.test\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	pc, url := testAcceptProxy(t, session)
+	req, err := http.ReadRequest(bufio.NewReader(pc))
+	if err != nil {
+		t.Fatalf("Tunnel client didn't get a plaintext request: %v", err)
+	}
+	if req.Host != "term.ngrok.test" || url != "https://term.ngrok.test" {
+		t.Errorf("Tunnel %s got a request for %s", url, req.Host)
+	}
+	finish(url, tc, pc)
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"ngrok/conn"
+	"ngrok/msg"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHttpAuthRealm = "ngrok"
+
+	// number of successfully verified Authorization headers remembered
+	// per tunnel so that bcrypt doesn't run on every request
+	httpAuthCacheSize = 1024
+
+	// how long an Authorization header which failed is rejected without
+	// being checked again, browsers resend the same one repeatedly
+	httpAuthFailureTTL = 10 * time.Second
+
+	// bcrypt comparisons a second each tunnel makes for headers it hasn't
+	// seen before, so that guessing passwords can't use up the server's CPU.
+	// Headers beyond the rate are turned away instead of waiting their turn.
+	httpAuthHashRate = 20
+
+	NotAuthorized = `HTTP/1.0 401 Not Authorized
+WWW-Authenticate: %s
+Content-Length: 23
+
+Authorization required
+`
+
+	AuthBusy = `HTTP/1.0 429 Too Many Requests
+Retry-After: 1
+Content-Length: 33
+
+Too many authentication attempts
+`
+)
+
+// The credentials http requests to a tunnel must present, either with basic
+// auth as one of the users or as a bearer token. Secrets may be given in
+// plaintext or as bcrypt hashes like those made by htpasswd -B, so that
+// clients don't have to send them to the server in cleartext.
+type httpAuth struct {
+	realm  string
+	users  map[string][]string
+	tokens []string
+
+	// shapes the checks of unknown headers, nil if no secret is hashed
+	hashing *conn.RateLimiter
+
+	sync.Mutex
+	verified map[[sha256.Size]byte]bool
+	failed   map[[sha256.Size]byte]time.Time
+}
+
+func isBcryptHash(secret string) bool {
+	return strings.HasPrefix(secret, "$2a$") || strings.HasPrefix(secret, "$2b$") || strings.HasPrefix(secret, "$2y$")
+}
+
+func checkSecretFormat(secret string) error {
+	if strings.HasPrefix(secret, "$apr1$") || strings.HasPrefix(secret, "{SHA}") {
+		return fmt.Errorf("Only bcrypt password hashes are supported, create them with htpasswd -B")
+	}
+
+	if isBcryptHash(secret) {
+		if _, err := bcrypt.Cost([]byte(secret)); err != nil {
+			return fmt.Errorf("Invalid bcrypt hash: %v", err)
+		}
+	}
+	return nil
+}
+
+// Returns nil if the tunnel doesn't require authentication
+func newHttpAuth(req *msg.ReqTunnel) (*httpAuth, error) {
+	users := req.HttpAuthUsers
+	if req.HttpAuth != "" {
+		users = append([]string{req.HttpAuth}, users...)
+	}
+
+	if len(users) == 0 && len(req.HttpAuthTokens) == 0 {
+		return nil, nil
+	}
+
+	a := &httpAuth{
+		realm:    strings.Replace(req.HttpAuthRealm, `"`, "", -1),
+		users:    make(map[string][]string),
+		tokens:   req.HttpAuthTokens,
+		verified: make(map[[sha256.Size]byte]bool),
+		failed:   make(map[[sha256.Size]byte]time.Time),
+	}
+
+	if a.realm == "" {
+		a.realm = defaultHttpAuthRealm
+	}
+
+	for _, cred := range users {
+		parts := strings.SplitN(cred, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid http auth credential for %s, expected user:password", parts[0])
+		}
+
+		if err := checkSecretFormat(parts[1]); err != nil {
+			return nil, fmt.Errorf("Invalid http auth credential for %s: %v", parts[0], err)
+		}
+		a.users[parts[0]] = append(a.users[parts[0]], parts[1])
+
+		if isBcryptHash(parts[1]) {
+			a.hashing = conn.NewRateLimiter(httpAuthHashRate, 0)
+		}
+	}
+
+	for _, token := range a.tokens {
+		if token == "" {
+			return nil, fmt.Errorf("Empty http auth bearer token")
+		}
+
+		if err := checkSecretFormat(token); err != nil {
+			return nil, fmt.Errorf("Invalid http auth bearer token: %v", err)
+		}
+
+		if isBcryptHash(token) {
+			a.hashing = conn.NewRateLimiter(httpAuthHashRate, 0)
+		}
+	}
+
+	return a, nil
+}
+
+func secretMatches(secret, presented string) bool {
+	if isBcryptHash(secret) {
+		return bcrypt.CompareHashAndPassword([]byte(secret), []byte(presented)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(presented)) == 1
+}
+
+// Checks the value of a request's Authorization header. busy is set if it
+// wasn't checked because the tunnel's hash rate is used up, the request may
+// be retried later.
+func (a *httpAuth) Authorize(header string) (ok, busy bool) {
+	digest := sha256.Sum256([]byte(header))
+
+	a.Lock()
+	ok = a.verified[digest]
+	failedAt, failed := a.failed[digest]
+	a.Unlock()
+	if ok {
+		return true, false
+	}
+	if failed && time.Since(failedAt) < httpAuthFailureTTL {
+		return false, false
+	}
+
+	if !a.hashing.Allow(1) {
+		return false, true
+	}
+	ok = a.check(header)
+
+	a.Lock()
+	defer a.Unlock()
+	if ok {
+		if len(a.verified) >= httpAuthCacheSize {
+			a.verified = make(map[[sha256.Size]byte]bool)
+		}
+		a.verified[digest] = true
+	} else {
+		if len(a.failed) >= httpAuthCacheSize {
+			a.failed = make(map[[sha256.Size]byte]time.Time)
+		}
+		a.failed[digest] = time.Now()
+	}
+	return ok, false
+}
+
+func (a *httpAuth) check(header string) bool {
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	switch strings.ToLower(parts[0]) {
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return false
+		}
+
+		cred := strings.SplitN(string(decoded), ":", 2)
+		if len(cred) != 2 {
+			return false
+		}
+
+		for _, secret := range a.users[cred[0]] {
+			if secretMatches(secret, cred[1]) {
+				return true
+			}
+		}
+
+	case "bearer":
+		token := strings.TrimSpace(parts[1])
+		for _, secret := range a.tokens {
+			if secretMatches(secret, token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// The response asking for credentials
+func (a *httpAuth) Challenge() string {
+	return fmt.Sprintf(NotAuthorized, a.WWWAuthenticate())
+}
+
+// The WWW-Authenticate header of the challenge
+func (a *httpAuth) WWWAuthenticate() string {
+	scheme := "Basic"
+	if len(a.users) == 0 {
+		scheme = "Bearer"
+	}
+	return fmt.Sprintf(`%s realm="%s"`, scheme, a.realm)
+}
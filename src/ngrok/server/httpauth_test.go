@@ -0,0 +1,166 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"ngrok/msg"
+	"testing"
+	"time"
+)
+
+func basicAuth(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+func TestNewHttpAuth(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		req  msg.ReqTunnel
+		ok   bool
+	}{
+		{"none", msg.ReqTunnel{}, true},
+		{"legacy", msg.ReqTunnel{HttpAuth: "user:pass"}, true},
+		{"users", msg.ReqTunnel{HttpAuthUsers: []string{"a:1", "b:$2y$04$Ro0CUfOqk6cXEKf3dyaM7OhSCvnwM9s4wIX9JeLapehKK5YdLxKcm"}}, true},
+		{"tokens", msg.ReqTunnel{HttpAuthTokens: []string{"secret"}}, true},
+		{"no password", msg.ReqTunnel{HttpAuthUsers: []string{"user"}}, false},
+		{"apr1", msg.ReqTunnel{HttpAuthUsers: []string{"user:$apr1$abc$def"}}, false},
+		{"sha", msg.ReqTunnel{HttpAuthUsers: []string{"user:{SHA}abc"}}, false},
+		{"bad bcrypt", msg.ReqTunnel{HttpAuthUsers: []string{"user:$2y$99$x"}}, false},
+		{"empty token", msg.ReqTunnel{HttpAuthTokens: []string{""}}, false},
+	} {
+		a, err := newHttpAuth(&c.req)
+		if c.ok && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+		if c.name == "none" && a != nil {
+			t.Errorf("none: auth required without credentials")
+		}
+	}
+}
+
+func TestHttpAuthAuthorize(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hashed"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenHash, _ := bcrypt.GenerateFromPassword([]byte("hashed-token"), bcrypt.MinCost)
+
+	a, err := newHttpAuth(&msg.ReqTunnel{
+		HttpAuth:       "alice:plain",
+		HttpAuthUsers:  []string{"bob:" + string(hash), "alice:second"},
+		HttpAuthTokens: []string{"token", string(tokenHash)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		header string
+		ok     bool
+	}{
+		{basicAuth("alice", "plain"), true},
+		{basicAuth("alice", "second"), true},
+		{basicAuth("bob", "hashed"), true},
+		{"basic " + base64.StdEncoding.EncodeToString([]byte("bob:hashed")), true},
+		{"Bearer token", true},
+		{"Bearer hashed-token", true},
+		{basicAuth("alice", "hashed"), false},
+		{basicAuth("bob", "plain"), false},
+		{basicAuth("carol", "plain"), false},
+		{"Bearer wrong", false},
+		{"Basic !!!", false},
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("nocolon")), false},
+		{"token", false},
+		{"", false},
+	} {
+		// twice, the second time from the caches
+		for i := 0; i < 2; i++ {
+			if ok, _ := a.Authorize(c.header); ok != c.ok {
+				t.Errorf("Authorize(%q) = %v, expected %v", c.header, ok, c.ok)
+			}
+		}
+	}
+
+	if a.WWWAuthenticate() != `Basic realm="ngrok"` {
+		t.Errorf("Unexpected challenge %s", a.WWWAuthenticate())
+	}
+}
+
+func TestHttpAuthFailureCache(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	a, err := newHttpAuth(&msg.ReqTunnel{HttpAuthUsers: []string{"alice:" + string(hash)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.hashing == nil {
+		t.Fatalf("Checks against bcrypt hashes are not rate limited")
+	}
+
+	header := basicAuth("alice", "guess")
+	if ok, _ := a.Authorize(header); ok {
+		t.Fatalf("Wrong password was accepted")
+	}
+
+	// the failure is remembered so bcrypt doesn't run again for it
+	if _, ok := a.failed[sha256.Sum256([]byte(header))]; !ok {
+		t.Fatalf("Failed header was not remembered")
+	}
+
+	if ok, _ := a.Authorize(basicAuth("alice", "secret")); !ok {
+		t.Fatalf("Right password was rejected after a failure")
+	}
+}
+
+func TestHttpAuthFlood(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	a, err := newHttpAuth(&msg.ReqTunnel{HttpAuthUsers: []string{"alice:" + string(hash)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := basicAuth("alice", "secret")
+	if ok, _ := a.Authorize(valid); !ok {
+		t.Fatalf("Right password was rejected")
+	}
+
+	// guesses beyond the hash rate are turned away right away instead of
+	// queueing, so they can't hold up anyone
+	start := time.Now()
+	var busy int
+	for i := 0; i < 5*httpAuthHashRate; i++ {
+		if _, b := a.Authorize(basicAuth("alice", fmt.Sprint("guess", i))); b {
+			busy++
+		}
+	}
+	if busy == 0 {
+		t.Fatalf("Flood of guesses was never turned away")
+	}
+
+	if ok, b := a.Authorize(valid); !ok || b {
+		t.Fatalf("Cached password was rejected during a flood, busy %v", b)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Flood of guesses took %v", elapsed)
+	}
+}
+
+func TestHttpAuthBearerChallenge(t *testing.T) {
+	a, err := newHttpAuth(&msg.ReqTunnel{HttpAuthTokens: []string{"token"}, HttpAuthRealm: `my "realm"`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.hashing != nil {
+		t.Errorf("Plaintext tokens are rate limited")
+	}
+
+	if a.WWWAuthenticate() != `Bearer realm="my realm"` {
+		t.Errorf("Unexpected challenge %s", a.WWWAuthenticate())
+	}
+}
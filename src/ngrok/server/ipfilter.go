@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// CIDR allow and deny lists which public connections to a tunnel are
+// checked against. Deny entries take precedence, and when there are any
+// allow entries a connection must match one of them.
+type ipFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, entry := range cidrs {
+		cidr := strings.TrimSpace(entry)
+
+		// a bare address is a network of one
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR %s", entry)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Returns nil if there's nothing to filter on
+func newIPFilter(allow, deny []string) (f *ipFilter, err error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	f = new(ipFilter)
+	if f.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func matchesAny(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *ipFilter) Allows(addr net.Addr) bool {
+	if f == nil {
+		return true
+	}
+
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return false
+	}
+
+	if matchesAny(f.deny, ip) {
+		return false
+	}
+
+	return len(f.allow) == 0 || matchesAny(f.allow, ip)
+}
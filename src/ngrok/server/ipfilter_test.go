@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNewIPFilter(t *testing.T) {
+	for _, c := range []struct {
+		allow, deny []string
+		ok          bool
+	}{
+		{nil, nil, true},
+		{[]string{"10.0.0.0/8", " 192.168.1.1 "}, nil, true},
+		{nil, []string{"2001:db8::/32", "::1"}, true},
+		{[]string{"10.0.0.0/33"}, nil, false},
+		{nil, []string{"not an address"}, false},
+		{[]string{"10.0.0.0/8"}, []string{"1.2.3"}, false},
+	} {
+		f, err := newIPFilter(c.allow, c.deny)
+		if c.ok && err != nil {
+			t.Errorf("allow %v deny %v: %v", c.allow, c.deny, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("allow %v deny %v: expected an error", c.allow, c.deny)
+		}
+		if c.ok && c.allow == nil && c.deny == nil && f != nil {
+			t.Errorf("Filter created without any CIDRs")
+		}
+	}
+}
+
+func TestIPFilterAllows(t *testing.T) {
+	f, err := newIPFilter(
+		[]string{"10.0.0.0/8", "192.168.1.1", "2001:db8::/32"},
+		[]string{"10.1.0.0/16", "2001:db8:dead::/48"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcp := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234} }
+	udp := func(ip string) net.Addr { return &net.UDPAddr{IP: net.ParseIP(ip), Port: 1234} }
+
+	for _, c := range []struct {
+		addr net.Addr
+		ok   bool
+	}{
+		{tcp("10.2.3.4"), true},
+		{udp("10.2.3.4"), true},
+		{tcp("::ffff:10.2.3.4"), true},
+		{tcp("192.168.1.1"), true},
+		{tcp("192.168.1.2"), false},
+		{tcp("10.1.2.3"), false},
+		{udp("10.1.2.3"), false},
+		{tcp("2001:db8:1::1"), true},
+		{tcp("2001:db8:dead::1"), false},
+		{tcp("8.8.8.8"), false},
+		{&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, false},
+	} {
+		if ok := f.Allows(c.addr); ok != c.ok {
+			t.Errorf("Allows(%v) = %v, expected %v", c.addr, ok, c.ok)
+		}
+	}
+
+	// deny lists on their own let everything else through
+	f, _ = newIPFilter(nil, []string{"10.0.0.0/8"})
+	if !f.Allows(tcp("8.8.8.8")) || f.Allows(tcp("10.0.0.1")) {
+		t.Errorf("Deny list without an allow list filtered wrongly")
+	}
+
+	var none *ipFilter
+	if !none.Allows(tcp("8.8.8.8")) {
+		t.Errorf("Tunnel without IP restrictions rejected a connection")
+	}
+}
@@ -1,14 +1,17 @@
 package server
 
 import (
-	"crypto/tls"
+	"fmt"
 	"math/rand"
 	"ngrok/conn"
 	log "ngrok/log"
 	"ngrok/msg"
 	"ngrok/util"
 	"os"
+	"os/signal"
 	"runtime/debug"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -21,6 +24,9 @@ const (
 var (
 	tunnelRegistry  *TunnelRegistry
 	controlRegistry *ControlRegistry
+	authenticator   Authenticator
+	policy          *Policy
+	acmeManager     *AcmeManager
 
 	// XXX: kill these global variables - they're only used in tunnel.go for constructing forwarding URLs
 	opts      *Options
@@ -55,13 +61,7 @@ func NewProxy(pxyConn conn.Conn, regPxy *msg.RegProxy) {
 // for ease of deployment. The hope is that by running on port 443, using
 // TLS and running all connections over the same port, we can bust through
 // restrictive firewalls.
-func tunnelListener(addr string, tlsConfig *tls.Config) {
-	// listen for incoming connections
-	listener, err := conn.Listen(addr, "tun", tlsConfig)
-	if err != nil {
-		panic(err)
-	}
-
+func tunnelListener(listener *conn.Listener) {
 	log.Info("Listening for control and proxy connections on %s", listener.Addr.String())
 	for c := range listener.Conns {
 		go func(tunnelConn conn.Conn) {
@@ -73,8 +73,8 @@ func tunnelListener(addr string, tlsConfig *tls.Config) {
 			}()
 
 			tunnelConn.SetReadDeadline(time.Now().Add(connReadTimeout))
-			var rawMsg msg.Message
-			if rawMsg, err = msg.ReadMsg(tunnelConn); err != nil {
+			rawMsg, err := msg.ReadMsg(tunnelConn)
+			if err != nil {
 				tunnelConn.Warn("Failed to read message: %v", err)
 				tunnelConn.Close()
 				return
@@ -86,6 +86,14 @@ func tunnelListener(addr string, tlsConfig *tls.Config) {
 
 			switch m := rawMsg.(type) {
 			case *msg.Auth:
+				// only proxy connections are accepted while draining. The
+				// connection is closed without an AuthResp, which clients
+				// take as fatal, so that they retry until we're back.
+				if atomic.LoadInt32(&serverDraining) == 1 {
+					tunnelConn.Info("Turning away client, the server is shutting down")
+					tunnelConn.Close()
+					return
+				}
 				NewControl(tunnelConn, m)
 
 			case *msg.RegProxy:
@@ -98,10 +106,44 @@ func tunnelListener(addr string, tlsConfig *tls.Config) {
 	}
 }
 
+// Types which can re-read their configuration implement this
+// and are reloaded when ngrokd receives a SIGHUP
+type Reloader interface {
+	Reload() error
+}
+
+func reloadOnHangup(reloaders []Reloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for _ = range hup {
+		log.Info("Got SIGHUP, reloading configuration")
+		for _, r := range reloaders {
+			if err := r.Reload(); err != nil {
+				log.Error("Failed to reload: %v", err)
+			}
+		}
+	}
+}
+
 func Main() {
 	// parse options
 	opts = parseArgs()
 
+	// read the configuration file, flags take precedence over it
+	if err := LoadConfiguration(opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// run a management command instead of the server
+	if len(opts.args) > 0 {
+		if err := runCommand(opts); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// init logging
 	log.LogTo(opts.logto, opts.loglevel)
 
@@ -112,11 +154,40 @@ func Main() {
 	}
 	rand.Seed(seed)
 
+	// init metrics
+	metrics = NewMetrics(opts)
+
 	// init tunnel/control registry
-	registryCacheFile := os.Getenv("REGISTRY_CACHE_FILE")
-	tunnelRegistry = NewTunnelRegistry(registryCacheSize, registryCacheFile)
+	var reservations *ReservationStore
+	if opts.reservations != "" {
+		if reservations, err = OpenReservationStore(opts.reservations); err != nil {
+			panic(err)
+		}
+	}
+
+	tunnelRegistry = NewTunnelRegistry(registryCacheSize, opts.registryCacheFile, reservations)
 	controlRegistry = NewControlRegistry()
 
+	// init authentication
+	if authenticator, err = NewAuthenticator(opts); err != nil {
+		panic(err)
+	}
+
+	// init reservation policy
+	if policy, err = NewPolicy(opts.policy, policyDomain(opts)); err != nil {
+		panic(err)
+	}
+
+	// reload configuration files on SIGHUP
+	reloaders := []Reloader{}
+	if r, ok := authenticator.(Reloader); ok {
+		reloaders = append(reloaders, r)
+	}
+	if opts.policy != "" {
+		reloaders = append(reloaders, policy)
+	}
+	go reloadOnHangup(reloaders)
+
 	// start listeners
 	listeners = make(map[string]*conn.Listener)
 
@@ -126,6 +197,25 @@ func Main() {
 		panic(err)
 	}
 
+	// obtain certificates for https tunnels through ACME
+	if opts.acmeDirectory != "" {
+		if acmeManager, err = NewAcmeManager(opts, tlsConfig); err != nil {
+			panic(err)
+		}
+		tlsConfig.GetCertificate = acmeManager.GetCertificate
+	}
+
+	// public https connections may negotiate HTTP/2, ngrok clients don't
+	httpsConfig := tlsConfig.Clone()
+	httpsConfig.NextProtos = []string{"h2", "http/1.1"}
+
+	// share tunnels with the other nodes of a cluster
+	if opts.clusterRegistry != "" {
+		if cluster, err = NewCluster(opts, httpsConfig); err != nil {
+			panic(err)
+		}
+	}
+
 	// listen for http
 	if opts.httpAddr != "" {
 		listeners["http"] = startHttpListener(opts.httpAddr, nil)
@@ -133,9 +223,21 @@ func Main() {
 
 	// listen for https
 	if opts.httpsAddr != "" {
-		listeners["https"] = startHttpListener(opts.httpsAddr, tlsConfig)
+		listeners["https"] = startHttpListener(opts.httpsAddr, httpsConfig)
+	}
+
+	// admin api
+	if opts.adminAddr != "" {
+		startAdminServer(opts.adminAddr)
 	}
 
 	// ngrok clients
-	tunnelListener(opts.tunnelAddr, tlsConfig)
+	tunListener, err := conn.Listen(opts.tunnelAddr, "tun", tlsConfig)
+	if err != nil {
+		panic(err)
+	}
+	go tunnelListener(tunListener)
+
+	// run until we're told to stop
+	drainOnTerm(tunListener, opts.drainTimeout)
 }
@@ -9,19 +9,21 @@ import (
 	"net/http"
 	"ngrok/conn"
 	"ngrok/log"
-	"os"
 	"time"
 )
 
 var metrics Metrics
 
-func init() {
-	keenApiKey := os.Getenv("KEEN_API_KEY")
-
-	if keenApiKey != "" {
-		metrics = NewKeenIoMetrics(60 * time.Second)
-	} else {
-		metrics = NewLocalMetrics(30 * time.Second)
+func NewMetrics(opts *Options) Metrics {
+	switch {
+	case opts.metrics == "local":
+		return NewLocalMetrics(30 * time.Second)
+	case opts.metrics == "prometheus", opts.metrics == "" && opts.prometheusAddr != "":
+		return NewPrometheusMetrics(opts.prometheusAddr)
+	case opts.metrics == "keen", opts.metrics == "" && opts.keenApiKey != "":
+		return NewKeenIoMetrics(60*time.Second, opts.keenApiKey, opts.keenProjectToken)
+	default:
+		return NewLocalMetrics(30 * time.Second)
 	}
 }
 
@@ -29,8 +31,10 @@ type Metrics interface {
 	log.Logger
 	OpenConnection(*Tunnel, conn.Conn)
 	CloseConnection(*Tunnel, conn.Conn, time.Time, int64, int64)
+	RejectConnection(*Tunnel, conn.Conn)
 	OpenTunnel(*Tunnel)
 	CloseTunnel(*Tunnel)
+	LostHeartbeat(*Control)
 }
 
 type LocalMetrics struct {
@@ -45,6 +49,7 @@ type LocalMetrics struct {
 	tcpTunnelMeter     gometrics.Meter
 	httpTunnelMeter    gometrics.Meter
 	connMeter          gometrics.Meter
+	rejectedConnMeter  gometrics.Meter
 	lostHeartbeatMeter gometrics.Meter
 
 	connTimer gometrics.Timer
@@ -72,6 +77,7 @@ func NewLocalMetrics(reportInterval time.Duration) *LocalMetrics {
 		tcpTunnelMeter:     gometrics.NewMeter(),
 		httpTunnelMeter:    gometrics.NewMeter(),
 		connMeter:          gometrics.NewMeter(),
+		rejectedConnMeter:  gometrics.NewMeter(),
 		lostHeartbeatMeter: gometrics.NewMeter(),
 
 		connTimer: gometrics.NewTimer(),
@@ -125,6 +131,14 @@ func (m *LocalMetrics) CloseConnection(t *Tunnel, c conn.Conn, start time.Time,
 	m.bytesOutCount.Inc(bytesOut)
 }
 
+func (m *LocalMetrics) RejectConnection(t *Tunnel, c conn.Conn) {
+	m.rejectedConnMeter.Mark(1)
+}
+
+func (m *LocalMetrics) LostHeartbeat(c *Control) {
+	m.lostHeartbeatMeter.Mark(1)
+}
+
 func (m *LocalMetrics) Report() {
 	m.Info("Reporting every %d seconds", int(m.reportInterval.Seconds()))
 
@@ -141,8 +155,10 @@ func (m *LocalMetrics) Report() {
 			"tunnelMeter.m1":        m.tunnelMeter.Rate1(),
 			"connMeter.count":       m.connMeter.Count(),
 			"connMeter.m1":          m.connMeter.Rate1(),
+			"rejectedConns.count":   m.rejectedConnMeter.Count(),
 			"bytesIn.count":         m.bytesInCount.Count(),
 			"bytesOut.count":        m.bytesOutCount.Count(),
+			"lostHeartbeats.count":  m.lostHeartbeatMeter.Count(),
 		})
 
 		if err != nil {
@@ -167,11 +183,11 @@ type KeenIoMetrics struct {
 	Metrics      chan *KeenIoMetric
 }
 
-func NewKeenIoMetrics(batchInterval time.Duration) *KeenIoMetrics {
+func NewKeenIoMetrics(batchInterval time.Duration, apiKey, projectToken string) *KeenIoMetrics {
 	k := &KeenIoMetrics{
 		Logger:       log.NewPrefixLogger("metrics"),
-		ApiKey:       os.Getenv("KEEN_API_KEY"),
-		ProjectToken: os.Getenv("KEEN_PROJECT_TOKEN"),
+		ApiKey:       apiKey,
+		ProjectToken: projectToken,
 		Metrics:      make(chan *KeenIoMetric, 1000),
 	}
 
@@ -273,12 +289,12 @@ func (k *KeenIoMetrics) CloseConnection(t *Tunnel, c conn.Conn, start time.Time,
 			Timestamp: start.UTC().Format("2006-01-02T15:04:05.000Z"),
 		},
 		OS:                 t.ctl.auth.OS,
-		ClientId:           t.ctl.id,
+		ClientId:           t.ctl.Id(),
 		Protocol:           t.req.Protocol,
 		Url:                t.url,
-		User:               t.ctl.auth.User,
+		User:               t.ctl.account.User,
 		Version:            t.ctl.auth.MmVersion,
-		HttpAuth:           t.req.HttpAuth != "",
+		HttpAuth:           t.httpAuth != nil,
 		Subdomain:          t.req.Subdomain != "",
 		TunnelDuration:     time.Since(t.start).Seconds(),
 		ConnectionDuration: time.Since(start).Seconds(),
@@ -292,6 +308,12 @@ func (k *KeenIoMetrics) CloseConnection(t *Tunnel, c conn.Conn, start time.Time,
 func (k *KeenIoMetrics) OpenTunnel(t *Tunnel) {
 }
 
+func (k *KeenIoMetrics) RejectConnection(t *Tunnel, c conn.Conn) {
+}
+
+func (k *KeenIoMetrics) LostHeartbeat(c *Control) {
+}
+
 type KeenStruct struct {
 	Timestamp string `json:"timestamp"`
 }
@@ -314,14 +336,14 @@ func (k *KeenIoMetrics) CloseTunnel(t *Tunnel) {
 			Timestamp: t.start.UTC().Format("2006-01-02T15:04:05.000Z"),
 		},
 		OS:       t.ctl.auth.OS,
-		ClientId: t.ctl.id,
+		ClientId: t.ctl.Id(),
 		Protocol: t.req.Protocol,
 		Url:      t.url,
-		User:     t.ctl.auth.User,
+		User:     t.ctl.account.User,
 		Version:  t.ctl.auth.MmVersion,
 		//Reason: reason,
 		Duration:  time.Since(t.start).Seconds(),
-		HttpAuth:  t.req.HttpAuth != "",
+		HttpAuth:  t.httpAuth != nil,
 		Subdomain: t.req.Subdomain != "",
 	}
 
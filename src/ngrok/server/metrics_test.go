@@ -0,0 +1,29 @@
+package server
+
+import (
+	"encoding/json"
+	"ngrok/msg"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeenIoMetricsUser(t *testing.T) {
+	ctl := testTunnelGlobals(t)
+	ctl.auth.User = "s3cret-token"
+	ctl.account.User = "alice"
+	tun := &Tunnel{ctl: ctl, req: &msg.ReqTunnel{Protocol: "http"}, url: "http://foo.ngrok.test", start: time.Now()}
+
+	k := &KeenIoMetrics{Metrics: make(chan *KeenIoMetric, 2)}
+	k.CloseConnection(tun, testConn(t, "pub"), time.Now(), 1, 2)
+	k.CloseTunnel(tun)
+
+	// events name the account the token authenticated, never the token itself
+	for i := 0; i < 2; i++ {
+		m := <-k.Metrics
+		buf, _ := json.Marshal(m.Event)
+		if strings.Contains(string(buf), "s3cret-token") || !strings.Contains(string(buf), `"User":"alice"`) {
+			t.Errorf("%s event reports the wrong user: %s", m.Collection, buf)
+		}
+	}
+}
@@ -0,0 +1,426 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/url"
+	"ngrok/conn"
+	"ngrok/msg"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcCallbackPath    = "/_ngrok/oidc/callback"
+	oidcSessionCookie   = "ngrok_session"
+	oidcStateCookie     = "ngrok_oidc_state"
+	oidcSessionDuration = 12 * time.Hour
+	oidcLoginTimeout    = 10 * time.Minute
+	oidcRequestTimeout  = 10 * time.Second
+
+	// how long a provider's discovery document is used before it's fetched
+	// again, and how many providers are kept at most
+	oidcProviderTTL  = time.Hour
+	oidcMaxProviders = 64
+)
+
+var (
+	// signs session and state cookies, sessions don't outlive the process
+	oidcCookieKey     []byte
+	oidcCookieKeyOnce sync.Once
+
+	// providers by issuer, so that discovery documents and signing keys
+	// are shared by all of the tunnels using the same provider
+	oidcProviders     = make(map[string]*oidcProviderEntry)
+	oidcProvidersLock sync.Mutex
+)
+
+// A provider being discovered or discovered already. Tunnels asking for
+// an issuer which is being discovered wait for that discovery instead of
+// starting another one.
+type oidcProviderEntry struct {
+	done     chan struct{}
+	provider *oidc.Provider
+	err      error
+	fetched  time.Time
+}
+
+func cookieKey() []byte {
+	oidcCookieKeyOnce.Do(func() {
+		oidcCookieKey = make([]byte, 32)
+		if _, err := rand.Read(oidcCookieKey); err != nil {
+			panic(err)
+		}
+	})
+	return oidcCookieKey
+}
+
+// Whether the operator allows tunnels to log in with the issuer. Unless
+// they listed the issuers, any issuer served over https is allowed.
+func oidcIssuerAllowed(issuer string) bool {
+	if opts != nil && len(opts.oidcIssuers) > 0 {
+		for _, allowed := range opts.oidcIssuers {
+			if strings.TrimSuffix(allowed, "/") == strings.TrimSuffix(issuer, "/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	u, err := url.Parse(issuer)
+	return err == nil && u.Scheme == "https" && u.Host != ""
+}
+
+func getOidcProvider(issuer string) (*oidc.Provider, error) {
+	if !oidcIssuerAllowed(issuer) {
+		return nil, fmt.Errorf("The OIDC issuer %s is not allowed on this server", issuer)
+	}
+
+	oidcProvidersLock.Lock()
+	e, ok := oidcProviders[issuer]
+	if !ok || (e.fetched != (time.Time{}) && time.Since(e.fetched) > oidcProviderTTL) {
+		e = &oidcProviderEntry{done: make(chan struct{})}
+		evictOidcProviders()
+		oidcProviders[issuer] = e
+		oidcProvidersLock.Unlock()
+
+		// discover outside of the lock, a slow provider mustn't hold up
+		// tunnels using other providers. The provider keeps the context
+		// to fetch its signing keys with later on, so it's bounded by a
+		// client timeout instead of being cancelled.
+		ctx := oidc.ClientContext(context.Background(), &http.Client{Timeout: oidcRequestTimeout})
+		e.provider, e.err = oidc.NewProvider(ctx, issuer)
+
+		oidcProvidersLock.Lock()
+		if e.err != nil {
+			// failures aren't cached so that the next tunnel tries again
+			if oidcProviders[issuer] == e {
+				delete(oidcProviders, issuer)
+			}
+		} else {
+			e.fetched = time.Now()
+		}
+		close(e.done)
+	}
+	oidcProvidersLock.Unlock()
+
+	<-e.done
+	return e.provider, e.err
+}
+
+// Makes room for another provider by dropping expired ones and, if that
+// isn't enough, the one fetched the longest ago. Providers still being
+// discovered are kept. The caller must hold the lock.
+func evictOidcProviders() {
+	var oldest string
+	for issuer, e := range oidcProviders {
+		if e.fetched == (time.Time{}) {
+			continue
+		}
+
+		if time.Since(e.fetched) > oidcProviderTTL {
+			delete(oidcProviders, issuer)
+		} else if oldest == "" || e.fetched.Before(oidcProviders[oldest].fetched) {
+			oldest = issuer
+		}
+	}
+
+	if len(oidcProviders) >= oidcMaxProviders && oldest != "" {
+		delete(oidcProviders, oldest)
+	}
+}
+
+// Signs a cookie value with the cookie key: <base64 payload>.<base64 signature>
+func signCookie(v interface{}) (string, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, cookieKey())
+	mac.Write(payload)
+
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(mac.Sum(nil)), nil
+}
+
+func verifyCookie(value string, v interface{}) error {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("Malformed cookie")
+	}
+
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return err
+	}
+
+	sig, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, cookieKey())
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return fmt.Errorf("Bad cookie signature")
+	}
+
+	return json.Unmarshal(payload, v)
+}
+
+// Contents of the session cookie set once a browser has logged in
+type oidcSession struct {
+	Host    string
+	Subject string
+	Email   string
+	Expires int64
+}
+
+// Contents of the cookie which carries a login across the redirect to the provider
+type oidcState struct {
+	Host    string
+	State   string
+	Return  string
+	Expires int64
+}
+
+// An OpenID Connect login gate in front of an http tunnel. Browsers
+// without a valid session are redirected to the provider, which sends
+// them back to the callback path on the tunnel's own host. Once the
+// ID token checks out, the browser gets a signed session cookie and its
+// requests are passed on to the tunnel.
+type oidcGate struct {
+	opts     *msg.OidcOptions
+	provider *oidc.Provider
+	verifier *oidc.IDTokenVerifier
+}
+
+// Returns nil if the tunnel doesn't require a login
+func newOidcGate(opts *msg.OidcOptions) (*oidcGate, error) {
+	if opts == nil {
+		return nil, nil
+	}
+
+	if opts.Issuer == "" || opts.ClientId == "" {
+		return nil, fmt.Errorf("An OIDC login requires an issuer and a client id")
+	}
+
+	provider, err := getOidcProvider(opts.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to discover OIDC provider %s: %v", opts.Issuer, err)
+	}
+
+	return &oidcGate{
+		opts:     opts,
+		provider: provider,
+		verifier: provider.Verifier(&oidc.Config{ClientID: opts.ClientId}),
+	}, nil
+}
+
+func (g *oidcGate) oauthConfig(proto, host string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     g.opts.ClientId,
+		ClientSecret: g.opts.ClientSecret,
+		Endpoint:     g.provider.Endpoint(),
+		RedirectURL:  fmt.Sprintf("%s://%s%s", proto, host, oidcCallbackPath),
+		Scopes:       []string{oidc.ScopeOpenID, "email"},
+	}
+}
+
+// Whether the logged in identity may use the tunnel
+func (g *oidcGate) allows(subject, email string, emailVerified bool) bool {
+	if len(g.opts.Subjects) == 0 && len(g.opts.EmailDomains) == 0 {
+		return true
+	}
+
+	for _, s := range g.opts.Subjects {
+		if s == subject {
+			return true
+		}
+	}
+
+	if emailVerified {
+		if at := strings.LastIndex(email, "@"); at >= 0 {
+			domain := strings.ToLower(email[at+1:])
+			for _, d := range g.opts.EmailDomains {
+				if strings.ToLower(d) == domain {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// Checks a request to the tunnel. Returns true if the browser is logged in,
+// otherwise it answers the request itself with w.
+func (g *oidcGate) Check(c conn.Conn, w http.ResponseWriter, req *http.Request, proto, host string) bool {
+	if req.URL.Path == oidcCallbackPath {
+		g.callback(c, w, req, proto, host)
+		return false
+	}
+
+	if cookie, err := req.Cookie(oidcSessionCookie); err == nil {
+		var s oidcSession
+		if err = verifyCookie(cookie.Value, &s); err == nil && s.Host == host && time.Now().Unix() < s.Expires {
+			c.Debug("OIDC session for %s", s.Subject)
+			return true
+		}
+	}
+
+	g.login(c, w, req, proto, host)
+	return false
+}
+
+// Redirects the browser to the provider to log in
+func (g *oidcGate) login(c conn.Conn, w http.ResponseWriter, req *http.Request, proto, host string) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	state := &oidcState{
+		Host:    host,
+		State:   base64.RawURLEncoding.EncodeToString(nonce),
+		Return:  req.URL.RequestURI(),
+		Expires: time.Now().Add(oidcLoginTimeout).Unix(),
+	}
+
+	value, err := signCookie(state)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	authUrl := g.oauthConfig(proto, host).AuthCodeURL(state.State, oidc.Nonce(state.State))
+
+	header := w.Header()
+	header.Set("Location", authUrl)
+	header.Add("Set-Cookie", (&http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(oidcLoginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   proto == "https",
+	}).String())
+
+	c.Info("Redirecting to OIDC provider %s to log in", g.opts.Issuer)
+	w.WriteHeader(302)
+}
+
+// Handles the provider redirecting the browser back to the tunnel
+func (g *oidcGate) callback(c conn.Conn, w http.ResponseWriter, req *http.Request, proto, host string) {
+	fail := func(status int, reason string, err error) {
+		c.Warn("OIDC login failed: %s: %v", reason, err)
+		http.Error(w, reason, status)
+	}
+
+	var state oidcState
+	cookie, err := req.Cookie(oidcStateCookie)
+	if err == nil {
+		err = verifyCookie(cookie.Value, &state)
+	}
+	if err != nil {
+		fail(400, "Missing or invalid login state", err)
+		return
+	}
+
+	query := req.URL.Query()
+	if state.Host != host || time.Now().Unix() > state.Expires ||
+		subtle.ConstantTimeCompare([]byte(state.State), []byte(query.Get("state"))) != 1 {
+		fail(400, "Login state mismatch, please try again", nil)
+		return
+	}
+
+	if e := query.Get("error"); e != "" {
+		fail(403, "Login failed", fmt.Errorf("%s: %s", e, query.Get("error_description")))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), oidcRequestTimeout)
+	defer cancel()
+
+	token, err := g.oauthConfig(proto, host).Exchange(ctx, query.Get("code"))
+	if err != nil {
+		fail(502, "Failed to exchange the authorization code", err)
+		return
+	}
+
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		fail(502, "The provider did not return an ID token", nil)
+		return
+	}
+
+	idToken, err := g.verifier.Verify(ctx, rawIdToken)
+	if err != nil {
+		fail(403, "Invalid ID token", err)
+		return
+	}
+
+	if idToken.Nonce != state.State {
+		fail(403, "Invalid ID token", fmt.Errorf("nonce mismatch"))
+		return
+	}
+
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err = idToken.Claims(&claims); err != nil {
+		fail(502, "Invalid ID token claims", err)
+		return
+	}
+
+	if !g.allows(idToken.Subject, claims.Email, claims.EmailVerified) {
+		fail(403, "You are not allowed to access this tunnel", fmt.Errorf("subject %s, email %s", idToken.Subject, claims.Email))
+		return
+	}
+
+	value, err := signCookie(&oidcSession{
+		Host:    host,
+		Subject: idToken.Subject,
+		Email:   claims.Email,
+		Expires: time.Now().Add(oidcSessionDuration).Unix(),
+	})
+	if err != nil {
+		fail(500, "Internal server error", err)
+		return
+	}
+
+	// only return to paths on this host
+	returnTo := state.Return
+	if u, err := url.Parse(returnTo); err != nil || u.Host != "" || !strings.HasPrefix(returnTo, "/") {
+		returnTo = "/"
+	}
+
+	header := w.Header()
+	header.Set("Location", returnTo)
+	header.Add("Set-Cookie", (&http.Cookie{
+		Name:     oidcSessionCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(oidcSessionDuration.Seconds()),
+		HttpOnly: true,
+		Secure:   proto == "https",
+	}).String())
+	header.Add("Set-Cookie", (&http.Cookie{Name: oidcStateCookie, Path: "/", MaxAge: -1}).String())
+
+	c.Info("OIDC login by %s (%s)", idToken.Subject, claims.Email)
+	w.WriteHeader(302)
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"ngrok/msg"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A mock OpenID Connect provider which logs everyone in as subject,
+// signing its ID tokens with an RSA key it publishes
+type testIdp struct {
+	*httptest.Server
+	key         *rsa.PrivateKey
+	discoveries int32
+
+	sync.Mutex
+	subject string
+	nonce   string
+}
+
+func newTestIdp(t *testing.T) *testIdp {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &testIdp{key: key, subject: "alice"}
+	idp.Server = httptest.NewServer(http.HandlerFunc(idp.serve))
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *testIdp) serve(w http.ResponseWriter, r *http.Request) {
+	enc := base64.RawURLEncoding
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		atomic.AddInt32(&idp.discoveries, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+
+	case "/jwks":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   enc.EncodeToString(idp.key.N.Bytes()),
+				"e":   enc.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+			}},
+		})
+
+	case "/token":
+		idp.Lock()
+		claims, _ := json.Marshal(map[string]interface{}{
+			"iss":            idp.URL,
+			"sub":            idp.subject,
+			"aud":            "ngrok",
+			"exp":            time.Now().Add(time.Hour).Unix(),
+			"iat":            time.Now().Unix(),
+			"nonce":          idp.nonce,
+			"email":          idp.subject + "@example.com",
+			"email_verified": true,
+		})
+		idp.Unlock()
+
+		signed := enc.EncodeToString([]byte(`{"alg":"RS256","kid":"test"}`)) + "." + enc.EncodeToString(claims)
+		digest := sha256.Sum256([]byte(signed))
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     signed + "." + enc.EncodeToString(sig),
+		})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Runs a request through the gate, returns whether it was let through and
+// the response the gate answered it with otherwise
+func checkOidc(t *testing.T, g *oidcGate, target string, cookies []*http.Cookie) (bool, *bufferedResponse) {
+	req, _ := http.NewRequest("GET", target, nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+
+	w := &bufferedResponse{header: make(http.Header), status: 200}
+	ok := g.Check(testConn(t, "pub"), w, req, "http", req.URL.Host)
+	return ok, w
+}
+
+func responseCookies(w *bufferedResponse) []*http.Cookie {
+	return (&http.Response{Header: w.header}).Cookies()
+}
+
+func TestOidcLogin(t *testing.T) {
+	idp := newTestIdp(t)
+	opts = &Options{oidcIssuers: []string{idp.URL}}
+
+	for _, c := range []struct {
+		subject  string
+		gate     msg.OidcOptions
+		loggedIn bool
+	}{
+		{"alice", msg.OidcOptions{}, true},
+		{"alice", msg.OidcOptions{Subjects: []string{"bob", "alice"}}, true},
+		{"alice", msg.OidcOptions{EmailDomains: []string{"EXAMPLE.com"}}, true},
+		{"alice", msg.OidcOptions{Subjects: []string{"bob"}}, false},
+		{"alice", msg.OidcOptions{EmailDomains: []string{"example.org"}}, false},
+	} {
+		gateOpts := c.gate
+		gateOpts.Issuer = idp.URL
+		gateOpts.ClientId = "ngrok"
+		g, err := newOidcGate(&gateOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// browsers without a session are sent to the provider
+		ok, w := checkOidc(t, g, "http://foo.ngrok.test/page?x=1", nil)
+		if ok || w.status != 302 {
+			t.Fatalf("Request without a session got %d, expected a redirect", w.status)
+		}
+
+		auth, err := url.Parse(w.header.Get("Location"))
+		if err != nil || !strings.HasPrefix(auth.String(), idp.URL+"/authorize") {
+			t.Fatalf("Redirected to %s instead of the provider", w.header.Get("Location"))
+		}
+		query := auth.Query()
+
+		idp.Lock()
+		idp.subject, idp.nonce = c.subject, query.Get("nonce")
+		idp.Unlock()
+
+		// the provider sends the browser back with a code
+		callback := fmt.Sprintf("http://foo.ngrok.test%s?code=abc&state=%s", oidcCallbackPath, url.QueryEscape(query.Get("state")))
+		_, w = checkOidc(t, g, callback, responseCookies(w))
+		if !c.loggedIn {
+			if w.status != 403 {
+				t.Errorf("%+v: login was answered with %d, expected 403", c.gate, w.status)
+			}
+			continue
+		}
+
+		if w.status != 302 || w.header.Get("Location") != "/page?x=1" {
+			t.Fatalf("%+v: callback answered %d to %s: %s", c.gate, w.status, w.header.Get("Location"), w.body.String())
+		}
+
+		session := responseCookies(w)
+		if ok, _ = checkOidc(t, g, "http://foo.ngrok.test/page", session); !ok {
+			t.Errorf("%+v: logged in request was not let through", c.gate)
+		}
+
+		// sessions are only good for the host they were made for
+		if ok, _ = checkOidc(t, g, "http://bar.ngrok.test/page", session); ok {
+			t.Errorf("%+v: session was accepted for another host", c.gate)
+		}
+	}
+
+	// a forged state is rejected
+	g, _ := newOidcGate(&msg.OidcOptions{Issuer: idp.URL, ClientId: "ngrok"})
+	_, w := checkOidc(t, g, "http://foo.ngrok.test/", nil)
+	_, w = checkOidc(t, g, "http://foo.ngrok.test"+oidcCallbackPath+"?code=abc&state=forged", responseCookies(w))
+	if w.status != 400 {
+		t.Errorf("Callback with a forged state answered %d, expected 400", w.status)
+	}
+}
+
+func TestOidcProviderCache(t *testing.T) {
+	idp := newTestIdp(t)
+	opts = &Options{oidcIssuers: []string{idp.URL}}
+
+	// concurrent tunnels share a single discovery
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := getOidcProvider(idp.URL); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&idp.discoveries); n != 1 {
+		t.Errorf("Provider was discovered %d times, expected once", n)
+	}
+
+	// expired providers are discovered again
+	oidcProvidersLock.Lock()
+	oidcProviders[idp.URL].fetched = time.Now().Add(-2 * oidcProviderTTL)
+	oidcProvidersLock.Unlock()
+	if _, err := getOidcProvider(idp.URL); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&idp.discoveries); n != 2 {
+		t.Errorf("Expired provider was not discovered again")
+	}
+
+	// the cache is bounded
+	oidcProvidersLock.Lock()
+	for i := 0; i < 2*oidcMaxProviders; i++ {
+		evictOidcProviders()
+		oidcProviders[fmt.Sprintf("https://idp%d.test", i)] = &oidcProviderEntry{fetched: time.Now()}
+	}
+	n := len(oidcProviders)
+	oidcProvidersLock.Unlock()
+	if n > oidcMaxProviders {
+		t.Errorf("%d providers are cached, expected at most %d", n, oidcMaxProviders)
+	}
+}
+
+func TestOidcIssuerAllowed(t *testing.T) {
+	for _, c := range []struct {
+		allowed []string
+		issuer  string
+		ok      bool
+	}{
+		{nil, "https://accounts.example.com", true},
+		{nil, "http://accounts.example.com", false},
+		{nil, "http://169.254.169.254", false},
+		{nil, "accounts.example.com", false},
+		{[]string{"https://a.example.com/"}, "https://a.example.com", true},
+		{[]string{"https://a.example.com"}, "https://b.example.com", false},
+		{[]string{"http://127.0.0.1:5556/dex"}, "http://127.0.0.1:5556/dex", true},
+	} {
+		opts = &Options{oidcIssuers: c.allowed}
+		if ok := oidcIssuerAllowed(c.issuer); ok != c.ok {
+			t.Errorf("oidcIssuerAllowed(%s) with %v = %v, expected %v", c.issuer, c.allowed, ok, c.ok)
+		}
+	}
+
+	opts = &Options{oidcIssuers: []string{"https://a.example.com"}}
+	if _, err := newOidcGate(&msg.OidcOptions{Issuer: "https://b.example.com", ClientId: "ngrok"}); err == nil {
+		t.Errorf("Gate was created for an issuer which isn't allowed")
+	}
+}
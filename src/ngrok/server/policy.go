@@ -0,0 +1,246 @@
+package server
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v1"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"ngrok/log"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Policy reserves hostnames, subdomains and TCP/UDP ports to specific users.
+// A reserved name may only be registered by the user(s) who reserved it;
+// anything not reserved is handed out first-come-first-served.
+//
+// Reservations are read from a YAML file keyed by user name:
+//
+//	alice:
+//	  hostnames: ["*.alice.example.com", "www.example.org"]
+//	  subdomains: ["api", "alice-*"]
+//	  ports: ["2222", "10000-10099"]
+//
+// Hostname and subdomain entries are shell patterns as understood by path.Match.
+// Subdomain entries are matched against the part of a hostname in front of
+// the server's domain, so they also guard against requesting the full hostname.
+type Policy struct {
+	log.Logger
+	sync.RWMutex
+	path   string
+	domain string
+	rules  []*userRules
+}
+
+type reservation struct {
+	Hostnames  []string      `yaml:"hostnames,omitempty"`
+	Subdomains []string      `yaml:"subdomains,omitempty"`
+	Ports      []interface{} `yaml:"ports,omitempty"`
+}
+
+type portRange struct {
+	low, high int
+}
+
+type userRules struct {
+	user       string
+	hostnames  []string
+	subdomains []string
+	ports      []portRange
+}
+
+// Create a new policy from the given file. If path is empty, the policy
+// has no reservations.
+func NewPolicy(policyPath string, domain string) (*Policy, error) {
+	p := &Policy{
+		Logger: log.NewPrefixLogger("policy"),
+		path:   policyPath,
+		domain: strings.ToLower(domain),
+	}
+
+	if policyPath == "" {
+		return p, nil
+	}
+
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *Policy) Reload() error {
+	buf, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return fmt.Errorf("Failed to read policy file %s: %v", p.path, err)
+	}
+
+	reservations := make(map[string]*reservation)
+	if err = yaml.Unmarshal(buf, &reservations); err != nil {
+		return fmt.Errorf("Error parsing policy file %s: %v", p.path, err)
+	}
+
+	rules := make([]*userRules, 0, len(reservations))
+	for user, res := range reservations {
+		if res == nil {
+			continue
+		}
+
+		r, err := parseReservation(user, res)
+		if err != nil {
+			return fmt.Errorf("Policy file %s, user %s: %v", p.path, user, err)
+		}
+		rules = append(rules, r)
+	}
+
+	p.Lock()
+	p.rules = rules
+	p.Unlock()
+
+	p.Info("Loaded reservations for %d users from %s", len(rules), p.path)
+	return nil
+}
+
+func parseReservation(user string, res *reservation) (r *userRules, err error) {
+	r = &userRules{user: user}
+
+	validPattern := func(pattern string) (string, error) {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if _, err := path.Match(pattern, ""); err != nil {
+			return "", fmt.Errorf("invalid pattern '%s': %v", pattern, err)
+		}
+		return pattern, nil
+	}
+
+	for _, h := range res.Hostnames {
+		if h, err = validPattern(h); err != nil {
+			return
+		}
+		r.hostnames = append(r.hostnames, h)
+	}
+
+	for _, s := range res.Subdomains {
+		if s, err = validPattern(s); err != nil {
+			return
+		}
+		r.subdomains = append(r.subdomains, s)
+	}
+
+	for _, raw := range res.Ports {
+		var pr portRange
+		if pr, err = parsePortRange(fmt.Sprint(raw)); err != nil {
+			return
+		}
+		r.ports = append(r.ports, pr)
+	}
+
+	return
+}
+
+// Parses a single port "2222" or an inclusive range "10000-10099"
+func parsePortRange(s string) (pr portRange, err error) {
+	parts := strings.SplitN(strings.TrimSpace(s), "-", 2)
+	if pr.low, err = strconv.Atoi(parts[0]); err != nil {
+		return pr, fmt.Errorf("invalid port range '%s'", s)
+	}
+
+	pr.high = pr.low
+	if len(parts) == 2 {
+		if pr.high, err = strconv.Atoi(parts[1]); err != nil {
+			return pr, fmt.Errorf("invalid port range '%s'", s)
+		}
+	}
+
+	if pr.low < 1 || pr.high > 65535 || pr.low > pr.high {
+		return pr, fmt.Errorf("invalid port range '%s'", s)
+	}
+
+	return
+}
+
+func (r *userRules) matchesHost(host, domain string) bool {
+	for _, pattern := range r.hostnames {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+
+	if strings.HasSuffix(host, "."+domain) {
+		subdomain := host[:len(host)-len(domain)-1]
+		for _, pattern := range r.subdomains {
+			if ok, _ := path.Match(pattern, subdomain); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (r *userRules) matchesPort(port int) bool {
+	for _, pr := range r.ports {
+		if port >= pr.low && port <= pr.high {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize returns an error if the tunnel url is reserved and the user
+// is not one of the users who reserved it.
+func (p *Policy) Authorize(user string, tunnelUrl string) error {
+	u, err := url.Parse(tunnelUrl)
+	if err != nil {
+		return err
+	}
+
+	host, portStr, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		// no port in the url
+		host = u.Host
+	}
+	host = strings.ToLower(host)
+
+	p.RLock()
+	defer p.RUnlock()
+
+	reserved := false
+	for _, r := range p.rules {
+		var matches bool
+		if u.Scheme == "tcp" || u.Scheme == "udp" {
+			port, _ := strconv.Atoi(portStr)
+			matches = r.matchesPort(port)
+		} else {
+			matches = r.matchesHost(host, p.domain)
+		}
+
+		if matches {
+			if r.user == user {
+				return nil
+			}
+			reserved = true
+		}
+	}
+
+	if reserved {
+		return fmt.Errorf("The tunnel %s is reserved for another account.", tunnelUrl)
+	}
+
+	return nil
+}
+
+// The domain that subdomain reservations are relative to
+func policyDomain(opts *Options) string {
+	vhost := opts.vhost
+	if vhost == "" {
+		return opts.domain
+	}
+
+	if host, _, err := net.SplitHostPort(vhost); err == nil {
+		return host
+	}
+	return vhost
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicyAuthorize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yml")
+	err := ioutil.WriteFile(path, []byte(`
+alice:
+  hostnames: ["*.alice.example.com", "www.example.org"]
+  subdomains: ["api", "alice-*"]
+  ports: ["2222", "10000-10099"]
+bob:
+  subdomains: ["bob"]
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewPolicy(path, "Ngrok.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		user string
+		url  string
+		ok   bool
+	}{
+		{"alice", "http://api.ngrok.test", true},
+		{"bob", "http://api.ngrok.test", false},
+		{"bob", "https://API.ngrok.test", false},
+		{"bob", "http://alice-dev.ngrok.test", false},
+		{"bob", "http://bob.ngrok.test", true},
+		{"alice", "http://bob.ngrok.test:8080", false},
+		{"bob", "http://www.alice.example.com", false},
+		{"alice", "http://www.alice.example.com", true},
+		{"bob", "tls://www.example.org", false},
+		{"bob", "http://free.ngrok.test", true},
+		{"", "http://free.ngrok.test", true},
+		{"alice", "tcp://ngrok.test:2222", true},
+		{"bob", "tcp://ngrok.test:2222", false},
+		{"bob", "tcp://ngrok.test:10050", false},
+		{"bob", "tcp://ngrok.test:10100", true},
+		{"alice", "udp://ngrok.test:10000", true},
+		{"bob", "udp://ngrok.test:2222", false},
+		{"bob", "udp://ngrok.test:10099", false},
+		{"bob", "udp://ngrok.test:53", true},
+	} {
+		err := p.Authorize(c.user, c.url)
+		if c.ok && err != nil {
+			t.Errorf("%s was refused %s: %v", c.user, c.url, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%s was allowed %s", c.user, c.url)
+		}
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	for _, c := range []struct {
+		spec      string
+		low, high int
+		ok        bool
+	}{
+		{"2222", 2222, 2222, true},
+		{"10000-10099", 10000, 10099, true},
+		{"100-10", 0, 0, false},
+		{"0", 0, 0, false},
+		{"70000", 0, 0, false},
+		{"a-b", 0, 0, false},
+		{"", 0, 0, false},
+	} {
+		pr, err := parsePortRange(c.spec)
+		switch {
+		case c.ok && err != nil:
+			t.Errorf("%q: %v", c.spec, err)
+		case !c.ok && err == nil:
+			t.Errorf("%q parsed as %+v, expected an error", c.spec, pr)
+		case c.ok && (pr.low != c.low || pr.high != c.high):
+			t.Errorf("%q parsed as %+v, expected %d-%d", c.spec, pr, c.low, c.high)
+		}
+	}
+}
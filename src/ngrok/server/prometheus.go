@@ -0,0 +1,320 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"ngrok/conn"
+	"ngrok/log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	counterType   = "counter"
+	gaugeType     = "gauge"
+	histogramType = "histogram"
+)
+
+// upper bounds of the connection duration histogram buckets, in seconds
+var connDurationBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+// A metric family with a value for each combination of label values
+type promFamily struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+	series  map[string]*promSeries
+}
+
+type promSeries struct {
+	labelValues []string
+	value       float64
+
+	// histograms only
+	bucketCounts []uint64
+	count        uint64
+}
+
+func newPromFamily(name, typ, help string, labels ...string) *promFamily {
+	return &promFamily{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		series: make(map[string]*promSeries),
+	}
+}
+
+func (f *promFamily) get(labelValues ...string) *promSeries {
+	key := strings.Join(labelValues, "\x00")
+	s, ok := f.series[key]
+	if !ok {
+		s = &promSeries{labelValues: labelValues}
+		if f.typ == histogramType {
+			s.bucketCounts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Removes all series where the label at index has the given value
+func (f *promFamily) remove(index int, value string) {
+	for key, s := range f.series {
+		if s.labelValues[index] == value {
+			delete(f.series, key)
+		}
+	}
+}
+
+func (f *promFamily) add(v float64, labelValues ...string) {
+	f.get(labelValues...).value += v
+}
+
+func (f *promFamily) observe(v float64, labelValues ...string) {
+	s := f.get(labelValues...)
+	for i, bound := range f.buckets {
+		if v <= bound {
+			s.bucketCounts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+func escapeLabelValue(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+	return strings.Replace(v, "\n", `\n`, -1)
+}
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Writes the family in the prometheus text exposition format
+func (f *promFamily) writeTo(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", f.name, f.typ)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if f.typ != histogramType {
+			fmt.Fprintf(buf, "%s%s %s\n", f.name, formatLabels(f.labels, s.labelValues, "", ""), formatFloat(s.value))
+			continue
+		}
+
+		for i, bound := range f.buckets {
+			labels := formatLabels(f.labels, s.labelValues, "le", formatFloat(bound))
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", f.name, labels, s.bucketCounts[i])
+		}
+		labels := formatLabels(f.labels, s.labelValues, "le", "+Inf")
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", f.name, labels, s.count)
+
+		labels = formatLabels(f.labels, s.labelValues, "", "")
+		fmt.Fprintf(buf, "%s_sum%s %s\n", f.name, labels, formatFloat(s.value))
+		fmt.Fprintf(buf, "%s_count%s %d\n", f.name, labels, s.count)
+	}
+}
+
+// PrometheusMetrics exposes server metrics in the prometheus text format
+// on /metrics of its own HTTP listener. Per-tunnel series are labeled with
+// the tunnel's url and are dropped when the tunnel closes.
+type PrometheusMetrics struct {
+	log.Logger
+	sync.Mutex
+
+	tunnelsOpen     *promFamily
+	tunnelsOpened   *promFamily
+	connections     *promFamily
+	connectionsOpen *promFamily
+	rejected        *promFamily
+	connDuration    *promFamily
+	bytesIn         *promFamily
+	bytesOut        *promFamily
+	rateLimit       *promFamily
+	lostHeartbeats  *promFamily
+	families        []*promFamily
+}
+
+func NewPrometheusMetrics(addr string) *PrometheusMetrics {
+	m := &PrometheusMetrics{
+		Logger: log.NewPrefixLogger("metrics"),
+
+		tunnelsOpen: newPromFamily("ngrokd_tunnels_open", gaugeType,
+			"Number of tunnels currently open.", "protocol", "user"),
+		tunnelsOpened: newPromFamily("ngrokd_tunnels_opened_total", counterType,
+			"Number of tunnels opened, by client operating system.", "protocol", "os", "user"),
+		connections: newPromFamily("ngrokd_connections_total", counterType,
+			"Number of public connections handled by a tunnel.", "url", "user"),
+		connectionsOpen: newPromFamily("ngrokd_connections_open", gaugeType,
+			"Number of public connections currently open on a tunnel.", "url", "user"),
+		rejected: newPromFamily("ngrokd_connections_rejected_total", counterType,
+			"Number of public connections rejected by a tunnel's IP restrictions.", "url", "user"),
+		connDuration: newPromFamily("ngrokd_connection_duration_seconds", histogramType,
+			"Duration of public connections.", "url", "user"),
+		bytesIn: newPromFamily("ngrokd_bytes_in_total", counterType,
+			"Bytes sent from the client to public connections.", "url", "user"),
+		bytesOut: newPromFamily("ngrokd_bytes_out_total", counterType,
+			"Bytes sent from public connections to the client.", "url", "user"),
+		rateLimit: newPromFamily("ngrokd_tunnel_rate_limit_bytes", gaugeType,
+			"Bytes a second a tunnel may carry in each direction, the lower of its own and its user's limit. 0 if unlimited.", "url", "user"),
+		lostHeartbeats: newPromFamily("ngrokd_lost_heartbeats_total", counterType,
+			"Number of control connections closed because the client stopped responding to heartbeats.", "user"),
+	}
+	m.connDuration.buckets = connDurationBuckets
+
+	m.families = []*promFamily{
+		m.tunnelsOpen,
+		m.tunnelsOpened,
+		m.connections,
+		m.connectionsOpen,
+		m.rejected,
+		m.connDuration,
+		m.bytesIn,
+		m.bytesOut,
+		m.rateLimit,
+		m.lostHeartbeats,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", m.serve)
+
+	m.Info("Serving prometheus metrics on %s", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			m.Error("Prometheus metrics listener failed: %v", err)
+		}
+	}()
+
+	return m
+}
+
+func (m *PrometheusMetrics) serve(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+
+	m.Lock()
+	for _, f := range m.families {
+		f.writeTo(&buf)
+	}
+	m.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+func (m *PrometheusMetrics) OpenTunnel(t *Tunnel) {
+	m.Lock()
+	defer m.Unlock()
+
+	user := t.ctl.account.User
+	m.tunnelsOpen.add(1, t.req.Protocol, user)
+	m.tunnelsOpened.add(1, t.req.Protocol, t.ctl.auth.OS, user)
+
+	// make the tunnel's series visible before its first connection
+	m.connections.add(0, t.url, user)
+	m.connectionsOpen.add(0, t.url, user)
+	m.bytesIn.add(0, t.url, user)
+	m.bytesOut.add(0, t.url, user)
+
+	// set rather than added up, the members of a group share the series
+	m.rateLimit.get(t.url, user).value = float64(t.RateLimit())
+}
+
+func (m *PrometheusMetrics) CloseTunnel(t *Tunnel) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.tunnelsOpen.add(-1, t.req.Protocol, t.ctl.account.User)
+
+	// the other members of a group keep the url's series, only the
+	// connections still open on this one no longer count
+	if tunnelRegistry.Peek(t.url) != nil {
+		active := atomic.LoadInt64(&t.activeConnections)
+		m.connectionsOpen.add(-float64(active), t.url, t.ctl.account.User)
+		return
+	}
+
+	for _, f := range []*promFamily{m.connections, m.connectionsOpen, m.rejected, m.connDuration, m.bytesIn, m.bytesOut, m.rateLimit} {
+		f.remove(0, t.url)
+	}
+}
+
+// connections may outlive their tunnel, don't bring its series back to life
+func tunnelClosed(t *Tunnel) bool {
+	return atomic.LoadInt32(&t.closing) == 1
+}
+
+func (m *PrometheusMetrics) OpenConnection(t *Tunnel, c conn.Conn) {
+	m.Lock()
+	defer m.Unlock()
+
+	if tunnelClosed(t) {
+		return
+	}
+
+	user := t.ctl.account.User
+	m.connections.add(1, t.url, user)
+	m.connectionsOpen.add(1, t.url, user)
+}
+
+func (m *PrometheusMetrics) CloseConnection(t *Tunnel, c conn.Conn, start time.Time, bytesIn, bytesOut int64) {
+	m.Lock()
+	defer m.Unlock()
+
+	if tunnelClosed(t) {
+		return
+	}
+
+	user := t.ctl.account.User
+	m.connectionsOpen.add(-1, t.url, user)
+	m.connDuration.observe(time.Since(start).Seconds(), t.url, user)
+	m.bytesIn.add(float64(bytesIn), t.url, user)
+	m.bytesOut.add(float64(bytesOut), t.url, user)
+}
+
+func (m *PrometheusMetrics) RejectConnection(t *Tunnel, c conn.Conn) {
+	m.Lock()
+	defer m.Unlock()
+
+	if tunnelClosed(t) {
+		return
+	}
+
+	m.rejected.add(1, t.url, t.ctl.account.User)
+}
+
+func (m *PrometheusMetrics) LostHeartbeat(c *Control) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.lostHeartbeats.add(1, c.account.User)
+}
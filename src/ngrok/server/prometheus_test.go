@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http/httptest"
+	"ngrok/msg"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func scrapePrometheus(t *testing.T, m *PrometheusMetrics) string {
+	w := httptest.NewRecorder()
+	m.serve(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Errorf("Served content type %q", ct)
+	}
+	return w.Body.String()
+}
+
+func TestPrometheusMetricsOutput(t *testing.T) {
+	ctl := testTunnelGlobals(t)
+	ctl.auth.OS = "linux"
+	ctl.account.User = "alice"
+	tun := &Tunnel{ctl: ctl, req: &msg.ReqTunnel{Protocol: "http"}, url: "http://foo.ngrok.test", start: time.Now()}
+	pub := testConn(t, "pub")
+
+	m := NewPrometheusMetrics("127.0.0.1:0")
+	m.OpenTunnel(tun)
+	m.OpenConnection(tun, pub)
+	m.CloseConnection(tun, pub, time.Now().Add(-2*time.Second), 10, 20)
+	m.RejectConnection(tun, pub)
+	m.LostHeartbeat(ctl)
+	m.LostHeartbeat(&Control{account: &Account{User: "bob \"the\" admin"}})
+
+	out := scrapePrometheus(t, m)
+	for _, line := range []string{
+		"# HELP ngrokd_bytes_in_total Bytes sent from the client to public connections.",
+		"# TYPE ngrokd_bytes_in_total counter",
+		"# TYPE ngrokd_tunnels_open gauge",
+		"# TYPE ngrokd_connection_duration_seconds histogram",
+		`ngrokd_tunnels_open{protocol="http",user="alice"} 1`,
+		`ngrokd_tunnels_opened_total{protocol="http",os="linux",user="alice"} 1`,
+		`ngrokd_connections_total{url="http://foo.ngrok.test",user="alice"} 1`,
+		`ngrokd_connections_open{url="http://foo.ngrok.test",user="alice"} 0`,
+		`ngrokd_connections_rejected_total{url="http://foo.ngrok.test",user="alice"} 1`,
+		`ngrokd_bytes_in_total{url="http://foo.ngrok.test",user="alice"} 10`,
+		`ngrokd_bytes_out_total{url="http://foo.ngrok.test",user="alice"} 20`,
+		`ngrokd_tunnel_rate_limit_bytes{url="http://foo.ngrok.test",user="alice"} 0`,
+		`ngrokd_connection_duration_seconds_bucket{url="http://foo.ngrok.test",user="alice",le="1"} 0`,
+		`ngrokd_connection_duration_seconds_bucket{url="http://foo.ngrok.test",user="alice",le="5"} 1`,
+		`ngrokd_connection_duration_seconds_bucket{url="http://foo.ngrok.test",user="alice",le="+Inf"} 1`,
+		`ngrokd_connection_duration_seconds_count{url="http://foo.ngrok.test",user="alice"} 1`,
+		`ngrokd_lost_heartbeats_total{user="alice"} 1`,
+		`ngrokd_lost_heartbeats_total{user="bob \"the\" admin"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Output is missing %s", line)
+		}
+	}
+
+	// a closed tunnel's series are dropped and late connections don't
+	// bring them back
+	m.CloseTunnel(tun)
+	atomic.StoreInt32(&tun.closing, 1)
+	m.CloseConnection(tun, pub, time.Now(), 1, 1)
+
+	out = scrapePrometheus(t, m)
+	if strings.Contains(out, `url="http://foo.ngrok.test"`) {
+		t.Errorf("Closed tunnel still has series:\n%s", out)
+	}
+	if !strings.Contains(out, `ngrokd_tunnels_open{protocol="http",user="alice"} 0`+"\n") {
+		t.Errorf("Closed tunnel is still counted as open:\n%s", out)
+	}
+}
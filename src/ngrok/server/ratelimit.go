@@ -0,0 +1,101 @@
+package server
+
+import (
+	"ngrok/conn"
+	"sync"
+)
+
+// The bytes a second a tunnel, or all of the tunnels of a user, may carry.
+// Each direction is shaped by a token bucket of its own so that uploads
+// and downloads may both use the whole rate. A nil limit doesn't limit.
+type rateLimit struct {
+	fromPublic *conn.RateLimiter // public clients to the client
+	toPublic   *conn.RateLimiter // the client back to public clients
+}
+
+// Returns nil if rate isn't positive, the burst defaults to the rate
+func newRateLimit(rate, burst int64) *rateLimit {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &rateLimit{
+		fromPublic: conn.NewRateLimiter(rate, burst),
+		toPublic:   conn.NewRateLimiter(rate, burst),
+	}
+}
+
+// Bytes a second in each direction, 0 if unlimited
+func (r *rateLimit) Rate() int64 {
+	if r == nil {
+		return 0
+	}
+	return r.fromPublic.Rate()
+}
+
+// The limits shared by all of the tunnels of each user
+var userRateLimits = struct {
+	sync.Mutex
+	limits map[string]*rateLimit
+}{limits: make(map[string]*rateLimit)}
+
+// Returns the limit every tunnel of the account's user shares, updated to
+// the account's rate. Accounts without a user are each limited on their
+// own, since every client of an open server has the same empty one.
+func userRateLimit(account *Account) *rateLimit {
+	rate, burst := account.Rate, account.Burst
+	if rate == 0 {
+		rate, burst = opts.userRate, opts.userBurst
+	}
+
+	if account.User == "" {
+		return newRateLimit(rate, burst)
+	}
+
+	userRateLimits.Lock()
+	defer userRateLimits.Unlock()
+
+	r := userRateLimits.limits[account.User]
+	switch {
+	case rate <= 0:
+		delete(userRateLimits.limits, account.User)
+		return nil
+	case r == nil:
+		r = newRateLimit(rate, burst)
+		userRateLimits.limits[account.User] = r
+	default:
+		r.fromPublic.SetRate(rate, burst)
+		r.toPublic.SetRate(rate, burst)
+	}
+	return r
+}
+
+// Returns the limit of a single tunnel of the account
+func tunnelRateLimit(account *Account) *rateLimit {
+	rate, burst := account.TunnelRate, account.TunnelBurst
+	if rate == 0 {
+		rate, burst = opts.tunnelRate, opts.tunnelBurst
+	}
+	return newRateLimit(rate, burst)
+}
+
+// The limiters the bytes from public clients, and those back to them,
+// are shaped by: the tunnel's own and those of its user
+func (t *Tunnel) rateLimiters() (fromPublic, toPublic []*conn.RateLimiter) {
+	for _, r := range []*rateLimit{t.rate, t.ctl.rate} {
+		if r != nil {
+			fromPublic = append(fromPublic, r.fromPublic)
+			toPublic = append(toPublic, r.toPublic)
+		}
+	}
+	return
+}
+
+// The lowest of the tunnel's and its user's rates, 0 if neither is limited
+func (t *Tunnel) RateLimit() int64 {
+	rate := t.rate.Rate()
+	if user := t.ctl.rate.Rate(); user > 0 && (rate == 0 || user < rate) {
+		rate = user
+	}
+	return rate
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/gob"
 	"fmt"
 	"net"
+	"net/http"
 	"ngrok/cache"
 	"ngrok/log"
 	"sync"
@@ -20,19 +21,40 @@ func (url cacheUrl) Size() int {
 	return len(url)
 }
 
-// TunnelRegistry maps a tunnel URL to Tunnel structures
+// TunnelRegistry maps a tunnel URL to Tunnel structures, or to the
+// group of tunnels which share it
 type TunnelRegistry struct {
-	tunnels  map[string]*Tunnel
+	tunnels map[string]*Tunnel
+	groups  map[string]*tunnelGroup
+
+	// tunnels open for each user, counted by slot
+	users    map[string]int
 	affinity *cache.LRUCache
 	log.Logger
 	sync.RWMutex
+
+	// durable reservations, if configured they replace the affinity cache
+	reservations *ReservationStore
+
+	// file the affinity cache is saved to
+	cacheFile string
 }
 
-func NewTunnelRegistry(cacheSize uint64, cacheFile string) *TunnelRegistry {
+func NewTunnelRegistry(cacheSize uint64, cacheFile string, reservations *ReservationStore) *TunnelRegistry {
 	registry := &TunnelRegistry{
-		tunnels:  make(map[string]*Tunnel),
-		affinity: cache.NewLRUCache(cacheSize),
-		Logger:   log.NewPrefixLogger("registry", "tun"),
+		tunnels:      make(map[string]*Tunnel),
+		groups:       make(map[string]*tunnelGroup),
+		users:        make(map[string]int),
+		affinity:     cache.NewLRUCache(cacheSize),
+		Logger:       log.NewPrefixLogger("registry", "tun"),
+		reservations: reservations,
+		cacheFile:    cacheFile,
+	}
+
+	if reservations != nil {
+		registry.Info("Using the reservation store for affinity")
+		registry.SweepReservationsThread(reservationSweepInterval)
+		return registry
 	}
 
 	// LRUCache uses Gob encoding. Unfortunately, Gob is fickle and will fail
@@ -75,24 +97,120 @@ func (r *TunnelRegistry) SaveCacheThread(path string, interval time.Duration) {
 	}()
 }
 
+// Spawns a goroutine that periodically removes expired reservations. The
+// urls of open tunnels are touched first so that long lived tunnels keep
+// their reservations.
+func (r *TunnelRegistry) SweepReservationsThread(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+
+			for _, t := range r.All() {
+				if err := r.reservations.Touch(t.url); err != nil {
+					r.Warn("Failed to update reservation of %s: %v", t.url, err)
+				}
+			}
+
+			if removed, err := r.reservations.Sweep(); err != nil {
+				r.Error("Failed to remove expired reservations: %v", err)
+			} else {
+				r.Info("Removed %d expired reservations", removed)
+			}
+		}
+	}()
+}
+
+// Saves the affinity cache and closes the reservation store
+// before ngrokd exits
+func (r *TunnelRegistry) Flush() {
+	if r.reservations != nil {
+		if err := r.reservations.Close(); err != nil {
+			r.Error("Failed to close the reservation store: %v", err)
+		}
+		return
+	}
+
+	if r.cacheFile != "" {
+		if err := r.affinity.SaveItemsToFile(r.cacheFile); err != nil {
+			r.Error("Failed to save affinity cache: %v", err)
+		} else {
+			r.Info("Saved affinity cache")
+		}
+	}
+}
+
+// Returns an error if the url is reserved for someone other
+// than the tunnel's user or client
+func (r *TunnelRegistry) Authorize(url string, t *Tunnel) error {
+	if err := policy.Authorize(t.ctl.account.User, url); err != nil {
+		return err
+	}
+
+	if r.reservations != nil {
+		return r.reservations.Authorize(url, t)
+	}
+
+	return nil
+}
+
 // Register a tunnel with a specific url, returns an error
-// if a tunnel is already registered at that url
+// if a tunnel is already registered at that url or if the
+// url is reserved for another user. A tunnel with a group
+// secret joins the group registered at the url if it knows
+// the group's secret.
 func (r *TunnelRegistry) Register(url string, t *Tunnel) error {
+	if err := r.Authorize(url, t); err != nil {
+		return err
+	}
+
 	r.Lock()
-	defer r.Unlock()
+	if g := r.groups[url]; g != nil {
+		defer r.Unlock()
+		if t.req.GroupSecret == "" {
+			return fmt.Errorf("The tunnel %s is already registered.", url)
+		}
+
+		// the url is already claimed for the group
+		if err := g.add(t); err != nil {
+			return err
+		}
+		t.group = g
+		return nil
+	}
 
 	if r.tunnels[url] != nil {
+		r.Unlock()
 		return fmt.Errorf("The tunnel %s is already registered.", url)
 	}
 
-	r.tunnels[url] = t
+	if t.req.GroupSecret != "" {
+		t.group = newTunnelGroup(url, t)
+		r.groups[url] = t.group
+	} else {
+		r.tunnels[url] = t
+	}
+	r.Unlock()
+
+	// the url must not be registered on any other node either
+	if cluster != nil {
+		if err := cluster.Claim(url); err != nil {
+			r.Lock()
+			r.remove(url, t)
+			r.Unlock()
+
+			if t.req.GroupSecret != "" {
+				err = fmt.Errorf("%v The tunnels of a group must all connect to the same server.", err)
+			}
+			return err
+		}
+	}
 
 	return nil
 }
 
 func (r *TunnelRegistry) cacheKeys(t *Tunnel) (ip string, id string) {
 	clientIp := t.ctl.conn.RemoteAddr().(*net.TCPAddr).IP.String()
-	clientId := t.ctl.id
+	clientId := t.ctl.Id()
 
 	ipKey := fmt.Sprintf("client-ip-%s:%s", t.req.Protocol, clientIp)
 	idKey := fmt.Sprintf("client-id-%s:%s", t.req.Protocol, clientId)
@@ -104,7 +222,11 @@ func (r *TunnelRegistry) GetCachedRegistration(t *Tunnel) (url string) {
 
 	// check cache for ID first, because we prefer that over IP which might
 	// not be specific to a user because of NATs
-	if v, ok := r.affinity.Get(idCacheKey); ok {
+	if r.reservations != nil {
+		if url = r.reservations.Affinity(idCacheKey, ipCacheKey); url != "" {
+			t.Debug("Found reserved affinity %s", url)
+		}
+	} else if v, ok := r.affinity.Get(idCacheKey); ok {
 		url = string(v.(cacheUrl))
 		t.Debug("Found registry affinity %s for %s", url, idCacheKey)
 	} else if v, ok := r.affinity.Get(ipCacheKey); ok {
@@ -118,6 +240,15 @@ func (r *TunnelRegistry) RegisterAndCache(url string, t *Tunnel) (err error) {
 	if err = r.Register(url, t); err == nil {
 		// we successfully assigned a url, cache it
 		ipCacheKey, idCacheKey := r.cacheKeys(t)
+		if r.reservations != nil {
+			// reserve it so it's still ours when we reconnect
+			if err = r.reservations.Assign(url, t, idCacheKey, ipCacheKey); err != nil {
+				r.Del(url, t)
+				err = fmt.Errorf("Failed to reserve %s: %v", url, err)
+			}
+			return
+		}
+
 		r.affinity.Set(ipCacheKey, cacheUrl(url))
 		r.affinity.Set(idCacheKey, cacheUrl(url))
 	}
@@ -148,18 +279,152 @@ func (r *TunnelRegistry) RegisterRepeat(urlFn func() string, t *Tunnel) (string,
 	return "", fmt.Errorf("Failed to assign a URL after %d attempts!", maxAttempts)
 }
 
-func (r *TunnelRegistry) Del(url string) {
+// Unregister a tunnel, the url is released once no tunnel
+// of its group is left
+func (r *TunnelRegistry) Del(url string, t *Tunnel) {
+	r.Lock()
+	released := r.remove(url, t)
+	r.Unlock()
+
+	if released && cluster != nil {
+		cluster.Release(url)
+	}
+
+	// an automatic reservation lasts from when the url was last used
+	if released && r.reservations != nil {
+		if err := r.reservations.Touch(url); err != nil {
+			r.Warn("Failed to update reservation of %s: %v", url, err)
+		}
+	}
+}
+
+// Removes a tunnel from the url, returns whether the url is no longer
+// registered. The caller must hold the lock.
+func (r *TunnelRegistry) remove(url string, t *Tunnel) bool {
+	if g := r.groups[url]; g != nil && t.group == g {
+		if !g.remove(t) {
+			return false
+		}
+		delete(r.groups, url)
+		return true
+	}
+
+	if r.tunnels[url] == t {
+		delete(r.tunnels, url)
+		return true
+	}
+	return false
+}
+
+// A tunnel counted against its user's limit. The protocols opened for a
+// single ReqTunnel, like http and https, share one slot, which is freed
+// once all of them are closed.
+type tunnelSlot struct {
+	user string
+	refs int
+}
+
+// Reserves a slot for a new tunnel of the user, returns an error if the
+// user already has max tunnels open. 0 means unlimited. The caller holds
+// a reference to the slot until it calls Release.
+func (r *TunnelRegistry) ReserveUser(user string, max int) (*tunnelSlot, error) {
 	r.Lock()
 	defer r.Unlock()
-	delete(r.tunnels, url)
+
+	if max > 0 && r.users[user] >= max {
+		return nil, fmt.Errorf("Your account is limited to %d open tunnels.", max)
+	}
+
+	r.users[user]++
+	return &tunnelSlot{user: user, refs: 1}, nil
 }
 
+// Takes another reference to a slot for a tunnel opened in it
+func (r *TunnelRegistry) Retain(s *tunnelSlot) {
+	r.Lock()
+	defer r.Unlock()
+	s.refs++
+}
+
+// Drops a reference to a slot, it's freed once none are left
+func (r *TunnelRegistry) Release(s *tunnelSlot) {
+	r.Lock()
+	defer r.Unlock()
+
+	if s.refs--; s.refs > 0 {
+		return
+	}
+
+	if r.users[s.user]--; r.users[s.user] <= 0 {
+		delete(r.users, s.user)
+	}
+}
+
+// Returns the tunnel registered at a url. For a group, this is
+// the member picked to handle the next public connection.
 func (r *TunnelRegistry) Get(url string) *Tunnel {
 	r.RLock()
 	defer r.RUnlock()
+	if g := r.groups[url]; g != nil {
+		return g.Pick()
+	}
 	return r.tunnels[url]
 }
 
+// Returns the tunnel an http request to a url goes to. For a group,
+// this is the member the routing rules of its members pick. HTTP/1.1
+// connections are proxied as a whole, so only their first request is
+// routed, HTTP/2 requests are routed one by one.
+func (r *TunnelRegistry) Route(url string, req *http.Request) *Tunnel {
+	r.RLock()
+	defer r.RUnlock()
+	if g := r.groups[url]; g != nil {
+		return g.Route(req)
+	}
+	return r.tunnels[url]
+}
+
+// Returns a tunnel registered at a url without picking a member of a
+// group, for checks of the settings all of its members share
+func (r *TunnelRegistry) Peek(url string) *Tunnel {
+	r.RLock()
+	defer r.RUnlock()
+	if g := r.groups[url]; g != nil {
+		if members := g.Members(); len(members) > 0 {
+			return members[0]
+		}
+		return nil
+	}
+	return r.tunnels[url]
+}
+
+// Returns every tunnel registered at a url, all the members of a group
+func (r *TunnelRegistry) Members(url string) []*Tunnel {
+	r.RLock()
+	defer r.RUnlock()
+	if g := r.groups[url]; g != nil {
+		return g.Members()
+	}
+	if t := r.tunnels[url]; t != nil {
+		return []*Tunnel{t}
+	}
+	return nil
+}
+
+// Returns a snapshot of all registered tunnels
+func (r *TunnelRegistry) All() []*Tunnel {
+	r.RLock()
+	defer r.RUnlock()
+	tunnels := make([]*Tunnel, 0, len(r.tunnels))
+	for _, t := range r.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	for _, g := range r.groups {
+		tunnels = append(tunnels, g.Members()...)
+	}
+	return tunnels
+}
+
 // ControlRegistry maps a client ID to Control structures
 type ControlRegistry struct {
 	controls map[string]*Control
@@ -180,6 +445,17 @@ func (r *ControlRegistry) Get(clientId string) *Control {
 	return r.controls[clientId]
 }
 
+// Returns a snapshot of all registered control connections
+func (r *ControlRegistry) All() []*Control {
+	r.RLock()
+	defer r.RUnlock()
+	controls := make([]*Control, 0, len(r.controls))
+	for _, c := range r.controls {
+		controls = append(controls, c)
+	}
+	return controls
+}
+
 func (r *ControlRegistry) Add(clientId string, ctl *Control) (oldCtl *Control) {
 	r.Lock()
 	defer r.Unlock()
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestReserveUser(t *testing.T) {
+	r := NewTunnelRegistry(16, "", nil)
+
+	a, err := r.ReserveUser("alice", 2)
+	if err != nil {
+		t.Fatalf("first tunnel: %v", err)
+	}
+
+	// the http and https tunnels of one request share the slot
+	r.Retain(a)
+	r.Retain(a)
+	r.Release(a)
+
+	b, err := r.ReserveUser("alice", 2)
+	if err != nil {
+		t.Fatalf("second tunnel: %v", err)
+	}
+
+	if _, err = r.ReserveUser("alice", 2); err == nil {
+		t.Fatalf("third tunnel was allowed over the limit of 2")
+	}
+
+	if _, err = r.ReserveUser("bob", 2); err != nil {
+		t.Fatalf("another user is limited by alice's tunnels: %v", err)
+	}
+
+	// closing one protocol of the first tunnel doesn't free its slot
+	r.Release(a)
+	if _, err = r.ReserveUser("alice", 2); err == nil {
+		t.Fatalf("slot was freed while a tunnel is still open in it")
+	}
+
+	r.Release(a)
+	if _, err = r.ReserveUser("alice", 2); err != nil {
+		t.Fatalf("slot wasn't freed once its tunnels closed: %v", err)
+	}
+
+	r.Release(b)
+	if n := r.users["alice"]; n != 1 {
+		t.Fatalf("alice has %d slots, expected 1", n)
+	}
+
+	// 0 is unlimited
+	for i := 0; i < 10; i++ {
+		if _, err = r.ReserveUser("carol", 0); err != nil {
+			t.Fatalf("unlimited user was limited: %v", err)
+		}
+	}
+}
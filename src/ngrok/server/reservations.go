@@ -0,0 +1,414 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"net"
+	"net/url"
+	"ngrok/log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// automatic reservations are dropped once they haven't been used for this long
+	reservationExpiry = 30 * 24 * time.Hour
+
+	// how often expired reservations are removed from the store
+	reservationSweepInterval = 24 * time.Hour
+
+	// how long to wait for the lock on the reservation store file
+	reservationOpenTimeout = time.Second
+)
+
+var (
+	reservationsBucket = []byte("reservations")
+	affinityBucket     = []byte("affinity")
+)
+
+// A tunnel url reserved to a user or, when the user is empty, a client id
+type Reservation struct {
+	Url      string
+	User     string
+	ClientId string
+
+	// automatic reservations are made when a url is assigned to a client,
+	// the others are made by an administrator and never expire
+	Auto     bool
+	Created  time.Time
+	LastUsed time.Time
+}
+
+func (r *Reservation) expired() bool {
+	return r.Auto && time.Since(r.LastUsed) > reservationExpiry
+}
+
+// Whether the tunnel may use the reserved url
+func (r *Reservation) allows(t *Tunnel) bool {
+	if r.User != "" {
+		return r.User == t.ctl.account.User
+	}
+	return r.ClientId == t.ctl.Id()
+}
+
+// ReservationStore durably records which tunnel urls are reserved to whom,
+// along with the affinity of clients to the urls they were assigned so that
+// reconnecting clients get the same urls back. Every change is written to
+// disk in its own transaction.
+type ReservationStore struct {
+	log.Logger
+	db *bolt.DB
+}
+
+func OpenReservationStore(path string) (*ReservationStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: reservationOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open reservation store %s: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{reservationsBucket, affinityBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed to initialize reservation store %s: %v", path, err)
+	}
+
+	return &ReservationStore{
+		Logger: log.NewPrefixLogger("reservations"),
+		db:     db,
+	}, nil
+}
+
+func (s *ReservationStore) Close() error {
+	return s.db.Close()
+}
+
+func getReservation(tx *bolt.Tx, url string) (*Reservation, error) {
+	buf := tx.Bucket(reservationsBucket).Get([]byte(url))
+	if buf == nil {
+		return nil, nil
+	}
+
+	res := new(Reservation)
+	if err := json.Unmarshal(buf, res); err != nil {
+		return nil, fmt.Errorf("Corrupt reservation for %s: %v", url, err)
+	}
+	return res, nil
+}
+
+func putReservation(tx *bolt.Tx, res *Reservation) error {
+	buf, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(reservationsBucket).Put([]byte(res.Url), buf)
+}
+
+// Returns an error if the url is reserved to someone other than the tunnel
+func (s *ReservationStore) Authorize(url string, t *Tunnel) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		res, err := getReservation(tx, url)
+		if err != nil {
+			return err
+		}
+
+		if res != nil && !res.expired() && !res.allows(t) {
+			return fmt.Errorf("The tunnel %s is reserved for another account.", url)
+		}
+		return nil
+	})
+}
+
+// Reserves a url which was assigned to the tunnel and records the affinity
+// of the tunnel's client to it under each of the keys
+func (s *ReservationStore) Assign(url string, t *Tunnel, keys ...string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		res, err := getReservation(tx, url)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if res == nil || res.expired() {
+			res = &Reservation{
+				Url:      url,
+				User:     t.ctl.account.User,
+				ClientId: t.ctl.Id(),
+				Auto:     true,
+				Created:  now,
+			}
+		} else if res.Auto {
+			// the user's client may have reconnected with a new id
+			res.ClientId = t.ctl.Id()
+		}
+		res.LastUsed = now
+
+		if err = putReservation(tx, res); err != nil {
+			return err
+		}
+
+		affinity := tx.Bucket(affinityBucket)
+		for _, key := range keys {
+			if err = affinity.Put([]byte(key), []byte(url)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Records that the reserved url was just in use, so that an automatic
+// reservation expires counting from when its tunnel closed instead of
+// from when it was opened
+func (s *ReservationStore) Touch(url string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		res, err := getReservation(tx, url)
+		if err != nil || res == nil {
+			return err
+		}
+
+		res.LastUsed = time.Now()
+		return putReservation(tx, res)
+	})
+}
+
+// Returns the url last assigned under the first of the keys which has one
+func (s *ReservationStore) Affinity(keys ...string) (url string) {
+	err := s.db.View(func(tx *bolt.Tx) error {
+		affinity := tx.Bucket(affinityBucket)
+		for _, key := range keys {
+			if v := affinity.Get([]byte(key)); v != nil {
+				url = string(v)
+				return nil
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		s.Error("Failed to read affinity: %v", err)
+	}
+	return
+}
+
+// Reserves a url to a user, replacing any existing reservation of it
+func (s *ReservationStore) Add(rawUrl, user string) (*Reservation, error) {
+	url, err := canonicalTunnelUrl(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == "" {
+		return nil, fmt.Errorf("A user is required to reserve %s", url)
+	}
+
+	now := time.Now()
+	res := &Reservation{
+		Url:      url,
+		User:     user,
+		Created:  now,
+		LastUsed: now,
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return putReservation(tx, res)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.Info("Reserved %s to %s", url, user)
+	return res, nil
+}
+
+// Checks that a url is one a tunnel could be registered at and returns it
+// the way the tunnel registry writes it: a lower case host, with a port
+// that tcp and udp urls must have, and nothing else
+func canonicalTunnelUrl(rawUrl string) (string, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", fmt.Errorf("Invalid url %s: %v", rawUrl, err)
+	}
+
+	if u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("Invalid url %s, expected only a scheme and a host", rawUrl)
+	}
+
+	host := strings.ToLower(u.Host)
+	switch u.Scheme {
+	case "http", "https", "tls":
+		if u.Hostname() == "" {
+			return "", fmt.Errorf("Invalid url %s, expected a hostname", rawUrl)
+		}
+
+	case "tcp", "udp":
+		_, port, err := net.SplitHostPort(host)
+		if err != nil {
+			return "", fmt.Errorf("Invalid url %s, expected a port", rawUrl)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return "", fmt.Errorf("Invalid url %s, expected a port", rawUrl)
+		}
+
+	default:
+		return "", fmt.Errorf("Invalid url %s, expected one of http, https, tls, tcp or udp", rawUrl)
+	}
+
+	return u.Scheme + "://" + host, nil
+}
+
+// Removes the reservation of a url
+func (s *ReservationStore) Revoke(rawUrl string) error {
+	url, err := canonicalTunnelUrl(rawUrl)
+	if err != nil {
+		return err
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		res, err := getReservation(tx, url)
+		if err != nil {
+			return err
+		}
+
+		if res == nil {
+			return fmt.Errorf("No reservation for %s", url)
+		}
+
+		return tx.Bucket(reservationsBucket).Delete([]byte(url))
+	})
+	if err != nil {
+		return err
+	}
+
+	s.Info("Revoked reservation of %s", url)
+	return nil
+}
+
+// Removes expired automatic reservations along with the affinity of clients
+// to urls which aren't reserved anymore, which would otherwise stay in the
+// store forever. Returns the number of reservations removed.
+func (s *ReservationStore) Sweep() (removed int, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		reservations := tx.Bucket(reservationsBucket)
+		live := make(map[string]bool)
+		var expired [][]byte
+		err := reservations.ForEach(func(k, v []byte) error {
+			res := new(Reservation)
+			if err := json.Unmarshal(v, res); err != nil {
+				return fmt.Errorf("Corrupt reservation for %s: %v", k, err)
+			}
+
+			if res.expired() {
+				expired = append(expired, append([]byte(nil), k...))
+			} else {
+				live[res.Url] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		affinity := tx.Bucket(affinityBucket)
+		var stale [][]byte
+		err = affinity.ForEach(func(k, v []byte) error {
+			if !live[string(v)] {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// buckets can't be changed while they're iterated
+		for _, k := range expired {
+			if err = reservations.Delete(k); err != nil {
+				return err
+			}
+		}
+		for _, k := range stale {
+			if err = affinity.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		removed = len(expired)
+		return nil
+	})
+	return
+}
+
+// Returns all reservations which haven't expired
+func (s *ReservationStore) List() ([]*Reservation, error) {
+	reservations := make([]*Reservation, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(reservationsBucket).ForEach(func(k, v []byte) error {
+			res := new(Reservation)
+			if err := json.Unmarshal(v, res); err != nil {
+				return fmt.Errorf("Corrupt reservation for %s: %v", k, err)
+			}
+
+			if !res.expired() {
+				reservations = append(reservations, res)
+			}
+			return nil
+		})
+	})
+	return reservations, err
+}
+
+// Runs one of the management commands given on the command line. The
+// reservation store can only be opened by one process at a time, use
+// the admin api to manage the reservations of a running server.
+func runCommand(opts *Options) error {
+	args := opts.args
+	if args[0] != "reservations" || len(args) < 2 {
+		return fmt.Errorf("Unknown command: %v, run %s -help for usage", args, os.Args[0])
+	}
+
+	if opts.reservations == "" {
+		return fmt.Errorf("Specify the reservation store with -reservations")
+	}
+
+	s, err := OpenReservationStore(opts.reservations)
+	if err != nil {
+		return fmt.Errorf("%v (if ngrokd is running, use the admin api instead)", err)
+	}
+	defer s.Close()
+
+	switch {
+	case args[1] == "list" && len(args) == 2:
+		reservations, err := s.List()
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "URL\tUSER\tCLIENT ID\tAUTOMATIC\tLAST USED")
+		for _, r := range reservations {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s\n", r.Url, r.User, r.ClientId, r.Auto, r.LastUsed.Format(time.RFC3339))
+		}
+		return w.Flush()
+
+	case args[1] == "add" && len(args) == 4:
+		_, err = s.Add(args[2], args[3])
+		return err
+
+	case args[1] == "revoke" && len(args) == 3:
+		return s.Revoke(args[2])
+
+	default:
+		return fmt.Errorf("Invalid reservations command: %v, run %s -help for usage", args[1:], os.Args[0])
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"ngrok/msg"
+	"strings"
+)
+
+// The rules by which the http requests of a tunnel group are routed to a
+// member: requests with the header or the cookie go to the member, and it
+// gets weight percent of the requests which no member's header or cookie
+// matches.
+type tunnelRoute struct {
+	weight int
+
+	header string
+	value  string
+
+	cookie      string
+	cookieValue string
+}
+
+// Returns nil if the tunnel doesn't ask for any requests in particular
+func newTunnelRoute(req *msg.ReqTunnel) (*tunnelRoute, error) {
+	if req.Weight == 0 && req.RouteHeader == "" && req.RouteCookie == "" {
+		return nil, nil
+	}
+
+	if req.GroupSecret == "" {
+		return nil, fmt.Errorf("Requests can only be routed between the members of a tunnel group")
+	}
+
+	if req.Weight < 0 || req.Weight > 100 {
+		return nil, fmt.Errorf("Invalid weight %d, expected a percentage between 0 and 100", req.Weight)
+	}
+
+	r := &tunnelRoute{weight: req.Weight}
+	if req.RouteHeader != "" {
+		parts := strings.SplitN(req.RouteHeader, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Invalid route header %s, expected Name: value", req.RouteHeader)
+		}
+		r.header = http.CanonicalHeaderKey(strings.TrimSpace(parts[0]))
+		r.value = strings.TrimSpace(parts[1])
+	}
+
+	if req.RouteCookie != "" {
+		parts := strings.SplitN(req.RouteCookie, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Invalid route cookie %s, expected name=value", req.RouteCookie)
+		}
+		r.cookie = strings.TrimSpace(parts[0])
+		r.cookieValue = strings.TrimSpace(parts[1])
+	}
+
+	return r, nil
+}
+
+// Whether the request has the route's header or cookie, false if the
+// route has neither or r is nil
+func (r *tunnelRoute) Matches(req *http.Request) bool {
+	if r == nil {
+		return false
+	}
+
+	if r.header != "" {
+		for _, v := range req.Header[r.header] {
+			if strings.TrimSpace(v) == r.value {
+				return true
+			}
+		}
+	}
+
+	if r.cookie != "" {
+		for _, c := range req.Cookies() {
+			if c.Name == r.cookie && c.Value == r.cookieValue {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// The percentage of the group's unmatched requests the member gets
+func (r *tunnelRoute) Weight() int {
+	if r == nil {
+		return 0
+	}
+	return r.weight
+}
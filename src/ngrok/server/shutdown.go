@@ -0,0 +1,114 @@
+package server
+
+import (
+	"ngrok/conn"
+	"ngrok/log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	drainPollInterval = 250 * time.Millisecond
+)
+
+// Public connections which are currently being handled by tunnels
+func activeConnections() (n int64) {
+	for _, t := range tunnelRegistry.All() {
+		n += atomic.LoadInt64(&t.activeConnections)
+	}
+	return
+}
+
+// Set once ngrokd starts shutting down, new clients are turned away from
+// then on while the proxy connections of connected ones are still accepted
+var serverDraining int32
+
+// Waits for SIGTERM or SIGINT and then shuts ngrokd down gracefully:
+// every public listener stops accepting, connected clients are told the
+// server is going away so they reconnect right away, and public connections
+// which are already joined with a proxy connection get until the drain
+// timeout to finish. A second signal stops waiting for them.
+//
+// The tunnel listener keeps accepting until the drain is over, clients
+// which don't multiplex dial it for the proxy connections of public
+// connections which were accepted before the signal.
+func drainOnTerm(tunListener *conn.Listener, timeout time.Duration) {
+	term := make(chan os.Signal, 2)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	drain(<-term, term, tunListener, timeout)
+}
+
+// Shuts ngrokd down after the first signal, sig, a further one on term
+// stops waiting for connections to finish
+func drain(sig os.Signal, term <-chan os.Signal, tunListener *conn.Listener, timeout time.Duration) {
+	log.Info("Got %v, shutting down and draining connections for up to %v", sig, timeout)
+	deadline := time.After(timeout)
+
+	// stop accepting new public connections and new clients
+	atomic.StoreInt32(&serverDraining, 1)
+	for _, l := range listeners {
+		l.Close()
+	}
+
+	for _, t := range tunnelRegistry.All() {
+		t.Drain()
+	}
+
+	// clients can reconnect to another server, or to this one once it
+	// restarts. Each of them is told on its own so that a client which
+	// doesn't read its control connection can't hold up the others.
+	notified := make(chan struct{})
+	go func() {
+		defer close(notified)
+
+		// let other nodes of the cluster take over our tunnel urls
+		if cluster != nil {
+			cluster.Leave()
+		}
+
+		var wg sync.WaitGroup
+		for _, ctl := range controlRegistry.All() {
+			wg.Add(1)
+			go func(ctl *Control) {
+				defer wg.Done()
+				ctl.GoingAway("The server is shutting down")
+			}(ctl)
+		}
+		wg.Wait()
+	}()
+
+	// wait for joined connections to finish
+	poll := time.NewTicker(drainPollInterval)
+	defer poll.Stop()
+
+wait:
+	for {
+		n := activeConnections()
+		select {
+		case <-notified:
+			if n == 0 {
+				log.Info("All connections finished")
+				break wait
+			}
+		default:
+		}
+
+		select {
+		case <-poll.C:
+		case <-deadline:
+			log.Warn("Drain timeout expired, dropping %d connections", n)
+			break wait
+		case sig = <-term:
+			log.Warn("Got %v, dropping %d connections", sig, n)
+			break wait
+		}
+	}
+
+	tunListener.Close()
+	tunnelRegistry.Flush()
+	log.Info("Shutdown complete")
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"io"
+	"net"
+	"ngrok/conn"
+	"ngrok/msg"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Starts draining with a public connection joined to a tunnel client.
+// Returns the public and proxy ends of that connection and a channel which
+// closes once the drain is over.
+func testDrain(t *testing.T, term chan os.Signal, timeout time.Duration) (net.Conn, conn.Conn, chan struct{}) {
+	testControlGlobals(t)
+	t.Cleanup(func() { atomic.StoreInt32(&serverDraining, 0) })
+
+	httpListener, err := conn.Listen("127.0.0.1:0", "pub", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners = map[string]*conn.Listener{"http": httpListener}
+
+	tunListener, err := conn.Listen("127.0.0.1:0", "tun", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tunListener.Close() })
+
+	client, session, _ := testSession(t, true)
+	url := testSessionTunnel(t, client, &msg.ReqTunnel{Protocol: "tcp"})
+	tunnelAddr := "127.0.0.1" + url[strings.LastIndex(url, ":"):]
+
+	public, err := net.Dial("tcp", tunnelAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, _ := testAcceptProxy(t, session)
+
+	// lets the connection finish before the next test replaces the globals
+	t.Cleanup(func() {
+		public.Close()
+		pc.Close()
+		for deadline := time.Now().Add(5 * time.Second); activeConnections() != 0 && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	done := make(chan struct{})
+	go func() {
+		drain(syscall.SIGTERM, term, tunListener, timeout)
+		close(done)
+	}()
+
+	// clients are told to reconnect elsewhere
+	if m, ok := testReadMsg(t, client).(*msg.ServerGoingAway); !ok {
+		t.Fatalf("Got %+v, expected a ServerGoingAway", m)
+	}
+
+	// and nothing new is accepted
+	if atomic.LoadInt32(&serverDraining) != 1 {
+		t.Errorf("New clients aren't turned away")
+	}
+	for _, addr := range []string{tunnelAddr, httpListener.Addr.String()} {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			t.Errorf("%s still accepts public connections", addr)
+		}
+	}
+
+	return public, pc, done
+}
+
+func TestDrain(t *testing.T) {
+	public, pc, done := testDrain(t, make(chan os.Signal, 1), time.Minute)
+
+	// joined connections keep working until they finish on their own
+	select {
+	case <-done:
+		t.Fatalf("Drain finished while a connection was active")
+	case <-time.After(2 * drainPollInterval):
+	}
+
+	if _, err := pc.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(public, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("Public connection read %q, %v while draining", buf, err)
+	}
+
+	public.Close()
+	pc.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Drain didn't finish once the connection finished")
+	}
+}
+
+func TestDrainInterrupted(t *testing.T) {
+	// a second signal stops waiting for joined connections
+	term := make(chan os.Signal, 1)
+	_, _, done := testDrain(t, term, time.Minute)
+	term <- os.Interrupt
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Drain didn't stop on a second signal")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	_, _, done := testDrain(t, make(chan os.Signal, 1), drainPollInterval)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Drain didn't stop after its timeout")
+	}
+}
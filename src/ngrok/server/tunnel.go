@@ -1,7 +1,6 @@
 package server
 
 import (
-	"encoding/base64"
 	"fmt"
 	"math/rand"
 	"net"
@@ -9,16 +8,20 @@ import (
 	"ngrok/log"
 	"ngrok/msg"
 	"ngrok/util"
-	"os"
 	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
 )
 
+const (
+	maxBindAttempts = 5
+)
+
 var defaultPortMap = map[string]int{
 	"http":  80,
 	"https": 443,
+	"tls":   443,
 	"smtp":  25,
 }
 
@@ -27,9 +30,33 @@ var defaultPortMap = map[string]int{
  *         route public traffic to a firewalled endpoint.
  */
 type Tunnel struct {
+	// counters for the admin api, these are accessed atomically
+	// and kept first in the struct for 64-bit alignment
+	connections       int64
+	activeConnections int64
+	bytesIn           int64
+	bytesOut          int64
+	rejected          int64
+
 	// request that opened the tunnel
 	req *msg.ReqTunnel
 
+	// addresses public connections are allowed from, nil allows all
+	ipFilter *ipFilter
+
+	// credentials http requests must present, nil if none are required
+	httpAuth *httpAuth
+
+	// login browsers must complete first, nil if none is required
+	oidc *oidcGate
+
+	// which requests of its group the tunnel gets, nil for its share
+	// of those no other member asks for
+	route *tunnelRoute
+
+	// bytes a second the tunnel may carry, nil if unlimited
+	rate *rateLimit
+
 	// time when the tunnel was opened
 	start time.Time
 
@@ -39,19 +66,32 @@ type Tunnel struct {
 	// tcp listener
 	listener *net.TCPListener
 
+	// udp socket
+	udpConn *net.UDPConn
+
 	// control connection
 	ctl *Control
 
+	// counts the tunnel against its user's limit
+	slot *tunnelSlot
+
+	// the tunnels public connections are balanced across, nil if the
+	// tunnel isn't a member of a group
+	group *tunnelGroup
+
 	// logger
 	log.Logger
 
 	// closing
 	closing int32
+
+	// no longer accepting public connections because ngrokd is shutting down
+	draining int32
 }
 
 // Common functionality for registering virtually hosted protocols
 func registerVhost(t *Tunnel, protocol string, servingPort int) (err error) {
-	vhost := os.Getenv("VHOST")
+	vhost := opts.vhost
 	if vhost == "" {
 		vhost = fmt.Sprintf("%s:%d", opts.domain, servingPort)
 	}
@@ -84,6 +124,11 @@ func registerVhost(t *Tunnel, protocol string, servingPort int) (err error) {
 		return tunnelRegistry.Register(t.url, t)
 	}
 
+	// the members of a group must agree on the url
+	if t.req.GroupSecret != "" {
+		return fmt.Errorf("A tunnel group must ask for a hostname or subdomain")
+	}
+
 	// Register for random URL
 	t.url, err = tunnelRegistry.RegisterRepeat(func() string {
 		return fmt.Sprintf("%s://%x.%s", protocol, rand.Int31(), vhost)
@@ -99,67 +144,112 @@ func NewTunnel(m *msg.ReqTunnel, ctl *Control) (t *Tunnel, err error) {
 		req:    m,
 		start:  time.Now(),
 		ctl:    ctl,
+		rate:   tunnelRateLimit(ctl.account),
 		Logger: log.NewPrefixLogger(),
 	}
 
+	if t.ipFilter, err = newIPFilter(m.AllowCIDRs, m.DenyCIDRs); err != nil {
+		return
+	}
+
+	if t.httpAuth, err = newHttpAuth(m); err != nil {
+		return
+	}
+
+	if t.route, err = newTunnelRoute(m); err != nil {
+		return
+	}
+
 	proto := t.req.Protocol
+	if m.Oidc != nil && proto != "http" && proto != "https" {
+		err = fmt.Errorf("An OIDC login can only be required for http and https tunnels")
+		return
+	}
+
+	switch m.AppProtocol {
+	case "", "http1", "http2":
+	default:
+		err = fmt.Errorf("Unknown app protocol %s, expected http1 or http2", m.AppProtocol)
+		return
+	}
+
+	if m.AppProtocol != "" && proto != "http" && proto != "https" {
+		err = fmt.Errorf("An app protocol can only be set for http and https tunnels")
+		return
+	}
+
+	switch m.Balance {
+	case "", "round_robin", "least_connections":
+	default:
+		err = fmt.Errorf("Unknown balancing %s, expected round_robin or least_connections", m.Balance)
+		return
+	}
+
+	if m.Balance != "" && m.GroupSecret == "" {
+		err = fmt.Errorf("Balancing only applies to tunnel groups, which need a group secret")
+		return
+	}
+
+	if m.GroupSecret != "" && proto != "http" && proto != "https" && proto != "tls" {
+		err = fmt.Errorf("Only http, https and tls tunnels can form tunnel groups")
+		return
+	}
+
+	if t.route != nil && proto != "http" && proto != "https" {
+		err = fmt.Errorf("Requests can only be routed for http and https tunnels")
+		return
+	}
+
 	switch proto {
 	case "tcp":
-		bindTcp := func(port int) error {
-			if t.listener, err = net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("0.0.0.0"), Port: port}); err != nil {
-				err = t.ctl.conn.Error("Error binding TCP listener: %v", err)
-				return err
-			}
+		if err = t.bindPort(t.bindTcp); err != nil {
+			return
+		}
 
-			// create the url
-			addr := t.listener.Addr().(*net.TCPAddr)
-			t.url = fmt.Sprintf("tcp://%s:%d", opts.domain, addr.Port)
-
-			// register it
-			if err = tunnelRegistry.RegisterAndCache(t.url, t); err != nil {
-				// This should never be possible because the OS will
-				// only assign available ports to us.
-				t.listener.Close()
-				err = fmt.Errorf("TCP listener bound, but failed to register %s", t.url)
-				return err
-			}
+	case "udp":
+		if err = t.bindPort(t.bindUdp); err != nil {
+			return
+		}
 
-			go t.listenTcp(t.listener)
-			return nil
+	case "http", "https":
+		l, ok := listeners[proto]
+		if !ok {
+			err = fmt.Errorf("Not listening for %s connections", proto)
+			return
 		}
 
-		// use the custom remote port you asked for
-		if t.req.RemotePort != 0 {
-			bindTcp(int(t.req.RemotePort))
+		// encrypted connections passed through to the client can't be gated
+		if t.req.Oidc != nil && proto == "https" && t.req.ClientTLS {
+			err = fmt.Errorf("An OIDC login can't be required when the client terminates TLS")
 			return
 		}
 
-		// try to return to you the same port you had before
-		cachedUrl := tunnelRegistry.GetCachedRegistration(t)
-		if cachedUrl != "" {
-			var port int
-			parts := strings.Split(cachedUrl, ":")
-			portPart := parts[len(parts)-1]
-			port, err = strconv.Atoi(portPart)
-			if err != nil {
-				t.ctl.conn.Error("Failed to parse cached url port as integer: %s", portPart)
-			} else {
-				// we have a valid, cached port, let's try to bind with it
-				if bindTcp(port) != nil {
-					t.ctl.conn.Warn("Failed to get custom port %d: %v, trying a random one", port, err)
-				} else {
-					// success, we're done
-					return
-				}
-			}
+		if t.httpAuth != nil && proto == "https" && t.req.ClientTLS {
+			err = fmt.Errorf("Http auth can't be required when the client terminates TLS")
+			return
 		}
 
-		// Bind for TCP connections
-		bindTcp(0)
-		return
+		if t.route != nil && proto == "https" && t.req.ClientTLS {
+			err = fmt.Errorf("Requests can't be routed when the client terminates TLS")
+			return
+		}
 
-	case "http", "https":
-		l, ok := listeners[proto]
+		if t.oidc, err = newOidcGate(t.req.Oidc); err != nil {
+			return
+		}
+
+		if err = registerVhost(t, proto, l.Addr.(*net.TCPAddr).Port); err != nil {
+			return
+		}
+
+		// only https connections can be passed through to the client
+		if proto != "https" {
+			t.req.ClientTLS = false
+		}
+
+	case "tls":
+		// tls tunnels share the https listener, connections are routed by SNI
+		l, ok := listeners["https"]
 		if !ok {
 			err = fmt.Errorf("Not listening for %s connections", proto)
 			return
@@ -174,40 +264,131 @@ func NewTunnel(m *msg.ReqTunnel, ctl *Control) (t *Tunnel, err error) {
 		return
 	}
 
-	// pre-encode the http basic auth for fast comparisons later
-	if m.HttpAuth != "" {
-		m.HttpAuth = "Basic " + base64.StdEncoding.EncodeToString([]byte(m.HttpAuth))
-	}
-
 	t.AddLogPrefix(t.Id())
 	t.Info("Registered new tunnel on: %s", t.ctl.conn.Id())
+	if rate := t.RateLimit(); rate > 0 {
+		t.Info("Limited to %d bytes a second in each direction", rate)
+	}
 
 	metrics.OpenTunnel(t)
 	return
 }
 
+// Binds a public port for a tcp or udp tunnel with bind: the port the client
+// asked for, or the one it had before, or else a random one
+func (t *Tunnel) bindPort(bind func(port int) error) (err error) {
+	// use the custom remote port you asked for
+	if t.req.RemotePort != 0 {
+		return bind(int(t.req.RemotePort))
+	}
+
+	// try to return to you the same port you had before
+	cachedUrl := tunnelRegistry.GetCachedRegistration(t)
+	if cachedUrl != "" {
+		parts := strings.Split(cachedUrl, ":")
+		portPart := parts[len(parts)-1]
+		port, err := strconv.Atoi(portPart)
+		if err != nil {
+			t.ctl.conn.Error("Failed to parse cached url port as integer: %s", portPart)
+		} else {
+			// we have a valid, cached port, let's try to bind with it
+			if err = bind(port); err != nil {
+				t.ctl.conn.Warn("Failed to get custom port %d: %v, trying a random one", port, err)
+			} else {
+				// success, we're done
+				return nil
+			}
+		}
+	}
+
+	// Bind a random port, trying again if the OS picks
+	// a port which is reserved for another user
+	for i := 0; i < maxBindAttempts; i++ {
+		if err = bind(0); err == nil {
+			break
+		}
+	}
+
+	return
+}
+
+func (t *Tunnel) bindTcp(port int) (err error) {
+	// don't even bind a port that's reserved for someone else
+	if port != 0 {
+		if err = tunnelRegistry.Authorize(fmt.Sprintf("tcp://%s:%d", opts.domain, port), t); err != nil {
+			return err
+		}
+	}
+
+	if t.listener, err = net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("0.0.0.0"), Port: port}); err != nil {
+		err = t.ctl.conn.Error("Error binding TCP listener: %v", err)
+		return err
+	}
+
+	// create the url
+	addr := t.listener.Addr().(*net.TCPAddr)
+	t.url = fmt.Sprintf("tcp://%s:%d", opts.domain, addr.Port)
+
+	// register it
+	if err = tunnelRegistry.RegisterAndCache(t.url, t); err != nil {
+		// The OS will only assign available ports to us, so this
+		// only happens when the port is reserved for another user
+		t.listener.Close()
+		err = fmt.Errorf("TCP listener bound, but failed to register %s: %v", t.url, err)
+		return err
+	}
+
+	go t.listenTcp(t.listener)
+	return nil
+}
+
 func (t *Tunnel) Shutdown() {
-	t.Info("Shutting down")
+	// mark that we're shutting down, tunnels may be shut down
+	// both individually and by their control connection
+	if !atomic.CompareAndSwapInt32(&t.closing, 0, 1) {
+		return
+	}
 
-	// mark that we're shutting down
-	atomic.StoreInt32(&t.closing, 1)
+	t.Info("Shutting down")
 
 	// if we have a public listener (this is a raw TCP tunnel), shut it down
 	if t.listener != nil {
 		t.listener.Close()
 	}
 
-	// remove ourselves from the tunnel registry
-	tunnelRegistry.Del(t.url)
+	// same for the socket of a UDP tunnel
+	if t.udpConn != nil {
+		t.udpConn.Close()
+	}
 
-	// let the control connection know we're shutting down
-	// currently, only the control connection shuts down tunnels,
-	// so it doesn't need to know about it
-	// t.ctl.stoptunnel <- t
+	// remove ourselves from the tunnel registry, or from our group
+	tunnelRegistry.Del(t.url, t)
+	if t.slot != nil {
+		tunnelRegistry.Release(t.slot)
+	}
+
+	// the control connection doesn't need to be told about it here: tunnels
+	// are only shut down by the control connection itself, either when it
+	// stops or when it handles a CloseTunnel message
 
 	metrics.CloseTunnel(t)
 }
 
+// Stops accepting public connections while leaving those already
+// joined with proxy connections alone, ngrokd is going away
+func (t *Tunnel) Drain() {
+	if !atomic.CompareAndSwapInt32(&t.draining, 0, 1) {
+		return
+	}
+
+	if t.listener != nil {
+		t.listener.Close()
+	}
+
+	// a udp socket stays open for the flows which already exist,
+	// listenUdp stops starting new ones
+}
+
 func (t *Tunnel) Id() string {
 	return t.url
 }
@@ -225,8 +406,8 @@ func (t *Tunnel) listenTcp(listener *net.TCPListener) {
 		tcpConn, err := listener.AcceptTCP()
 
 		if err != nil {
-			// not an error, we're shutting down this tunnel
-			if atomic.LoadInt32(&t.closing) == 1 {
+			// not an error, we're shutting down this tunnel or ngrokd
+			if atomic.LoadInt32(&t.closing) == 1 || atomic.LoadInt32(&t.draining) == 1 {
 				return
 			}
 
@@ -238,37 +419,78 @@ func (t *Tunnel) listenTcp(listener *net.TCPListener) {
 		conn.AddLogPrefix(t.Id())
 		conn.Info("New connection from %v", conn.RemoteAddr())
 
+		if !t.AllowConnection(conn) {
+			conn.Close()
+			continue
+		}
+
 		go t.HandlePublicConnection(conn)
 	}
 }
 
-func (t *Tunnel) HandlePublicConnection(publicConn conn.Conn) {
-	defer publicConn.Close()
-	defer func() {
-		if r := recover(); r != nil {
-			publicConn.Warn("HandlePublicConnection failed with error %v", r)
+// Checks a public connection against the tunnel's allow and deny lists
+// before a proxy connection is requested for it. Rejected connections
+// are logged and counted.
+func (t *Tunnel) AllowConnection(c conn.Conn) bool {
+	if t.ipFilter.Allows(c.RemoteAddr()) {
+		return true
+	}
+
+	c.Info("Rejected connection from %v by the tunnel's IP restrictions", c.RemoteAddr())
+	atomic.AddInt64(&t.rejected, 1)
+	metrics.RejectConnection(t, c)
+	return false
+}
+
+// Gets a proxy connection for a public connection. The members of a group
+// fail over to the other members when their client doesn't provide one,
+// which can only be members connected to this node. Returns the member
+// which serves the connection, the public connection the caller counted
+// as active on t is moved to it so it's accounted against that member.
+func (t *Tunnel) startProxy(clientAddr string) (served *Tunnel, proxyConn conn.Conn, err error) {
+	served = t
+	proxyConn, err = t.requestProxy(clientAddr)
+	if err == nil || t.group == nil {
+		return
+	}
+
+	tried := []*Tunnel{t}
+	for {
+		t.group.Failed(tried[len(tried)-1])
+
+		m := t.group.Pick(tried...)
+		if m == nil {
+			return
 		}
-	}()
 
-	startTime := time.Now()
-	metrics.OpenConnection(t, publicConn)
+		t.Info("Failing over to the tunnel of client %s", m.ctl.Id())
+		atomic.AddInt64(&served.activeConnections, -1)
+		atomic.AddInt64(&m.activeConnections, 1)
+		served = m
+
+		if proxyConn, err = m.requestProxy(clientAddr); err == nil {
+			return
+		}
+		tried = append(tried, m)
+	}
+}
 
-	var proxyConn conn.Conn
-	var err error
+// Gets a proxy connection from the client and tells the client
+// which tunnel and public client it's going to be used for
+func (t *Tunnel) requestProxy(clientAddr string) (proxyConn conn.Conn, err error) {
 	for i := 0; i < (2 * proxyMaxPoolSize); i++ {
 		// get a proxy connection
 		if proxyConn, err = t.ctl.GetProxy(); err != nil {
 			t.Warn("Failed to get proxy connection: %v", err)
 			return
 		}
-		defer proxyConn.Close()
 		t.Info("Got proxy connection %s", proxyConn.Id())
 		proxyConn.AddLogPrefix(t.Id())
 
 		// tell the client we're going to start using this proxy connection
 		startPxyMsg := &msg.StartProxy{
 			Url:        t.url,
-			ClientAddr: publicConn.RemoteAddr().String(),
+			ClientAddr: clientAddr,
 		}
 
 		if err = msg.WriteMsg(proxyConn, startPxyMsg); err != nil {
@@ -281,19 +503,48 @@ func (t *Tunnel) HandlePublicConnection(publicConn conn.Conn) {
 	}
 
 	if err != nil {
-		// give up
-		publicConn.Error("Too many failures starting proxy connection")
-		return
+		return nil, fmt.Errorf("Too many failures starting proxy connection")
 	}
 
 	// To reduce latency handling tunnel connections, we employ the following curde heuristic:
 	// Whenever we take a proxy connection from the pool, replace it with a new one
-	util.PanicToError(func() { t.ctl.out <- &msg.ReqProxy{} })
+	// Multiplexed sessions have no pool, they open a stream for every connection
+	if t.ctl.mux == nil {
+		util.PanicToError(func() { t.ctl.out <- &msg.ReqProxy{} })
+	}
+
+	return
+}
+
+func (t *Tunnel) HandlePublicConnection(publicConn conn.Conn) {
+	defer publicConn.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			publicConn.Warn("HandlePublicConnection failed with error %v", r)
+		}
+	}()
+
+	startTime := time.Now()
+	atomic.AddInt64(&t.activeConnections, 1)
+	served, proxyConn, err := t.startProxy(publicConn.RemoteAddr().String())
+	defer atomic.AddInt64(&served.activeConnections, -1)
+
+	metrics.OpenConnection(served, publicConn)
+	atomic.AddInt64(&served.connections, 1)
+	if err != nil {
+		// give up
+		publicConn.Error("%v", err)
+		return
+	}
+	defer proxyConn.Close()
 
 	// no timeouts while connections are joined
 	proxyConn.SetDeadline(time.Time{})
 
-	// join the public and proxy connections
-	bytesIn, bytesOut := conn.Join(publicConn, proxyConn)
-	metrics.CloseConnection(t, publicConn, startTime, bytesIn, bytesOut)
+	// join the public and proxy connections, shaping both directions
+	fromPublic, toPublic := served.rateLimiters()
+	bytesIn, bytesOut := conn.Join(conn.Limit(publicConn, fromPublic...), conn.Limit(proxyConn, toPublic...))
+	atomic.AddInt64(&served.bytesIn, bytesIn)
+	atomic.AddInt64(&served.bytesOut, bytesOut)
+	metrics.CloseConnection(served, publicConn, startTime, bytesIn, bytesOut)
 }
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net"
+	"ngrok/conn"
+	"ngrok/msg"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sets up the globals NewTunnel registers vhost tunnels with
+func testTunnelGlobals(t *testing.T) *Control {
+	opts = &Options{domain: "ngrok.test"}
+	policy, _ = NewPolicy("", "ngrok.test")
+	tunnelRegistry = NewTunnelRegistry(16, "", nil)
+	listeners = map[string]*conn.Listener{
+		"http":  {Addr: &net.TCPAddr{Port: 80}},
+		"https": {Addr: &net.TCPAddr{Port: 443}},
+	}
+	metrics = NewLocalMetrics(time.Hour)
+
+	return &Control{auth: &msg.Auth{}, account: &Account{}, conn: testConn(t, "ctl")}
+}
+
+// a logged connection over loopback tcp, closed when the test ends
+func testConn(t *testing.T, typ string) conn.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return conn.Wrap(c, typ)
+}
+
+func TestNewTunnelClientTLS(t *testing.T) {
+	ctl := testTunnelGlobals(t)
+
+	for _, c := range []struct {
+		name string
+		req  msg.ReqTunnel
+		err  string
+	}{
+		{"plain", msg.ReqTunnel{Protocol: "https", Subdomain: "plain", ClientTLS: true}, ""},
+		{"auth", msg.ReqTunnel{Protocol: "https", Subdomain: "auth", ClientTLS: true, HttpAuth: "user:pass"}, "Http auth"},
+		{"users", msg.ReqTunnel{Protocol: "https", Subdomain: "users", ClientTLS: true, HttpAuthUsers: []string{"user:pass"}}, "Http auth"},
+		{"tokens", msg.ReqTunnel{Protocol: "https", Subdomain: "tokens", ClientTLS: true, HttpAuthTokens: []string{"secret"}}, "Http auth"},
+		{"oidc", msg.ReqTunnel{Protocol: "https", Subdomain: "oidc", ClientTLS: true, Oidc: &msg.OidcOptions{Issuer: "https://idp.test", ClientId: "ngrok"}}, "OIDC"},
+		{"http auth", msg.ReqTunnel{Protocol: "http", Subdomain: "httpauth", ClientTLS: true, HttpAuth: "user:pass"}, ""},
+		{"terminated auth", msg.ReqTunnel{Protocol: "https", Subdomain: "terminated", HttpAuth: "user:pass"}, ""},
+	} {
+		req := c.req
+		tun, err := NewTunnel(&req, ctl)
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		case c.err != "" && err == nil:
+			t.Errorf("%s: tunnel was opened, expected an error", c.name)
+		case c.err != "" && !strings.Contains(err.Error(), c.err):
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		}
+
+		if err == nil {
+			tun.Shutdown()
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"ngrok/conn"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// flows which haven't carried a datagram in either direction
+	// for this long are closed along with their proxy connection
+	udpFlowIdleTimeout = 60 * time.Second
+
+	// datagrams waiting for a flow's proxy connection, more are dropped
+	udpFlowQueueSize = 64
+
+	// flows a tunnel carries at once, datagrams from new addresses
+	// are dropped while it has this many
+	udpMaxFlows = 1024
+)
+
+// The datagrams exchanged with one public address of a udp tunnel. Each
+// flow gets its own proxy connection, datagrams are framed with
+// conn.WriteDatagram on it.
+type udpFlow struct {
+	addr *net.UDPAddr
+	in   chan []byte
+
+	// unix nanoseconds, accessed atomically
+	lastActive int64
+}
+
+func (f *udpFlow) touch() {
+	atomic.StoreInt64(&f.lastActive, time.Now().UnixNano())
+}
+
+func (f *udpFlow) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&f.lastActive)))
+}
+
+// The flows of a udp tunnel by public address. Datagrams are queued on
+// flows and flows are removed under the lock, so a flow which has left the
+// table never gets another datagram.
+type udpFlows struct {
+	sync.Mutex
+	flows map[string]*udpFlow
+}
+
+// Removes a flow from the table unless datagrams are waiting for it and
+// force isn't set, returns whether it was removed
+func (fs *udpFlows) remove(f *udpFlow, force bool) bool {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if !force && len(f.in) > 0 {
+		return false
+	}
+
+	key := f.addr.String()
+	if fs.flows[key] == f {
+		delete(fs.flows, key)
+	}
+	return true
+}
+
+func (t *Tunnel) bindUdp(port int) (err error) {
+	// don't even bind a port that's reserved for someone else
+	if port != 0 {
+		if err = tunnelRegistry.Authorize(fmt.Sprintf("udp://%s:%d", opts.domain, port), t); err != nil {
+			return err
+		}
+	}
+
+	if t.udpConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("0.0.0.0"), Port: port}); err != nil {
+		err = t.ctl.conn.Error("Error binding UDP socket: %v", err)
+		return err
+	}
+
+	// create the url
+	addr := t.udpConn.LocalAddr().(*net.UDPAddr)
+	t.url = fmt.Sprintf("udp://%s:%d", opts.domain, addr.Port)
+
+	// register it
+	if err = tunnelRegistry.RegisterAndCache(t.url, t); err != nil {
+		t.udpConn.Close()
+		err = fmt.Errorf("UDP socket bound, but failed to register %s: %v", t.url, err)
+		return err
+	}
+
+	go t.listenUdp()
+	return nil
+}
+
+// Reads datagrams from the internet and hands them to the flow of their
+// source address, starting a new flow for addresses without one
+func (t *Tunnel) listenUdp() {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Warn("listenUdp failed with error %v", r)
+		}
+	}()
+
+	flows := &udpFlows{flows: make(map[string]*udpFlow)}
+
+	buf := make([]byte, conn.MaxDatagramSize)
+	for {
+		n, addr, err := t.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			// not an error, we're shutting down this tunnel
+			if atomic.LoadInt32(&t.closing) == 1 {
+				return
+			}
+
+			t.Error("Failed to read UDP datagram: %v", err)
+			continue
+		}
+
+		if !t.ipFilter.Allows(addr) {
+			t.Debug("Rejected datagram from %v by the tunnel's IP restrictions", addr)
+			atomic.AddInt64(&t.rejected, 1)
+			metrics.RejectConnection(t, nil)
+			continue
+		}
+
+		p := make([]byte, n)
+		copy(p, buf[:n])
+		t.queueDatagram(flows, addr, p)
+	}
+}
+
+// Queues a datagram on the flow of its source address, starting a new flow
+// for addresses without one
+func (t *Tunnel) queueDatagram(flows *udpFlows, addr *net.UDPAddr, p []byte) {
+	flows.Lock()
+	defer flows.Unlock()
+
+	key := addr.String()
+	flow, ok := flows.flows[key]
+	if !ok {
+		// ngrokd is going away and doesn't start new flows
+		if atomic.LoadInt32(&t.draining) == 1 {
+			return
+		}
+
+		if len(flows.flows) >= udpMaxFlows {
+			t.Debug("Dropped datagram from %v, the tunnel has %d flows", addr, len(flows.flows))
+			return
+		}
+
+		flow = &udpFlow{addr: addr, in: make(chan []byte, udpFlowQueueSize)}
+		flow.touch()
+		flows.flows[key] = flow
+
+		go func() {
+			t.handleUdpFlow(flows, flow)
+			flows.remove(flow, true)
+		}()
+	}
+
+	select {
+	case flow.in <- p:
+	default:
+		t.Debug("Dropped datagram from %v, its flow is backed up", addr)
+	}
+}
+
+// Carries the datagrams of a flow over a proxy connection until it's idle
+func (t *Tunnel) handleUdpFlow(flows *udpFlows, f *udpFlow) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Warn("handleUdpFlow failed with error %v", r)
+		}
+	}()
+
+	t.Info("New UDP flow from %v", f.addr)
+
+	startTime := time.Now()
+	atomic.AddInt64(&t.connections, 1)
+	atomic.AddInt64(&t.activeConnections, 1)
+	defer atomic.AddInt64(&t.activeConnections, -1)
+
+	// udp tunnels don't form groups, so t serves all of its flows
+	_, proxyConn, err := t.startProxy(f.addr.String())
+	if err != nil {
+		t.Error("%v", err)
+		return
+	}
+	defer proxyConn.Close()
+
+	// no timeouts, flows end when they're idle
+	proxyConn.SetDeadline(time.Time{})
+	metrics.OpenConnection(t, proxyConn)
+
+	// datagrams are shaped like the bytes of connections, those which
+	// arrive while a flow waits are dropped once its queue is full
+	fromPublic, toPublic := t.rateLimiters()
+
+	// datagrams from the client go back to the public address
+	var bytesIn int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		buf := make([]byte, conn.MaxDatagramSize)
+		for {
+			p, err := conn.ReadDatagram(proxyConn, buf)
+			if err != nil {
+				proxyConn.Debug("Stopped reading datagrams: %v", err)
+				return
+			}
+
+			for _, l := range toPublic {
+				l.Wait(len(p))
+			}
+
+			if _, err = t.udpConn.WriteToUDP(p, f.addr); err != nil {
+				proxyConn.Warn("Failed to write datagram to %v: %v", f.addr, err)
+				return
+			}
+
+			atomic.AddInt64(&bytesIn, int64(len(p)))
+			f.touch()
+		}
+	}()
+
+	var bytesOut int64
+	idleCheck := time.NewTicker(udpFlowIdleTimeout / 4)
+	defer idleCheck.Stop()
+
+loop:
+	for {
+		select {
+		case p := <-f.in:
+			for _, l := range fromPublic {
+				l.Wait(len(p))
+			}
+
+			if err := conn.WriteDatagram(proxyConn, p); err != nil {
+				proxyConn.Warn("Failed to write datagram: %v", err)
+				break loop
+			}
+			bytesOut += int64(len(p))
+			f.touch()
+
+		case <-done:
+			break loop
+
+		case <-idleCheck.C:
+			// an idle flow leaves the table before it stops reading, so
+			// datagrams arriving from now on start a new flow
+			if atomic.LoadInt32(&t.closing) == 1 || (f.idle() > udpFlowIdleTimeout && flows.remove(f, false)) {
+				proxyConn.Info("Closing idle UDP flow from %v", f.addr)
+				break loop
+			}
+		}
+	}
+
+	flows.remove(f, true)
+	proxyConn.Close()
+	<-done
+
+	bytesIn = atomic.LoadInt64(&bytesIn)
+	atomic.AddInt64(&t.bytesIn, bytesIn)
+	atomic.AddInt64(&t.bytesOut, bytesOut)
+	metrics.CloseConnection(t, proxyConn, startTime, bytesIn, bytesOut)
+}
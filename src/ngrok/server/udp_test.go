@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"ngrok/conn"
+	"ngrok/log"
+	"ngrok/msg"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUdpFlowsRemove(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5353}
+	f := &udpFlow{addr: addr, in: make(chan []byte, udpFlowQueueSize)}
+	flows := &udpFlows{flows: map[string]*udpFlow{addr.String(): f}}
+
+	// an idle flow with datagrams waiting keeps running
+	f.in <- []byte("late")
+	if flows.remove(f, false) {
+		t.Fatalf("Flow with a waiting datagram was removed")
+	}
+
+	<-f.in
+	if !flows.remove(f, false) || len(flows.flows) != 0 {
+		t.Fatalf("Idle flow was not removed")
+	}
+
+	// a flow which already left doesn't remove its successor
+	next := &udpFlow{addr: addr, in: make(chan []byte, udpFlowQueueSize)}
+	flows.flows[addr.String()] = next
+	flows.remove(f, true)
+	if flows.flows[addr.String()] != next {
+		t.Fatalf("Flow removed its successor")
+	}
+}
+
+func TestQueueDatagramMaxFlows(t *testing.T) {
+	tun := &Tunnel{Logger: log.NewPrefixLogger()}
+	flows := &udpFlows{flows: make(map[string]*udpFlow)}
+	for i := 0; i < udpMaxFlows; i++ {
+		addr := &net.UDPAddr{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 5353}
+		flows.flows[addr.String()] = &udpFlow{addr: addr, in: make(chan []byte, udpFlowQueueSize)}
+	}
+
+	// new addresses are dropped while the tunnel is full
+	tun.queueDatagram(flows, &net.UDPAddr{IP: net.IPv4(10, 1, 0, 0), Port: 5353}, []byte("new"))
+	if len(flows.flows) != udpMaxFlows {
+		t.Fatalf("Tunnel has %d flows, expected at most %d", len(flows.flows), udpMaxFlows)
+	}
+
+	// existing flows still get their datagrams
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 7), Port: 5353}
+	tun.queueDatagram(flows, addr, []byte("known"))
+	if p := <-flows.flows[addr.String()].in; string(p) != "known" {
+		t.Fatalf("Flow got %q", p)
+	}
+
+	// datagrams beyond a flow's queue are dropped instead of blocking
+	for i := 0; i < udpFlowQueueSize+1; i++ {
+		tun.queueDatagram(flows, addr, []byte(fmt.Sprint(i)))
+	}
+	if n := len(flows.flows[addr.String()].in); n != udpFlowQueueSize {
+		t.Fatalf("Flow queued %d datagrams, expected %d", n, udpFlowQueueSize)
+	}
+}
+
+func TestUdpFlowBytes(t *testing.T) {
+	ctl := testTunnelGlobals(t)
+
+	// the client answers one datagram and ends the flow
+	testMuxClient(t, ctl, func(pc conn.Conn) {
+		defer pc.Close()
+		buf := make([]byte, conn.MaxDatagramSize)
+		if _, err := conn.ReadDatagram(pc, buf); err == nil {
+			conn.WriteDatagram(pc, []byte("pong from the client"))
+		}
+	})
+
+	tun, err := NewTunnel(&msg.ReqTunnel{Protocol: "udp"}, ctl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Shutdown()
+
+	port := tun.udpConn.LocalAddr().(*net.UDPAddr).Port
+	public, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+
+	public.SetDeadline(time.Now().Add(5 * time.Second))
+	public.Write([]byte("ping"))
+	buf := make([]byte, 64)
+	n, err := public.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "pong from the client" {
+		t.Fatalf("Public address got %q", buf[:n])
+	}
+
+	// bytes in are those the client sent to the public address, like conn.Join counts them
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt64(&tun.bytesIn) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if in, out := atomic.LoadInt64(&tun.bytesIn), atomic.LoadInt64(&tun.bytesOut); in != int64(n) || out != 4 {
+		t.Fatalf("Flow counted %d bytes in and %d bytes out, expected %d and 4", in, out, n)
+	}
+}